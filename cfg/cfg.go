@@ -1,37 +1,195 @@
 package cfg
 
+import (
+	"fmt"
+)
+
 // QueueItemCfg contains the configuration for a queue
 type QueueItemCfg struct {
 	Location string `json:"location"`
-	Config   string `json:"config"`
+	Config   Config `json:"config"`
+}
+
+// RestartCfg contains the restart policy of a component. Policy is never,
+// on-failure or always, backoffs are durations such as 1s and zero maximum
+// restarts means no limit.
+type RestartCfg struct {
+	Policy      string `json:"policy,omitempty"`
+	Backoff     string `json:"backoff,omitempty"`
+	MaxBackoff  string `json:"maxBackoff,omitempty"`
+	MaxRestarts int    `json:"maxRestarts,omitempty"`
+}
+
+// DeliveryCfg contains the at-least-once delivery of an ingester. InFlight
+// limits the unacknowledged messages, Timeout is how long a message may stay
+// unacknowledged before it is delivered again and MaxAttempts how many times
+// it is delivered before giving up.
+type DeliveryCfg struct {
+	InFlight    int    `json:"inFlight,omitempty"`
+	Timeout     string `json:"timeout,omitempty"`
+	MaxAttempts int    `json:"maxAttempts,omitempty"`
 }
 
-// IngesterItemCfg contains the configuration for an ingester
+// IngesterItemCfg contains the configuration for an ingester. Delivery
+// turns on acknowledgements for the envelopes the ingester puts.
 type IngesterItemCfg struct {
+	Name      string            `json:"name,omitempty"`
 	Location  string            `json:"location"`
-	Config    string            `json:"config"`
+	Config    Config            `json:"config"`
 	QueueItem QueueItemCfg      `json:"queue"`
 	Digesters []DigesterItemCfg `json:"digesters"`
+	Delivery  *DeliveryCfg      `json:"delivery,omitempty"`
+	Restart   RestartCfg        `json:"restart"`
 }
 
-// DigesterItemCfg contains the configuration for a digester
+// DigesterItemCfg contains the configuration for a digester. DeadLetter is
+// the optional queue receiving messages the digester fails to process.
 type DigesterItemCfg struct {
-	Location  string       `json:"location"`
-	Config    string       `json:"config"`
-	QueueItem QueueItemCfg `json:"queue"`
+	Location   string        `json:"location"`
+	Config     Config        `json:"config"`
+	QueueItem  QueueItemCfg  `json:"queue"`
+	DeadLetter *QueueItemCfg `json:"deadLetter,omitempty"`
+	Restart    RestartCfg    `json:"restart"`
 }
 
-// ExpellerItemCfg contains the configuration for an expeller
+// ExpellerItemCfg contains the configuration for an expeller. Routes lists
+// the names of the ingesters the expeller receives from, when empty the
+// expeller receives from every ingester. DeadLetter is the optional queue
+// receiving messages the expeller fails to process.
 type ExpellerItemCfg struct {
 	Location      string            `json:"location"`
-	Config        string            `json:"config"`
-	IngesterItems []IngesterItemCfg `json:"ingesters"`
+	Config        Config            `json:"config"`
+	IngesterItems []IngesterItemCfg `json:"ingesters,omitempty"`
+	Routes        []string          `json:"routes,omitempty"`
+	DeadLetter    *QueueItemCfg     `json:"deadLetter,omitempty"`
+	Restart       RestartCfg        `json:"restart"`
 }
 
-// ReservoirCfg contains the configuration for the flow
+// ReservoirCfg contains the configuration for the flow. Either a single
+// expeller with nested ingesters, a list of expellers sharing a list of
+// ingesters or a graph may be given.
 type ReservoirCfg struct {
-	Name         string          `json:"name"`
-	ExpellerItem ExpellerItemCfg `json:"expeller"`
+	Name          string            `json:"name"`
+	ExpellerItem  ExpellerItemCfg   `json:"expeller"`
+	IngesterItems []IngesterItemCfg `json:"ingesters,omitempty"`
+	ExpellerItems []ExpellerItemCfg `json:"expellers,omitempty"`
+	Graph         *GraphCfg         `json:"graph,omitempty"`
+}
+
+// ToGraph returns the config in the graph form, converting the nested forms.
+// Generated node ids are ingesterN, ingesterN.digesterM and expellerN, a
+// named ingester uses its name instead.
+func (o ReservoirCfg) ToGraph() (GraphCfg, error) {
+	if o.Graph != nil {
+		if o.ExpellerItem.Location != "" || len(o.IngesterItems) != 0 || len(o.ExpellerItems) != 0 {
+			return GraphCfg{}, fmt.Errorf("%s: graph is mutually exclusive with expeller, expellers and ingesters", o.Name)
+		}
+		return *o.Graph, nil
+	}
+
+	normal, err := o.Normalize()
+	if err != nil {
+		return GraphCfg{}, err
+	}
+	graph := GraphCfg{
+		Nodes: make([]NodeCfg, 0),
+		Edges: make([]EdgeCfg, 0),
+	}
+	tails := make([]string, 0)
+	names := make(map[string]int)
+	for i := range normal.IngesterItems {
+		ingester := normal.IngesterItems[i]
+		id := ingester.Name
+		if id == "" {
+			id = fmt.Sprintf("ingester%d", i)
+		} else {
+			_, ok := names[id]
+			if ok == true {
+				return GraphCfg{}, fmt.Errorf("%s: duplicate ingester name %s", o.Name, id)
+			}
+			names[id] = i
+		}
+		graph.Nodes = append(graph.Nodes, NodeCfg{
+			ID:        id,
+			Kind:      KindIngester,
+			Location:  ingester.Location,
+			Config:    ingester.Config,
+			QueueItem: ingester.QueueItem,
+			Delivery:  ingester.Delivery,
+			Restart:   ingester.Restart,
+		})
+		prev := id
+		for d := range ingester.Digesters {
+			digID := fmt.Sprintf("%s.digester%d", id, d)
+			graph.Nodes = append(graph.Nodes, NodeCfg{
+				ID:         digID,
+				Kind:       KindDigester,
+				Location:   ingester.Digesters[d].Location,
+				Config:     ingester.Digesters[d].Config,
+				QueueItem:  ingester.Digesters[d].QueueItem,
+				DeadLetter: ingester.Digesters[d].DeadLetter,
+				Restart:    ingester.Digesters[d].Restart,
+			})
+			graph.Edges = append(graph.Edges, EdgeCfg{From: prev, To: digID})
+			prev = digID
+		}
+		tails = append(tails, prev)
+	}
+	for e := range normal.ExpellerItems {
+		expeller := normal.ExpellerItems[e]
+		id := fmt.Sprintf("expeller%d", e)
+		graph.Nodes = append(graph.Nodes, NodeCfg{
+			ID:         id,
+			Kind:       KindExpeller,
+			Location:   expeller.Location,
+			Config:     expeller.Config,
+			DeadLetter: expeller.DeadLetter,
+			Restart:    expeller.Restart,
+		})
+		if len(expeller.Routes) == 0 {
+			for t := range tails {
+				graph.Edges = append(graph.Edges, EdgeCfg{From: tails[t], To: id})
+			}
+		}
+		for r := range expeller.Routes {
+			i, ok := names[expeller.Routes[r]]
+			if ok == false {
+				return GraphCfg{}, fmt.Errorf("%s: expeller routes to unknown ingester %s", o.Name, expeller.Routes[r])
+			}
+			graph.Edges = append(graph.Edges, EdgeCfg{From: tails[i], To: id})
+		}
+	}
+	return graph, nil
+}
+
+// Normalize returns the config in the multiple expeller form
+func (o ReservoirCfg) Normalize() (ReservoirCfg, error) {
+	n := ReservoirCfg{
+		Name:          o.Name,
+		IngesterItems: append([]IngesterItemCfg{}, o.IngesterItems...),
+		ExpellerItems: append([]ExpellerItemCfg{}, o.ExpellerItems...),
+	}
+	if o.ExpellerItem.Location != "" {
+		if len(o.ExpellerItems) != 0 {
+			return n, fmt.Errorf("%s: expeller and expellers are mutually exclusive", o.Name)
+		}
+		expeller := o.ExpellerItem
+		expeller.IngesterItems = nil
+		n.ExpellerItems = append(n.ExpellerItems, expeller)
+		n.IngesterItems = append(n.IngesterItems, o.ExpellerItem.IngesterItems...)
+	}
+	for e := range n.ExpellerItems {
+		if len(n.ExpellerItems[e].IngesterItems) != 0 {
+			return n, fmt.Errorf("%s: ingesters must be listed on the reservoir when using expellers", o.Name)
+		}
+	}
+	if len(n.ExpellerItems) == 0 {
+		return n, fmt.Errorf("%s: no expeller found", o.Name)
+	}
+	if len(n.IngesterItems) == 0 {
+		return n, fmt.Errorf("%s: no ingester found", o.Name)
+	}
+	return n, nil
 }
 
 // Cfg configures system
@@ -0,0 +1,79 @@
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Config is the config of a plugin, either the path of a config file or an
+// inline json object kept as compact json text
+type Config string
+
+// Inline returns whether the config is inline json rather than a path
+func (o Config) Inline() bool {
+	return strings.HasPrefix(string(o), "{")
+}
+
+// UnmarshalJSON accepts a path string or a json object
+func (o *Config) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) == true {
+		*o = ""
+		return nil
+	}
+	switch data[0] {
+	case '"':
+		s := ""
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return err
+		}
+		*o = Config(s)
+		return nil
+	case '{':
+		buf := &bytes.Buffer{}
+		err := json.Compact(buf, data)
+		if err != nil {
+			return err
+		}
+		*o = Config(buf.String())
+		return nil
+	}
+	return fmt.Errorf("config must be a path or an object, got %s", data)
+}
+
+// MarshalJSON writes inline configs as objects and paths as strings
+func (o Config) MarshalJSON() ([]byte, error) {
+	if o.Inline() == true && json.Valid([]byte(o)) == true {
+		return []byte(o), nil
+	}
+	return json.Marshal(string(o))
+}
+
+// WithPath calls fn with the path of the config. Inline json is written to
+// a temporary file, removed once fn returns, for plugins whose New reads
+// its config from a path.
+func (o Config) WithPath(fn func(path string) error) error {
+	if o.Inline() == false {
+		return fn(string(o))
+	}
+	f, err := ioutil.TempFile("", "reservoird-config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(string(o))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return fn(f.Name())
+}
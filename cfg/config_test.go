@@ -0,0 +1,79 @@
+package cfg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConfigUnmarshal(t *testing.T) {
+	item := QueueItemCfg{}
+	err := json.Unmarshal([]byte(`{"location": "fifo.so", "config": {"max": 10, "name": "q"}}`), &item)
+	if err != nil {
+		t.Fatalf("error unmarshalling: %v", err)
+	}
+	if item.Config != `{"max":10,"name":"q"}` || item.Config.Inline() == false {
+		t.Errorf("expecting compact inline config but got %s", item.Config)
+	}
+	data, _ := json.Marshal(item)
+	if string(data) != `{"location":"fifo.so","config":{"max":10,"name":"q"}}` {
+		t.Errorf("unexpected json %s", data)
+	}
+
+	err = json.Unmarshal([]byte(`{"config": "fifo.json"}`), &item)
+	if err != nil || item.Config != "fifo.json" || item.Config.Inline() == true {
+		t.Errorf("expecting path config but got %s (%v)", item.Config, err)
+	}
+	err = json.Unmarshal([]byte(`{"config": 10}`), &item)
+	if err == nil {
+		t.Errorf("expecting error for number config")
+	}
+}
+
+func TestConfigWithPath(t *testing.T) {
+	var path string
+	err := Config(`{"max":10}`).WithPath(func(p string) error {
+		path = p
+		data, err := ioutil.ReadFile(p)
+		if err != nil || string(data) != `{"max":10}` {
+			t.Errorf("unexpected config file %s (%v)", data, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) == false {
+		t.Errorf("expecting temporary config removed")
+	}
+	Config("fifo.json").WithPath(func(p string) error {
+		if p != "fifo.json" {
+			t.Errorf("expecting path passed as is but got %s", p)
+		}
+		return nil
+	})
+}
+
+func TestLoadInline(t *testing.T) {
+	os.Setenv("RSV_MAX", "42")
+	defer os.Unsetenv("RSV_MAX")
+	data := `
+reservoirs:
+  - name: inline
+    ingesters:
+      - location: stdin.so
+        config:
+          max: ${RSV_MAX}
+`
+	config, err := Parse([]byte(data), FormatYAML)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	config.Resolve("/opt")
+	ingester := config.Reservoirs[0].IngesterItems[0]
+	if ingester.Config != `{"max":"42"}` || ingester.Location != "/opt/stdin.so" {
+		t.Errorf("unexpected ingester %+v", ingester)
+	}
+}
@@ -0,0 +1,193 @@
+package cfg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Node kinds
+const (
+	KindIngester = "ingester"
+	KindDigester = "digester"
+	KindExpeller = "expeller"
+)
+
+// NodeCfg contains the configuration for one component of a graph. The
+// queue is the output queue of ingesters and digesters and is not used by
+// expellers. DeadLetter is the optional queue of messages a digester or
+// expeller fails to process. Delivery is the optional at-least-once delivery
+// of an ingester. Restart is the policy applied when the component panics or
+// returns early.
+type NodeCfg struct {
+	ID         string        `json:"id"`
+	Kind       string        `json:"kind"`
+	Location   string        `json:"location"`
+	Config     Config        `json:"config"`
+	QueueItem  QueueItemCfg  `json:"queue"`
+	DeadLetter *QueueItemCfg `json:"deadLetter,omitempty"`
+	Delivery   *DeliveryCfg  `json:"delivery,omitempty"`
+	Restart    RestartCfg    `json:"restart"`
+}
+
+// EdgeCfg connects the output of one node to the input of another
+type EdgeCfg struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GraphCfg contains the configuration for a flow as a directed acyclic
+// graph. A node with several outgoing edges sends every message down each
+// edge, a digester with several incoming edges merges them.
+type GraphCfg struct {
+	Nodes []NodeCfg `json:"nodes"`
+	Edges []EdgeCfg `json:"edges"`
+}
+
+// Node returns the node with the given id
+func (o GraphCfg) Node(id string) (NodeCfg, bool) {
+	for n := range o.Nodes {
+		if o.Nodes[n].ID == id {
+			return o.Nodes[n], true
+		}
+	}
+	return NodeCfg{}, false
+}
+
+// Upstream returns the ids feeding a node in edge order
+func (o GraphCfg) Upstream(id string) []string {
+	ids := make([]string, 0)
+	for e := range o.Edges {
+		if o.Edges[e].To == id {
+			ids = append(ids, o.Edges[e].From)
+		}
+	}
+	return ids
+}
+
+// Downstream returns the ids fed by a node in edge order
+func (o GraphCfg) Downstream(id string) []string {
+	ids := make([]string, 0)
+	for e := range o.Edges {
+		if o.Edges[e].From == id {
+			ids = append(ids, o.Edges[e].To)
+		}
+	}
+	return ids
+}
+
+// Validate checks that the graph is a well formed acyclic flow
+func (o GraphCfg) Validate() error {
+	_, err := o.TopologicalOrder()
+	return err
+}
+
+// TopologicalOrder validates the graph and returns the node ids so that
+// every node comes after all of its upstream nodes. Ties keep the order
+// the nodes were declared in.
+func (o GraphCfg) TopologicalOrder() ([]string, error) {
+	err := o.check()
+	if err != nil {
+		return nil, err
+	}
+
+	indegree := make(map[string]int)
+	for e := range o.Edges {
+		indegree[o.Edges[e].To] = indegree[o.Edges[e].To] + 1
+	}
+	order := make([]string, 0)
+	done := make(map[string]bool)
+	for len(order) < len(o.Nodes) {
+		progress := false
+		for n := range o.Nodes {
+			id := o.Nodes[n].ID
+			if done[id] == true || indegree[id] != 0 {
+				continue
+			}
+			done[id] = true
+			order = append(order, id)
+			progress = true
+			for _, down := range o.Downstream(id) {
+				indegree[down] = indegree[down] - 1
+			}
+		}
+		if progress == false {
+			cycle := make([]string, 0)
+			for n := range o.Nodes {
+				if done[o.Nodes[n].ID] == false {
+					cycle = append(cycle, o.Nodes[n].ID)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("cycle detected between %s", strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+// check validates nodes and edges, everything but cycles
+func (o GraphCfg) check() error {
+	if len(o.Nodes) == 0 {
+		return fmt.Errorf("graph has no nodes")
+	}
+	kinds := make(map[string]string)
+	for n := range o.Nodes {
+		node := o.Nodes[n]
+		if node.ID == "" {
+			return fmt.Errorf("node %d: id is required", n)
+		}
+		_, ok := kinds[node.ID]
+		if ok == true {
+			return fmt.Errorf("%s: duplicate node id", node.ID)
+		}
+		switch node.Kind {
+		case KindIngester, KindDigester, KindExpeller:
+		default:
+			return fmt.Errorf("%s: unknown kind %s, expecting ingester, digester or expeller", node.ID, node.Kind)
+		}
+		if node.Kind == KindIngester && node.DeadLetter != nil {
+			return fmt.Errorf("%s: dead-letter queues are only for digesters and expellers", node.ID)
+		}
+		if node.Kind != KindIngester && node.Delivery != nil {
+			return fmt.Errorf("%s: delivery is only for ingesters", node.ID)
+		}
+		kinds[node.ID] = node.Kind
+	}
+
+	edges := make(map[EdgeCfg]bool)
+	for e := range o.Edges {
+		edge := o.Edges[e]
+		from, ok := kinds[edge.From]
+		if ok == false {
+			return fmt.Errorf("edge %s -> %s: unknown node %s", edge.From, edge.To, edge.From)
+		}
+		to, ok := kinds[edge.To]
+		if ok == false {
+			return fmt.Errorf("edge %s -> %s: unknown node %s", edge.From, edge.To, edge.To)
+		}
+		if edge.From == edge.To {
+			return fmt.Errorf("edge %s -> %s: cycle detected", edge.From, edge.To)
+		}
+		if from == KindExpeller {
+			return fmt.Errorf("edge %s -> %s: expellers cannot have downstream nodes", edge.From, edge.To)
+		}
+		if to == KindIngester {
+			return fmt.Errorf("edge %s -> %s: ingesters cannot have upstream nodes", edge.From, edge.To)
+		}
+		if edges[edge] == true {
+			return fmt.Errorf("edge %s -> %s: duplicate edge", edge.From, edge.To)
+		}
+		edges[edge] = true
+	}
+
+	for n := range o.Nodes {
+		node := o.Nodes[n]
+		if node.Kind != KindExpeller && len(o.Downstream(node.ID)) == 0 {
+			return fmt.Errorf("%s: %s has no downstream nodes", node.ID, node.Kind)
+		}
+		if node.Kind != KindIngester && len(o.Upstream(node.ID)) == 0 {
+			return fmt.Errorf("%s: %s has no upstream nodes", node.ID, node.Kind)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package cfg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testGraph() GraphCfg {
+	return GraphCfg{
+		Nodes: []NodeCfg{
+			{ID: "out", Kind: KindExpeller},
+			{ID: "dig", Kind: KindDigester},
+			{ID: "in", Kind: KindIngester},
+		},
+		Edges: []EdgeCfg{
+			{From: "in", To: "dig"},
+			{From: "dig", To: "out"},
+		},
+	}
+}
+
+func TestGraphTopologicalOrder(t *testing.T) {
+	order, err := testGraph().TopologicalOrder()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"in", "dig", "out"}
+	if reflect.DeepEqual(order, expected) == false {
+		t.Errorf("expecting %v, got %v", expected, order)
+	}
+}
+
+func TestGraphCycle(t *testing.T) {
+	graph := testGraph()
+	graph.Nodes = append(graph.Nodes, NodeCfg{ID: "loop", Kind: KindDigester})
+	graph.Edges = append(graph.Edges,
+		EdgeCfg{From: "dig", To: "loop"},
+		EdgeCfg{From: "loop", To: "dig"},
+	)
+	err := graph.Validate()
+	if err == nil || strings.Contains(err.Error(), "cycle detected between dig, loop") == false {
+		t.Errorf("expecting cycle error, got %v", err)
+	}
+}
+
+func TestGraphValidate(t *testing.T) {
+	tests := map[string]func(*GraphCfg){
+		"duplicate node id": func(g *GraphCfg) {
+			g.Nodes = append(g.Nodes, NodeCfg{ID: "dig", Kind: KindDigester})
+		},
+		"unknown kind": func(g *GraphCfg) {
+			g.Nodes[0].Kind = "sink"
+		},
+		"unknown node": func(g *GraphCfg) {
+			g.Edges = append(g.Edges, EdgeCfg{From: "dig", To: "nowhere"})
+		},
+		"expellers cannot have downstream nodes": func(g *GraphCfg) {
+			g.Edges = append(g.Edges, EdgeCfg{From: "out", To: "dig"})
+		},
+		"ingesters cannot have upstream nodes": func(g *GraphCfg) {
+			g.Edges = append(g.Edges, EdgeCfg{From: "dig", To: "in"})
+		},
+		"duplicate edge": func(g *GraphCfg) {
+			g.Edges = append(g.Edges, EdgeCfg{From: "in", To: "dig"})
+		},
+		"has no upstream nodes": func(g *GraphCfg) {
+			g.Edges = g.Edges[:1]
+		},
+		"has no downstream nodes": func(g *GraphCfg) {
+			g.Nodes = append(g.Nodes, NodeCfg{ID: "idle", Kind: KindIngester})
+		},
+		"dead-letter queues are only for digesters and expellers": func(g *GraphCfg) {
+			g.Nodes[2].DeadLetter = &QueueItemCfg{}
+		},
+		"delivery is only for ingesters": func(g *GraphCfg) {
+			g.Nodes[1].Delivery = &DeliveryCfg{}
+		},
+	}
+	for expected, modify := range tests {
+		graph := testGraph()
+		modify(&graph)
+		err := graph.Validate()
+		if err == nil || strings.Contains(err.Error(), expected) == false {
+			t.Errorf("expecting %q error, got %v", expected, err)
+		}
+	}
+}
+
+func TestReservoirCfgToGraph(t *testing.T) {
+	config := ReservoirCfg{
+		Name: "legacy",
+		ExpellerItem: ExpellerItemCfg{
+			Location: "out.so",
+			IngesterItems: []IngesterItemCfg{
+				{
+					Location:  "in.so",
+					Digesters: []DigesterItemCfg{{Location: "dig.so"}},
+				},
+			},
+		},
+	}
+	graph, err := config.ToGraph()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	order, err := graph.TopologicalOrder()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"ingester0", "ingester0.digester0", "expeller0"}
+	if reflect.DeepEqual(order, expected) == false {
+		t.Errorf("expecting %v, got %v", expected, order)
+	}
+	node, _ := graph.Node("ingester0.digester0")
+	if node.Kind != KindDigester || node.Location != "dig.so" {
+		t.Errorf("expecting digester dig.so, got %v", node)
+	}
+}
@@ -0,0 +1,244 @@
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config file formats
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Scheme prefixes of locations that are not plain paths, see run
+const (
+	builtinScheme = "builtin:"
+	execScheme    = "exec:"
+)
+
+// variable matches ${VAR} and ${VAR:-default}
+var variable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Format returns the format of a config file by extension, json unless
+// .yaml, .yml or .toml
+func Format(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// Load reads a config file in the format given by its extension,
+// substituting environment variables and resolving relative locations and
+// configs against the directory of the file
+func Load(path string) (Cfg, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Cfg{}, err
+	}
+	config, err := Parse(data, Format(path))
+	if err != nil {
+		return Cfg{}, fmt.Errorf("%s: %v", path, err)
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return Cfg{}, err
+	}
+	config.Resolve(dir)
+	return config, nil
+}
+
+// Parse decodes a config substituting ${VAR} and ${VAR:-default} in string
+// values, the default is used when VAR is unset or empty
+func Parse(data []byte, format string) (Cfg, error) {
+	var tree interface{}
+	var err error
+	switch format {
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&tree)
+	case FormatYAML:
+		err = yaml.Unmarshal(data, &tree)
+	case FormatTOML:
+		tree = make(map[string]interface{})
+		_, err = toml.Decode(string(data), &tree)
+	default:
+		err = fmt.Errorf("%s: unknown format, expecting json, yaml or toml", format)
+	}
+	if err != nil {
+		return Cfg{}, err
+	}
+	tree, err = expand(tree)
+	if err != nil {
+		return Cfg{}, err
+	}
+	data, err = json.Marshal(tree)
+	if err != nil {
+		return Cfg{}, err
+	}
+	config := Cfg{}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// Expand substitutes environment variables in a string
+func Expand(s string) string {
+	return variable.ReplaceAllStringFunc(s, func(match string) string {
+		groups := variable.FindStringSubmatch(match)
+		value := os.Getenv(groups[1])
+		if value == "" && groups[2] != "" {
+			return groups[3]
+		}
+		return value
+	})
+}
+
+// expand substitutes environment variables in the strings of a decoded
+// tree, converting yaml maps to json compatible maps
+func expand(tree interface{}) (interface{}, error) {
+	switch v := tree.(type) {
+	case string:
+		return Expand(v), nil
+	case []interface{}:
+		for i := range v {
+			item, err := expand(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+		return v, nil
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i := range v {
+			item, err := expand(v[i])
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	case map[string]interface{}:
+		for key := range v {
+			item, err := expand(v[key])
+			if err != nil {
+				return nil, err
+			}
+			v[key] = item
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key := range v {
+			s, ok := key.(string)
+			if ok == false {
+				return nil, fmt.Errorf("%v: keys must be strings", key)
+			}
+			item, err := expand(v[key])
+			if err != nil {
+				return nil, err
+			}
+			m[s] = item
+		}
+		return m, nil
+	}
+	return tree, nil
+}
+
+// resolve makes a relative path absolute against dir, leaving builtin
+// locations and absolute paths alone
+func resolve(dir string, path string) string {
+	if path == "" || strings.HasPrefix(path, builtinScheme) == true {
+		return path
+	}
+	if strings.HasPrefix(path, execScheme) == true {
+		return execScheme + resolve(dir, strings.TrimPrefix(path, execScheme))
+	}
+	if filepath.IsAbs(path) == true {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// resolveConfig resolves the path of a config, leaving inline json alone
+func resolveConfig(dir string, config Config) Config {
+	if config.Inline() == true {
+		return config
+	}
+	return Config(resolve(dir, string(config)))
+}
+
+// resolveQueue resolves the paths of a queue
+func resolveQueue(dir string, queue *QueueItemCfg) {
+	queue.Location = resolve(dir, queue.Location)
+	queue.Config = resolveConfig(dir, queue.Config)
+}
+
+// resolveDeadLetter resolves the paths of an optional dead-letter queue
+func resolveDeadLetter(dir string, queue *QueueItemCfg) {
+	if queue != nil {
+		resolveQueue(dir, queue)
+	}
+}
+
+// resolveIngester resolves the paths of an ingester and its digesters
+func resolveIngester(dir string, ingester *IngesterItemCfg) {
+	ingester.Location = resolve(dir, ingester.Location)
+	ingester.Config = resolveConfig(dir, ingester.Config)
+	resolveQueue(dir, &ingester.QueueItem)
+	for d := range ingester.Digesters {
+		digester := &ingester.Digesters[d]
+		digester.Location = resolve(dir, digester.Location)
+		digester.Config = resolveConfig(dir, digester.Config)
+		resolveQueue(dir, &digester.QueueItem)
+		resolveDeadLetter(dir, digester.DeadLetter)
+	}
+}
+
+// resolveExpeller resolves the paths of an expeller and nested ingesters
+func resolveExpeller(dir string, expeller *ExpellerItemCfg) {
+	expeller.Location = resolve(dir, expeller.Location)
+	expeller.Config = resolveConfig(dir, expeller.Config)
+	resolveDeadLetter(dir, expeller.DeadLetter)
+	for i := range expeller.IngesterItems {
+		resolveIngester(dir, &expeller.IngesterItems[i])
+	}
+}
+
+// Resolve makes relative plugin locations and configs absolute against dir
+func (o *Cfg) Resolve(dir string) {
+	for r := range o.Reservoirs {
+		reservoir := &o.Reservoirs[r]
+		resolveExpeller(dir, &reservoir.ExpellerItem)
+		for e := range reservoir.ExpellerItems {
+			resolveExpeller(dir, &reservoir.ExpellerItems[e])
+		}
+		for i := range reservoir.IngesterItems {
+			resolveIngester(dir, &reservoir.IngesterItems[i])
+		}
+		if reservoir.Graph != nil {
+			for n := range reservoir.Graph.Nodes {
+				node := &reservoir.Graph.Nodes[n]
+				node.Location = resolve(dir, node.Location)
+				node.Config = resolveConfig(dir, node.Config)
+				resolveQueue(dir, &node.QueueItem)
+				resolveDeadLetter(dir, node.DeadLetter)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const loadJSON = `{
+	"reservoirs": [
+		{
+			"name": "${RSV_NAME:-json}",
+			"ingesters": [
+				{
+					"location": "${RSV_PLUGINS}/stdin.so",
+					"config": "stdin.json",
+					"queue": {"location": "builtin:com.github.reservoird.reservoird.disk", "config": "/etc/disk.json"}
+				}
+			],
+			"expellers": [
+				{"location": "exec:bin/stdout", "restart": {"maxRestarts": 3}}
+			]
+		}
+	]
+}`
+
+const loadYAML = `
+reservoirs:
+  - name: ${RSV_NAME:-yaml}
+    ingesters:
+      - location: ${RSV_PLUGINS}/stdin.so
+        config: stdin.json
+        queue:
+          location: builtin:com.github.reservoird.reservoird.disk
+          config: /etc/disk.json
+    expellers:
+      - location: exec:bin/stdout
+        restart:
+          maxRestarts: 3
+`
+
+const loadTOML = `
+[[reservoirs]]
+name = "${RSV_NAME:-toml}"
+
+  [[reservoirs.ingesters]]
+  location = "${RSV_PLUGINS}/stdin.so"
+  config = "stdin.json"
+
+    [reservoirs.ingesters.queue]
+    location = "builtin:com.github.reservoird.reservoird.disk"
+    config = "/etc/disk.json"
+
+  [[reservoirs.expellers]]
+  location = "exec:bin/stdout"
+
+    [reservoirs.expellers.restart]
+    maxRestarts = 3
+`
+
+func TestFormat(t *testing.T) {
+	formats := map[string]string{
+		"a.json": FormatJSON,
+		"a.YML":  FormatYAML,
+		"a.yaml": FormatYAML,
+		"a.toml": FormatTOML,
+		"a.conf": FormatJSON,
+	}
+	for path, format := range formats {
+		if Format(path) != format {
+			t.Errorf("%s: expecting %s but got %s", path, format, Format(path))
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	os.Setenv("RSV_TEST_SET", "set")
+	os.Setenv("RSV_TEST_EMPTY", "")
+	defer os.Unsetenv("RSV_TEST_SET")
+	defer os.Unsetenv("RSV_TEST_EMPTY")
+	values := map[string]string{
+		"${RSV_TEST_SET}":                     "set",
+		"a/${RSV_TEST_SET}/b":                 "a/set/b",
+		"${RSV_TEST_UNSET}":                   "",
+		"${RSV_TEST_UNSET:-default}":          "default",
+		"${RSV_TEST_EMPTY:-default}":          "default",
+		"${RSV_TEST_SET:-default}":            "set",
+		"$RSV_TEST_SET":                       "$RSV_TEST_SET",
+		"${RSV_TEST_UNSET:-}-${RSV_TEST_SET}": "-set",
+	}
+	for s, expected := range values {
+		if Expand(s) != expected {
+			t.Errorf("%s: expecting %q but got %q", s, expected, Expand(s))
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfg")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("RSV_PLUGINS", "/opt/plugins")
+	defer os.Unsetenv("RSV_PLUGINS")
+
+	files := map[string]string{
+		"config.json": loadJSON,
+		"config.yaml": loadYAML,
+		"config.toml": loadTOML,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(data), 0644)
+		config, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: error loading: %v", name, err)
+		}
+		if len(config.Reservoirs) != 1 {
+			t.Fatalf("%s: expecting 1 reservoir but got %d", name, len(config.Reservoirs))
+		}
+		reservoir := config.Reservoirs[0]
+		if reservoir.Name != Format(name) {
+			t.Errorf("%s: expecting default name %s but got %s", name, Format(name), reservoir.Name)
+		}
+		ingester := reservoir.IngesterItems[0]
+		if ingester.Location != "/opt/plugins/stdin.so" {
+			t.Errorf("%s: unexpected location %s", name, ingester.Location)
+		}
+		if string(ingester.Config) != filepath.Join(dir, "stdin.json") {
+			t.Errorf("%s: unexpected config %s", name, ingester.Config)
+		}
+		if ingester.QueueItem.Location != "builtin:com.github.reservoird.reservoird.disk" || ingester.QueueItem.Config != "/etc/disk.json" {
+			t.Errorf("%s: unexpected queue %+v", name, ingester.QueueItem)
+		}
+		expeller := reservoir.ExpellerItems[0]
+		if expeller.Location != "exec:"+filepath.Join(dir, "bin/stdout") {
+			t.Errorf("%s: unexpected expeller location %s", name, expeller.Location)
+		}
+		if expeller.Restart.MaxRestarts != 3 {
+			t.Errorf("%s: expecting 3 max restarts but got %d", name, expeller.Restart.MaxRestarts)
+		}
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	_, err := Parse([]byte("reservoirs: [:"), FormatYAML)
+	if err == nil {
+		t.Errorf("expecting error for bad yaml")
+	}
+	_, err = Parse([]byte("{}"), "xml")
+	if err == nil {
+		t.Errorf("expecting error for unknown format")
+	}
+}
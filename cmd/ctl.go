@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/ctl"
+	"github.com/reservoird/reservoird/ver"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of ctl commands
+const (
+	ctlExitError    = 1
+	ctlExitUsage    = 2
+	ctlExitNotFound = 3
+	ctlExitConflict = 4
+)
+
+var ctlOutput string
+var ctlStopMode string
+var ctlConfig string
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Controls a running reservoird through its rest interface",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if ctlOutput != "table" && ctlOutput != "json" {
+			fmt.Printf("%s: unknown output, expecting table or json\n", ctlOutput)
+			os.Exit(ctlExitUsage)
+		}
+	},
+}
+
+// ctlExit exits with the code matching an error, 3 for not found and 4 for
+// conflicts
+func ctlExit(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Println(err)
+	if ctl.IsNotFound(err) == true {
+		os.Exit(ctlExitNotFound)
+	}
+	if ctl.IsConflict(err) == true {
+		os.Exit(ctlExitConflict)
+	}
+	os.Exit(ctlExitError)
+}
+
+// ctlJSON prints a value as indented json
+func ctlJSON(value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	ctlExit(err)
+	fmt.Printf("%s\n", data)
+}
+
+// ctlTable prints tab separated rows as aligned columns
+func ctlTable(rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for r := range rows {
+		fmt.Fprintf(w, "%s\n", strings.Join(rows[r], "\t"))
+	}
+	w.Flush()
+}
+
+// state returns how a reservoir is shown
+func state(reservoir ctl.Reservoir) string {
+	if reservoir.Disposed == true {
+		return "disposed"
+	}
+	if reservoir.Stopped == true {
+		return "stopped"
+	}
+	return "running"
+}
+
+// restarts totals the restarts of a reservoir
+func restarts(reservoir ctl.Reservoir) int {
+	total := 0
+	for s := range reservoir.Supervisors {
+		total = total + reservoir.Supervisors[s].Restarts
+	}
+	return total
+}
+
+var ctlListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists reservoirs",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		reservoirs, err := ctl.NewClient(Address).List()
+		ctlExit(err)
+		if ctlOutput == "json" {
+			ctlJSON(reservoirs)
+			return
+		}
+		rows := [][]string{{"NAME", "STATE", "COMPONENTS", "RESTARTS"}}
+		for _, reservoir := range reservoirs {
+			rows = append(rows, []string{
+				reservoir.Name,
+				state(reservoir),
+				fmt.Sprintf("%d", len(reservoir.Flow)),
+				fmt.Sprintf("%d", restarts(reservoir)),
+			})
+		}
+		ctlTable(rows)
+	},
+}
+
+var ctlGetCmd = &cobra.Command{
+	Use:   "get NAME",
+	Short: "Shows a reservoir with its flow and supervisors",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reservoir, err := ctl.NewClient(Address).Get(args[0])
+		ctlExit(err)
+		if ctlOutput == "json" {
+			ctlJSON(reservoir)
+			return
+		}
+		ctlTable([][]string{
+			{"NAME", "STATE", "RESTARTS"},
+			{reservoir.Name, state(reservoir), fmt.Sprintf("%d", restarts(reservoir))},
+		})
+		fmt.Println()
+		rows := [][]string{{"ID", "NAME", "POLICY", "RESTARTS", "PANICS", "LAST ERROR"}}
+		for _, s := range reservoir.Supervisors {
+			rows = append(rows, []string{
+				s.ID,
+				s.Name,
+				s.Policy,
+				fmt.Sprintf("%d", s.Restarts),
+				fmt.Sprintf("%d", s.Panics),
+				s.LastError,
+			})
+		}
+		ctlTable(rows)
+	},
+}
+
+var ctlStartCmd = &cobra.Command{
+	Use:   "start NAME...",
+	Short: "Starts reservoirs",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := ctl.NewClient(Address)
+		for _, name := range args {
+			ctlExit(client.Start(name))
+			fmt.Printf("%s: started\n", name)
+		}
+	},
+}
+
+var ctlStopCmd = &cobra.Command{
+	Use:   "stop NAME...",
+	Short: "Stops reservoirs",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := ctl.NewClient(Address)
+		for _, name := range args {
+			ctlExit(client.Stop(name, ctlStopMode))
+			fmt.Printf("%s: stopped\n", name)
+		}
+	},
+}
+
+var ctlDisposeCmd = &cobra.Command{
+	Use:   "dispose NAME...",
+	Short: "Disposes stopped reservoirs",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := ctl.NewClient(Address)
+		for _, name := range args {
+			ctlExit(client.Dispose(name))
+			fmt.Printf("%s: disposed\n", name)
+		}
+	},
+}
+
+var ctlCreateCmd = &cobra.Command{
+	Use:   "create -c config [NAME...]",
+	Short: "Creates the reservoirs of a config file, or only those named",
+	Run: func(cmd *cobra.Command, args []string) {
+		rsv, err := cfg.Load(ctlConfig)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(ctlExitUsage)
+		}
+		wanted := make(map[string]bool)
+		for _, name := range args {
+			wanted[name] = true
+		}
+		client := ctl.NewClient(Address)
+		for _, reservoir := range rsv.Reservoirs {
+			if len(wanted) != 0 && wanted[reservoir.Name] == false {
+				continue
+			}
+			delete(wanted, reservoir.Name)
+			ctlExit(client.Create(reservoir))
+			fmt.Printf("%s: created\n", reservoir.Name)
+		}
+		for name := range wanted {
+			fmt.Printf("%s: not found in %s\n", name, ctlConfig)
+			os.Exit(ctlExitNotFound)
+		}
+	},
+}
+
+var ctlStatsCmd = &cobra.Command{
+	Use:   "stats [NAME]",
+	Short: "Shows the queues of a reservoir or the runtime stats of the server",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := ctl.NewClient(Address)
+		if len(args) == 0 {
+			stats, err := client.Runtime()
+			ctlExit(err)
+			if ctlOutput == "json" {
+				ctlJSON(stats)
+				return
+			}
+			heap := "-"
+			if stats.MemStats != nil {
+				heap = fmt.Sprintf("%d", stats.MemStats.HeapAlloc)
+			}
+			ctlTable([][]string{
+				{"CPUS", "GOROUTINES", "HEAP", "GO"},
+				{fmt.Sprintf("%d", stats.CPUs), fmt.Sprintf("%d", stats.Goroutines), heap, stats.Goversion},
+			})
+			return
+		}
+		queues, err := client.Queues(args[0])
+		ctlExit(err)
+		if ctlOutput == "json" {
+			ctlJSON(queues)
+			return
+		}
+		rows := [][]string{{"INDEX", "ID", "NAME", "LEN", "CAP", "TAPS", "INJECTED"}}
+		for _, q := range queues {
+			rows = append(rows, []string{
+				fmt.Sprintf("%d", q.Index),
+				q.ID,
+				q.Name,
+				fmt.Sprintf("%d", q.Len),
+				fmt.Sprintf("%d", q.Cap),
+				fmt.Sprintf("%d", q.Taps),
+				fmt.Sprintf("%d", q.Injected),
+			})
+		}
+		ctlTable(rows)
+	},
+}
+
+var ctlVersionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Shows the client and server versions",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		server, err := ctl.NewClient(Address).Version()
+		ctlExit(err)
+		client := ver.NewVersion()
+		if ctlOutput == "json" {
+			ctlJSON(map[string]interface{}{
+				"client": client,
+				"server": server,
+			})
+			return
+		}
+		ctlTable([][]string{
+			{"", "VERSION", "HASH", "GO", "ICD"},
+			{"client", client.GitVersion, client.GitHash, client.GoVersion, client.ICDVersion},
+			{"server", server.GitVersion, server.GitHash, server.GoVersion, server.ICDVersion},
+		})
+	},
+}
+
+func init() {
+	ctlCmd.PersistentFlags().StringVarP(&ctlOutput, "output", "o", "table", "output format, table or json")
+	ctlStopCmd.Flags().StringVarP(&ctlStopMode, "mode", "m", "", "stop mode, drain or immediate (default)")
+	ctlCreateCmd.Flags().StringVarP(&ctlConfig, "config", "c", "", "reservoird config file, json, yaml or toml (required)")
+	ctlCreateCmd.MarkFlagRequired("config")
+	ctlCmd.AddCommand(ctlListCmd, ctlGetCmd, ctlStartCmd, ctlStopCmd, ctlDisposeCmd, ctlCreateCmd, ctlStatsCmd, ctlVersionCmd)
+	rootCmd.AddCommand(ctlCmd)
+}
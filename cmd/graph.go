@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/viz"
+	"github.com/spf13/cobra"
+)
+
+var graphFormat string
+var graphCmd = &cobra.Command{
+	Use:   "graph -c config [NAME...]",
+	Short: "Renders the topology of the reservoirs in a config, or only those named",
+	Run: func(cmd *cobra.Command, args []string) {
+		rsv, err := cfg.Load(config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		wanted := make(map[string]bool)
+		for _, name := range args {
+			wanted[name] = true
+		}
+		graphs := make([]viz.Graph, 0)
+		for _, reservoir := range rsv.Reservoirs {
+			if len(wanted) != 0 && wanted[reservoir.Name] == false {
+				continue
+			}
+			delete(wanted, reservoir.Name)
+			graph, err := viz.FromConfig(reservoir)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			graphs = append(graphs, graph)
+		}
+		for name := range wanted {
+			fmt.Printf("%s: not found in %s\n", name, config)
+			os.Exit(1)
+		}
+		out, err := viz.Render(graphs, graphFormat)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		fmt.Printf("%s", out)
+		os.Exit(0)
+	},
+}
+
+func init() {
+	graphCmd.Flags().StringVarP(&config, "config", "c", "", "reservoird config file, json, yaml or toml (required)")
+	graphCmd.MarkFlagRequired("config")
+	graphCmd.Flags().StringVarP(&graphFormat, "format", "f", viz.FormatDot, "output format, dot, mermaid or json-graph")
+	rootCmd.AddCommand(graphCmd)
+}
@@ -1,10 +1,9 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/reservoird/proxy"
 	"github.com/reservoird/reservoird/cfg"
@@ -16,6 +15,8 @@ import (
 )
 
 var config string
+var drainTimeout time.Duration
+var injectToken string
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Runs a reservoird config",
@@ -26,14 +27,7 @@ var runCmd = &cobra.Command{
 			log.SetLevel(log.InfoLevel)
 		}
 
-		data, err := ioutil.ReadFile(config)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		rsv := cfg.Cfg{}
-		err = json.Unmarshal(data, &rsv)
+		rsv, err := cfg.Load(config)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -45,12 +39,17 @@ var runCmd = &cobra.Command{
 		if err != nil {
 			log.Fatalf("error setting up reservoirs: %v\n", err)
 		}
+		reservoirMap.DrainTimeout = drainTimeout
 		reservoirMap.StartAll()
 
 		server, err := srv.NewServer(reservoirMap, Address)
 		if err != nil {
 			log.Fatalf("error setting up server: %v\n", err)
 		}
+		server.Loader = func() (cfg.Cfg, error) {
+			return cfg.Load(config)
+		}
+		server.InjectToken = injectToken
 		server.RunMonitor()
 
 		err = server.Serve()
@@ -67,7 +66,9 @@ var runCmd = &cobra.Command{
 }
 
 func init() {
-	runCmd.Flags().StringVarP(&config, "config", "c", "", "reservoird config file (required)")
+	runCmd.Flags().StringVarP(&config, "config", "c", "", "reservoird config file, json, yaml or toml (required)")
 	runCmd.MarkFlagRequired("config")
+	runCmd.Flags().DurationVarP(&drainTimeout, "drain-timeout", "t", run.DefaultDrainTimeout, "time allowed for queues to empty when stopping")
+	runCmd.Flags().StringVarP(&injectToken, "inject-token", "", os.Getenv("RESERVOIRD_INJECT_TOKEN"), "bearer token allowing messages to be injected, injecting is disabled without one")
 	rootCmd.AddCommand(runCmd)
 }
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/run"
+	"github.com/spf13/cobra"
+)
+
+var validateOutput string
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validates a reservoird config without running it",
+	Run: func(cmd *cobra.Command, args []string) {
+		if validateOutput != "text" && validateOutput != "json" {
+			fmt.Printf("%s: unknown output, expecting text or json\n", validateOutput)
+			os.Exit(2)
+		}
+
+		problems := make([]run.Problem, 0)
+		rsv, err := cfg.Load(config)
+		if err != nil {
+			problems = append(problems, run.Problem{Reservoir: config, Field: "file", Message: err.Error()})
+		} else {
+			problems = run.Validate(rsv, &proxy.PluginProxy{})
+		}
+
+		if validateOutput == "json" {
+			data, err := json.MarshalIndent(struct {
+				Valid    bool          `json:"valid"`
+				Problems []run.Problem `json:"problems"`
+			}{
+				Valid:    len(problems) == 0,
+				Problems: problems,
+			}, "", "  ")
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			fmt.Printf("%s\n", data)
+		} else {
+			for p := range problems {
+				fmt.Printf("%s\n", problems[p].String())
+			}
+			if len(problems) == 0 {
+				fmt.Printf("%s: ok\n", config)
+			} else {
+				fmt.Printf("%s: %d problem(s) found\n", config, len(problems))
+			}
+		}
+
+		if len(problems) != 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	},
+}
+
+func init() {
+	validateCmd.Flags().StringVarP(&config, "config", "c", "", "reservoird config file, json, yaml or toml (required)")
+	validateCmd.MarkFlagRequired("config")
+	validateCmd.Flags().StringVarP(&validateOutput, "output", "o", "text", "output format, text or json")
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,230 @@
+// Package ctl is a client for the reservoird rest interface
+package ctl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/sta"
+)
+
+// DefaultTimeout bounds each request
+const DefaultTimeout = 30 * time.Second
+
+// Error is returned when the server answers with an error status
+type Error struct {
+	Status  int
+	Message string
+}
+
+// Error returns the message sent by the server
+func (o *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", o.Status, http.StatusText(o.Status), o.Message)
+}
+
+// Reservoir describes a reservoir as reported by the server
+type Reservoir struct {
+	Name        string                `json:"name"`
+	Stopped     bool                  `json:"stopped"`
+	Disposed    bool                  `json:"disposed"`
+	Flow        []string              `json:"flow"`
+	Stats       []interface{}         `json:"stats"`
+	Supervisors []sta.SupervisorStats `json:"supervisors"`
+}
+
+// Client talks to a reservoird server
+type Client struct {
+	Address string
+	HTTP    *http.Client
+}
+
+// NewClient creates a client for an address as given to reservoird run,
+// such as :5514 or host:5514, or a url
+func NewClient(address string) *Client {
+	o := new(Client)
+	if strings.HasPrefix(address, ":") == true {
+		address = "localhost" + address
+	}
+	if strings.Contains(address, "://") == false {
+		address = "http://" + address
+	}
+	o.Address = strings.TrimSuffix(address, "/")
+	o.HTTP = &http.Client{Timeout: DefaultTimeout}
+	return o
+}
+
+// do sends a request and decodes a json response into out when given
+func (o *Client) do(method string, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, o.Address+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := o.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &Error{
+			Status:  resp.StatusCode,
+			Message: strings.TrimSpace(string(data)),
+		}
+	}
+	if out != nil {
+		err = json.Unmarshal(data, out)
+		if err != nil {
+			return fmt.Errorf("%s %s: invalid response (%v)", method, path, err)
+		}
+	}
+	return nil
+}
+
+// path escapes a reservoir name into a path
+func path(format string, name string) string {
+	return fmt.Sprintf(format, url.PathEscape(name))
+}
+
+// List returns every reservoir not disposed sorted by name
+func (o *Client) List() ([]Reservoir, error) {
+	flows := sta.FlowStats{}
+	err := o.do("GET", "/v1/flows", nil, &flows)
+	if IsNotFound(err) == true {
+		return []Reservoir{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for name := range flows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	reservoirs := make([]Reservoir, 0)
+	for _, name := range names {
+		reservoir, err := o.Get(name)
+		if IsNotFound(err) == true {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		reservoirs = append(reservoirs, reservoir)
+	}
+	return reservoirs, nil
+}
+
+// Get returns a reservoir with its flow, stats and supervisors
+func (o *Client) Get(name string) (Reservoir, error) {
+	stats := sta.ReservoirStats{}
+	err := o.do("GET", path("/v1/reservoirs/%s", name), nil, &stats)
+	if err != nil {
+		return Reservoir{}, err
+	}
+	reservoir := Reservoir{
+		Name:        name,
+		Stats:       stats[name],
+		Supervisors: make([]sta.SupervisorStats, 0),
+	}
+	if len(stats["stopped"]) == 1 {
+		reservoir.Stopped, _ = stats["stopped"][0].(bool)
+	}
+	if len(stats["disposed"]) == 1 {
+		reservoir.Disposed, _ = stats["disposed"][0].(bool)
+	}
+	b, err := json.Marshal(stats["supervisors"])
+	if err == nil {
+		json.Unmarshal(b, &reservoir.Supervisors)
+	}
+
+	flows := sta.FlowStats{}
+	err = o.do("GET", path("/v1/flows/%s", name), nil, &flows)
+	if err == nil {
+		reservoir.Flow = flows[name]
+	} else if IsNotFound(err) == false {
+		return Reservoir{}, err
+	}
+	return reservoir, nil
+}
+
+// Start starts a reservoir
+func (o *Client) Start(name string) error {
+	return o.do("PUT", path("/v1/flows/%s", name), nil, nil)
+}
+
+// Stop stops a reservoir, mode is drain, immediate or empty for immediate
+func (o *Client) Stop(name string, mode string) error {
+	p := path("/v1/flows/%s", name)
+	if mode != "" {
+		p = p + "?mode=" + url.QueryEscape(mode)
+	}
+	return o.do("DELETE", p, nil, nil)
+}
+
+// Dispose disposes a stopped reservoir
+func (o *Client) Dispose(name string) error {
+	return o.do("DELETE", path("/v1/reservoirs/%s", name), nil, nil)
+}
+
+// Create creates a reservoir in the stopped state
+func (o *Client) Create(config cfg.ReservoirCfg) error {
+	body, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return o.do("PUT", path("/v1/reservoirs/%s", config.Name), body, nil)
+}
+
+// Queues returns the queues between the components of a reservoir
+func (o *Client) Queues(name string) ([]sta.QueueStats, error) {
+	queues := make([]sta.QueueStats, 0)
+	err := o.do("GET", path("/v1/reservoirs/%s/queues", name), nil, &queues)
+	return queues, err
+}
+
+// Runtime returns the go runtime stats of the server
+func (o *Client) Runtime() (sta.RuntimeStats, error) {
+	stats := sta.RuntimeStats{}
+	err := o.do("GET", "/v1/stats", nil, &stats)
+	return stats, err
+}
+
+// Version returns the version of the server
+func (o *Client) Version() (sta.Version, error) {
+	version := sta.Version{}
+	err := o.do("GET", "/v1/version", nil, &version)
+	return version, err
+}
+
+// status returns the status of an error returned by the server, 0 for others
+func status(err error) int {
+	e, ok := err.(*Error)
+	if ok == false {
+		return 0
+	}
+	return e.Status
+}
+
+// IsNotFound returns whether the server answered 404
+func IsNotFound(err error) bool {
+	return status(err) == http.StatusNotFound
+}
+
+// IsConflict returns whether the server answered 409
+func IsConflict(err error) bool {
+	return status(err) == http.StatusConflict
+}
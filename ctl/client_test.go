@@ -0,0 +1,91 @@
+package ctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+// newTestServer serves one stopped reservoir named one
+func newTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.RequestURI()+" "+string(body)))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /v1/flows":
+			fmt.Fprintf(w, `{"one": ["in", "queue", "out"]}`)
+		case "GET /v1/flows/one":
+			fmt.Fprintf(w, `{"one": ["in", "queue", "out"]}`)
+		case "GET /v1/reservoirs/one":
+			fmt.Fprintf(w, `{"one": [1, 2, 3], "stopped": [true], "disposed": [false], "supervisors": [{"id": "in", "restarts": 2}]}`)
+		case "PUT /v1/flows/one":
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, "one: already running\n")
+		case "DELETE /v1/flows/one", "PUT /v1/reservoirs/two":
+			fmt.Fprintf(w, "ok\n")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "not found\n")
+		}
+	}))
+	return server, &requests
+}
+
+func TestNewClient(t *testing.T) {
+	tests := map[string]string{
+		":5514":                  "http://localhost:5514",
+		"host:5514":              "http://host:5514",
+		"https://host:5514/":     "https://host:5514",
+		"http://127.0.0.1:80/v1": "http://127.0.0.1:80/v1",
+	}
+	for address, expected := range tests {
+		if NewClient(address).Address != expected {
+			t.Errorf("%s: expecting %s, got %s", address, expected, NewClient(address).Address)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	server, requests := newTestServer(t)
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	reservoirs, err := client.List()
+	if err != nil || len(reservoirs) != 1 {
+		t.Fatalf("expecting one reservoir, got %v (%v)", reservoirs, err)
+	}
+	one := reservoirs[0]
+	if one.Name != "one" || one.Stopped != true || len(one.Flow) != 3 || len(one.Stats) != 3 || one.Supervisors[0].Restarts != 2 {
+		t.Errorf("expecting reservoir one, got %+v", one)
+	}
+
+	_, err = client.Get("missing")
+	if IsNotFound(err) == false {
+		t.Errorf("expecting not found, got %v", err)
+	}
+	err = client.Start("one")
+	if IsConflict(err) == false || strings.Contains(err.Error(), "already running") == false {
+		t.Errorf("expecting conflict, got %v", err)
+	}
+	err = client.Stop("one", "immediate")
+	if err != nil {
+		t.Errorf("error stopping: %v", err)
+	}
+	err = client.Create(cfg.ReservoirCfg{Name: "two"})
+	if err != nil {
+		t.Errorf("error creating: %v", err)
+	}
+	last := (*requests)[len(*requests)-1]
+	if strings.HasPrefix(last, `PUT /v1/reservoirs/two {"name":"two"`) == false {
+		t.Errorf("expecting reservoir config sent, got %s", last)
+	}
+	if (*requests)[len(*requests)-2] != "DELETE /v1/flows/one?mode=immediate" {
+		t.Errorf("expecting stop mode sent, got %s", (*requests)[len(*requests)-2])
+	}
+}
@@ -0,0 +1,15 @@
+package dsk
+
+import (
+	"os"
+)
+
+// lockFile does nothing, the directory is not locked on windows
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing, the directory is not locked on windows
+func unlockFile(f *os.File) error {
+	return nil
+}
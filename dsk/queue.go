@@ -0,0 +1,736 @@
+// Package dsk provides a persistent queue built into reservoird. Messages
+// are appended to segment files on local disk and a cursor records how far
+// they have been read, so buffered messages survive a restart.
+//
+// Each record is a 4 byte length, a 4 byte crc32 of the body and a body of
+// a 1 byte type followed by the payload. Byte slices and strings are stored
+// as is, envelopes are stored as json and returned as *env.Envelope,
+// anything else is stored as json and returned decoded. On open,
+// a partially written record at the end of a segment is truncated away.
+//
+// A queue takes an exclusive lock on its directory, a second queue opening
+// the same directory fails until the first is released.
+package dsk
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/env"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Location is the builtin location of the disk queue
+const Location = "builtin:com.github.reservoird.reservoird.disk"
+
+// Names of the queue, non-blocking queue names end with nb
+const (
+	Name   = "com.github.reservoird.reservoird.disk"
+	NameNB = "com.github.reservoird.reservoird.disknb"
+)
+
+// Fsync policies
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+// Defaults
+const (
+	DefaultSegmentSize   = 64 * 1024 * 1024
+	DefaultFsyncInterval = time.Second
+)
+
+const (
+	headerSize   = 8
+	cursorSize   = 20
+	cursorFile   = "cursor"
+	lockName     = "lock"
+	segmentExt   = ".seg"
+	typeBytes    = byte(0)
+	typeString   = byte(1)
+	typeJSON     = byte(2)
+	typeEnvelope = byte(3)
+	statsPeriod  = time.Second
+)
+
+// Cfg contains the configuration of a disk queue. MaxSize limits the bytes
+// of unread records and MaxLen the number of unread records, zero means no
+// limit.
+type Cfg struct {
+	Dir           string `json:"dir"`
+	SegmentSize   int64  `json:"segmentSize"`
+	MaxSize       int64  `json:"maxSize"`
+	MaxLen        int    `json:"maxLen"`
+	Fsync         string `json:"fsync"`
+	FsyncInterval string `json:"fsyncInterval"`
+	NonBlocking   bool   `json:"nonBlocking"`
+}
+
+// Stats contains the stats of a disk queue
+type Stats struct {
+	Name             string `json:"name"`
+	Dir              string `json:"dir"`
+	Len              int    `json:"len"`
+	Cap              int    `json:"cap"`
+	Bytes            int64  `json:"bytes"`
+	Segments         int    `json:"segments"`
+	MessagesReceived uint64 `json:"messagesReceived"`
+	MessagesSent     uint64 `json:"messagesSent"`
+	Running          bool   `json:"running"`
+}
+
+// Queue is a persistent queue of segment files
+type Queue struct {
+	cfg           Cfg
+	fsyncInterval time.Duration
+	segments      []uint64
+	reader        *os.File
+	readOff       int64
+	writer        *os.File
+	writeSize     int64
+	cursor        *os.File
+	lockFile      *os.File
+	count         int
+	size          int64
+	closed        bool
+	released      bool
+	lastSync      time.Time
+	received      uint64
+	sent          uint64
+	lock          *sync.Mutex
+	cond          *sync.Cond
+}
+
+// New creates a disk queue, config is the path of a json Cfg file
+func New(config string) (icd.Queue, error) {
+	c := Cfg{}
+	if config != "" {
+		data, err := ioutil.ReadFile(config)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewQueue(c)
+}
+
+// NewQueue opens or creates the disk queue in the configured directory,
+// recovering from a crash while writing
+func NewQueue(c Cfg) (*Queue, error) {
+	if c.Dir == "" {
+		return nil, fmt.Errorf("disk queue dir is required")
+	}
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = DefaultSegmentSize
+	}
+	o := new(Queue)
+	switch c.Fsync {
+	case "":
+		c.Fsync = FsyncInterval
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("%s: unknown fsync policy, expecting always, interval or never", c.Fsync)
+	}
+	o.fsyncInterval = DefaultFsyncInterval
+	if c.FsyncInterval != "" {
+		d, err := time.ParseDuration(c.FsyncInterval)
+		if err != nil {
+			return nil, err
+		}
+		o.fsyncInterval = d
+	}
+	o.cfg = c
+	o.lock = &sync.Mutex{}
+	o.cond = sync.NewCond(o.lock)
+	o.lastSync = time.Now()
+
+	err := os.MkdirAll(c.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	o.lockFile, err = os.OpenFile(filepath.Join(c.Dir, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(o.lockFile)
+	if err != nil {
+		o.lockFile.Close()
+		return nil, fmt.Errorf("%s: disk queue dir in use (%v)", c.Dir, err)
+	}
+	err = o.open()
+	if err != nil {
+		o.Release()
+		return nil, err
+	}
+	return o, nil
+}
+
+// Sub returns the config of a queue in a sub directory of the directory of
+// another config, config is a path or inline json. Queues copied by a flow
+// each get their own directory.
+func Sub(config string, name string) (string, error) {
+	c := Cfg{}
+	data := []byte(config)
+	if strings.HasPrefix(config, "{") == false {
+		var err error
+		data, err = ioutil.ReadFile(config)
+		if err != nil {
+			return "", err
+		}
+	}
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return "", err
+	}
+	if c.Dir == "" {
+		return "", fmt.Errorf("disk queue dir is required")
+	}
+	c.Dir = filepath.Join(c.Dir, name)
+	data, err = json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// segmentPath returns the path of a segment file
+func (o *Queue) segmentPath(id uint64) string {
+	return filepath.Join(o.cfg.Dir, fmt.Sprintf("%016x%s", id, segmentExt))
+}
+
+// open loads the segments and cursor, truncating partial records
+func (o *Queue) open() error {
+	files, err := ioutil.ReadDir(o.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	o.segments = make([]uint64, 0)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), segmentExt) == false {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		o.segments = append(o.segments, id)
+	}
+	sort.Slice(o.segments, func(i, j int) bool { return o.segments[i] < o.segments[j] })
+
+	o.cursor, err = os.OpenFile(filepath.Join(o.cfg.Dir, cursorFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	seg, off := o.readCursor()
+
+	// drop segments before the cursor, they were fully read
+	for len(o.segments) > 0 && o.segments[0] < seg {
+		err = os.Remove(o.segmentPath(o.segments[0]))
+		if err != nil {
+			return err
+		}
+		o.segments = o.segments[1:]
+	}
+	if len(o.segments) == 0 {
+		o.segments = append(o.segments, seg)
+	}
+	if o.segments[0] != seg {
+		off = 0
+	}
+
+	o.count = 0
+	o.size = 0
+	for s, id := range o.segments {
+		f, err := os.OpenFile(o.segmentPath(id), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		start := int64(0)
+		if s == 0 {
+			start = off
+		}
+		end, count := scan(f, start)
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != end {
+			log.WithFields(log.Fields{
+				"dir":     o.cfg.Dir,
+				"segment": id,
+				"offset":  end,
+				"size":    info.Size(),
+			}).Warn("truncating partial record in disk queue")
+			err = f.Truncate(end)
+			if err != nil {
+				return err
+			}
+		}
+		if start > end {
+			start = end
+		}
+		o.count = o.count + count
+		o.size = o.size + end
+		if s == 0 {
+			o.reader = f
+			o.readOff = start
+		}
+		if s == len(o.segments)-1 {
+			o.writer = f
+			o.writeSize = end
+		} else if s != 0 {
+			f.Close()
+		}
+	}
+	return o.writeCursor()
+}
+
+// scan counts the valid records from start, returning where they end
+func scan(f *os.File, start int64) (int64, int) {
+	off := int64(0)
+	count := 0
+	for {
+		_, _, next, err := readRecord(f, off)
+		if err != nil {
+			return off, count
+		}
+		if off >= start {
+			count = count + 1
+		}
+		off = next
+	}
+}
+
+// readRecord reads the record at off returning its type, payload and the
+// offset of the next record
+func readRecord(f *os.File, off int64) (byte, []byte, int64, error) {
+	header := make([]byte, headerSize)
+	_, err := f.ReadAt(header, off)
+	if err != nil {
+		return 0, nil, off, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length == 0 {
+		return 0, nil, off, fmt.Errorf("empty record at %d", off)
+	}
+	body := make([]byte, length)
+	_, err = f.ReadAt(body, off+headerSize)
+	if err != nil {
+		return 0, nil, off, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, nil, off, fmt.Errorf("corrupt record at %d", off)
+	}
+	return body[0], body[1:], off + headerSize + length, nil
+}
+
+// readCursor reads the segment and offset of the next record to read, a
+// missing or damaged cursor starts from the first segment
+func (o *Queue) readCursor() (uint64, int64) {
+	b := make([]byte, cursorSize)
+	_, err := o.cursor.ReadAt(b, 0)
+	first := uint64(0)
+	if len(o.segments) > 0 {
+		first = o.segments[0]
+	}
+	if err != nil || crc32.ChecksumIEEE(b[:16]) != binary.BigEndian.Uint32(b[16:]) {
+		return first, 0
+	}
+	return binary.BigEndian.Uint64(b[0:8]), int64(binary.BigEndian.Uint64(b[8:16]))
+}
+
+// writeCursor records the segment and offset of the next record to read
+func (o *Queue) writeCursor() error {
+	b := make([]byte, cursorSize)
+	binary.BigEndian.PutUint64(b[0:8], o.segments[0])
+	binary.BigEndian.PutUint64(b[8:16], uint64(o.readOff))
+	binary.BigEndian.PutUint32(b[16:], crc32.ChecksumIEEE(b[:16]))
+	_, err := o.cursor.WriteAt(b, 0)
+	if err != nil {
+		return err
+	}
+	if o.cfg.Fsync == FsyncAlways {
+		return o.cursor.Sync()
+	}
+	return nil
+}
+
+// sync flushes files according to the fsync policy
+func (o *Queue) sync(force bool) {
+	if o.cfg.Fsync == FsyncNever {
+		return
+	}
+	if force == true || o.cfg.Fsync == FsyncAlways || time.Since(o.lastSync) >= o.fsyncInterval {
+		o.writer.Sync()
+		o.cursor.Sync()
+		o.lastSync = time.Now()
+	}
+}
+
+// encode converts an item into a record body
+func encode(item interface{}) ([]byte, error) {
+	switch v := item.(type) {
+	case []byte:
+		return append([]byte{typeBytes}, v...), nil
+	case string:
+		return append([]byte{typeString}, v...), nil
+	}
+	b, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := env.From(item)
+	if ok == true {
+		return append([]byte{typeEnvelope}, b...), nil
+	}
+	return append([]byte{typeJSON}, b...), nil
+}
+
+// decode converts a record type and payload back into an item
+func decode(typ byte, payload []byte) (interface{}, error) {
+	switch typ {
+	case typeBytes:
+		return payload, nil
+	case typeString:
+		return string(payload), nil
+	case typeJSON:
+		var item interface{}
+		err := json.Unmarshal(payload, &item)
+		return item, err
+	case typeEnvelope:
+		e := new(env.Envelope)
+		err := json.Unmarshal(payload, e)
+		return e, err
+	}
+	return nil, fmt.Errorf("unknown record type %d", typ)
+}
+
+// full returns whether a record of the given size would exceed the limits
+func (o *Queue) full(size int64) bool {
+	if o.cfg.MaxLen > 0 && o.count >= o.cfg.MaxLen {
+		return true
+	}
+	unread := o.size - o.readOff
+	return o.cfg.MaxSize > 0 && unread > 0 && unread+size > o.cfg.MaxSize
+}
+
+// Name provides the name of the queue
+func (o *Queue) Name() string {
+	if o.cfg.NonBlocking == true {
+		return NameNB
+	}
+	return Name
+}
+
+// Put appends an item, blocking while full unless non-blocking
+func (o *Queue) Put(item interface{}) error {
+	body, err := encode(item)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, headerSize+len(body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	copy(record[headerSize:], body)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for o.closed == false && o.full(int64(len(record))) == true {
+		if o.cfg.NonBlocking == true {
+			return fmt.Errorf("%s: queue is full", o.cfg.Dir)
+		}
+		o.cond.Wait()
+	}
+	if o.closed == true {
+		return fmt.Errorf("%s: queue is closed", o.cfg.Dir)
+	}
+
+	if o.writeSize > 0 && o.writeSize+int64(len(record)) > o.cfg.SegmentSize {
+		err = o.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = o.writer.WriteAt(record, o.writeSize)
+	if err != nil {
+		return err
+	}
+	o.writeSize = o.writeSize + int64(len(record))
+	o.size = o.size + int64(len(record))
+	o.count = o.count + 1
+	o.received = o.received + 1
+	o.sync(false)
+	o.cond.Broadcast()
+	return nil
+}
+
+// rotate starts a new segment
+func (o *Queue) rotate() error {
+	o.sync(true)
+	id := o.segments[len(o.segments)-1] + 1
+	f, err := os.OpenFile(o.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if o.writer != o.reader {
+		o.writer.Close()
+	}
+	o.segments = append(o.segments, id)
+	o.writer = f
+	o.writeSize = 0
+	return nil
+}
+
+// Get gets the next item, blocking while empty unless non-blocking
+func (o *Queue) Get() (interface{}, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.released == true {
+		return nil, fmt.Errorf("%s: queue is released", o.cfg.Dir)
+	}
+	for o.count == 0 {
+		if o.closed == true {
+			return nil, fmt.Errorf("%s: queue is closed", o.cfg.Dir)
+		}
+		if o.cfg.NonBlocking == true {
+			return nil, fmt.Errorf("%s: queue is empty", o.cfg.Dir)
+		}
+		o.cond.Wait()
+	}
+
+	typ, payload, next, err := readRecord(o.reader, o.readOff)
+	for err == io.EOF && len(o.segments) > 1 {
+		err = o.advance()
+		if err != nil {
+			return nil, err
+		}
+		typ, payload, next, err = readRecord(o.reader, o.readOff)
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.readOff = next
+	o.count = o.count - 1
+	o.sent = o.sent + 1
+	if o.count == 0 && len(o.segments) == 1 {
+		// everything is read, start the segment over
+		err = o.reader.Truncate(0)
+		if err != nil {
+			return nil, err
+		}
+		o.size = 0
+		o.readOff = 0
+		o.writeSize = 0
+	}
+	err = o.writeCursor()
+	if err != nil {
+		return nil, err
+	}
+	o.sync(false)
+	o.cond.Broadcast()
+
+	item, err := decode(typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// advance removes the fully read segment and moves to the next
+func (o *Queue) advance() error {
+	id := o.segments[0]
+	o.reader.Close()
+	o.segments = o.segments[1:]
+	o.size = o.size - o.readOff
+	o.readOff = 0
+	if len(o.segments) == 1 {
+		o.reader = o.writer
+	} else {
+		f, err := os.OpenFile(o.segmentPath(o.segments[0]), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		o.reader = f
+	}
+	err := o.writeCursor()
+	if err != nil {
+		return err
+	}
+	return os.Remove(o.segmentPath(id))
+}
+
+// Len returns the number of unread items
+func (o *Queue) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.count
+}
+
+// Cap returns the maximum number of items, -1 when unbounded
+func (o *Queue) Cap() int {
+	if o.cfg.MaxLen > 0 {
+		return o.cfg.MaxLen
+	}
+	return -1
+}
+
+// Clear removes every item
+func (o *Queue) Clear() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.released == true {
+		return
+	}
+	for len(o.segments) > 1 {
+		o.readOff = o.size
+		err := o.advance()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"dir": o.cfg.Dir,
+				"err": err,
+			}).Error("clearing disk queue")
+			return
+		}
+	}
+	o.reader.Truncate(0)
+	o.size = 0
+	o.readOff = 0
+	o.writeSize = 0
+	o.count = 0
+	o.writeCursor()
+	o.cond.Broadcast()
+}
+
+// Reset makes a closed queue usable again, unless released
+func (o *Queue) Reset() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.released == false {
+		o.closed = false
+	}
+}
+
+// Close closes the queue, waking anything blocked on it. Unread items
+// remain on disk.
+func (o *Queue) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.closed = true
+	o.sync(true)
+	o.cond.Broadcast()
+	return nil
+}
+
+// Release closes the queue and its files and unlocks its directory, the
+// queue cannot be used afterwards
+func (o *Queue) Release() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.released == true {
+		return nil
+	}
+	o.closed = true
+	o.released = true
+	o.cond.Broadcast()
+	files := []*os.File{o.writer, o.reader, o.cursor}
+	if o.writer != nil {
+		o.sync(true)
+	}
+	if o.reader == o.writer {
+		files = files[1:]
+	}
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	o.writer = nil
+	o.reader = nil
+	o.cursor = nil
+	err := unlockFile(o.lockFile)
+	o.lockFile.Close()
+	return err
+}
+
+// Closed returns whether or not the queue is closed
+func (o *Queue) Closed() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.closed
+}
+
+// stats returns the current stats
+func (o *Queue) stats(running bool) Stats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return Stats{
+		Name:             o.Name(),
+		Dir:              o.cfg.Dir,
+		Len:              o.count,
+		Cap:              o.Cap(),
+		Bytes:            o.size - o.readOff,
+		Segments:         len(o.segments),
+		MessagesReceived: o.received,
+		MessagesSent:     o.sent,
+		Running:          running,
+	}
+}
+
+// Monitor provides stats until told to stop, also flushing to disk on the
+// fsync interval
+func (o *Queue) Monitor(mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+
+	run := true
+	for run == true {
+		select {
+		case <-mc.ClearChan:
+			o.lock.Lock()
+			o.received = 0
+			o.sent = 0
+			o.lock.Unlock()
+		default:
+		}
+
+		o.lock.Lock()
+		o.sync(false)
+		o.lock.Unlock()
+
+		select {
+		case mc.StatsChan <- o.stats(true):
+		default:
+		}
+
+		select {
+		case <-mc.DoneChan:
+			run = false
+		case <-time.After(statsPeriod):
+		}
+	}
+
+	o.lock.Lock()
+	o.sync(true)
+	o.lock.Unlock()
+	mc.FinalStatsChan <- o.stats(false)
+}
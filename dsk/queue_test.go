@@ -0,0 +1,268 @@
+package dsk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/env"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dsk")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestQueueTypes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(Cfg{Dir: dir, NonBlocking: true})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	if q.Name() != NameNB {
+		t.Errorf("expecting %s but got %s", NameNB, q.Name())
+	}
+	q.Put([]byte("bytes"))
+	q.Put("string")
+	q.Put(map[string]interface{}{"key": "value"})
+	q.Put(env.New("enveloped"))
+	if q.Len() != 4 {
+		t.Fatalf("expecting 4 items but got %d", q.Len())
+	}
+	item, _ := q.Get()
+	if b, ok := item.([]byte); ok == false || string(b) != "bytes" {
+		t.Errorf("expecting bytes but got %v", item)
+	}
+	item, _ = q.Get()
+	if s, ok := item.(string); ok == false || s != "string" {
+		t.Errorf("expecting string but got %v", item)
+	}
+	item, _ = q.Get()
+	if m, ok := item.(map[string]interface{}); ok == false || m["key"] != "value" {
+		t.Errorf("expecting map but got %v", item)
+	}
+	item, _ = q.Get()
+	if e, ok := item.(*env.Envelope); ok == false || e.Payload != "enveloped" {
+		t.Errorf("expecting envelope but got %v", item)
+	}
+	_, err = q.Get()
+	if err == nil {
+		t.Errorf("expecting error on empty queue")
+	}
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(Cfg{Dir: dir, SegmentSize: 64, Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	for _, s := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		err = q.Put(s)
+		if err != nil {
+			t.Fatalf("error putting: %v", err)
+		}
+	}
+	if len(q.segments) < 2 {
+		t.Fatalf("expecting segments to rotate but got %d", len(q.segments))
+	}
+	for i := 0; i < 5; i++ {
+		q.Get()
+	}
+	q.Release()
+
+	q, err = NewQueue(Cfg{Dir: dir, SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("error reopening queue: %v", err)
+	}
+	if q.Len() != 3 {
+		t.Fatalf("expecting 3 items but got %d", q.Len())
+	}
+	for _, expected := range []string{"f", "g", "h"} {
+		item, err := q.Get()
+		if err != nil || item != expected {
+			t.Errorf("expecting %s but got %v, %v", expected, item, err)
+		}
+	}
+	if len(q.segments) != 1 {
+		t.Errorf("expecting read segments removed but got %d", len(q.segments))
+	}
+}
+
+func TestQueueRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(Cfg{Dir: dir})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	q.Put("a")
+	q.Put("b")
+	q.Release()
+
+	// simulate a crash part way through writing a record
+	f, err := os.OpenFile(filepath.Join(dir, "0000000000000000.seg"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("error opening segment: %v", err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1, 2})
+	f.Close()
+
+	q, err = NewQueue(Cfg{Dir: dir})
+	if err != nil {
+		t.Fatalf("error reopening queue: %v", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expecting 2 items but got %d", q.Len())
+	}
+	q.Put("c")
+	for _, expected := range []string{"a", "b", "c"} {
+		item, err := q.Get()
+		if err != nil || item != expected {
+			t.Errorf("expecting %s but got %v, %v", expected, item, err)
+		}
+	}
+}
+
+func TestQueueLock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(Cfg{Dir: dir})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	_, err = NewQueue(Cfg{Dir: dir})
+	if err == nil {
+		t.Fatalf("expecting error opening a dir in use")
+	}
+	q.Put("a")
+	err = q.Release()
+	if err != nil {
+		t.Fatalf("error releasing queue: %v", err)
+	}
+	err = q.Put("b")
+	if err == nil {
+		t.Errorf("expecting error putting into a released queue")
+	}
+	q.Reset()
+	if q.Closed() == false {
+		t.Errorf("expecting a released queue to stay closed")
+	}
+	q, err = NewQueue(Cfg{Dir: dir})
+	if err != nil {
+		t.Fatalf("error reopening released queue: %v", err)
+	}
+	defer q.Release()
+	if q.Len() != 1 {
+		t.Errorf("expecting 1 item but got %d", q.Len())
+	}
+}
+
+func TestSub(t *testing.T) {
+	config, err := Sub(`{"dir":"/var/lib/reservoird","maxLen":10}`, "ingester0.fanout.expeller0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config != `{"dir":"/var/lib/reservoird/ingester0.fanout.expeller0","segmentSize":0,"maxSize":0,"maxLen":10,"fsync":"","fsyncInterval":"","nonBlocking":false}` {
+		t.Errorf("unexpected sub config %s", config)
+	}
+	_, err = Sub(`{"maxLen":10}`, "ingester0.merge")
+	if err == nil {
+		t.Errorf("expecting error without dir")
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(Cfg{Dir: dir, MaxLen: 2, NonBlocking: true})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	if q.Cap() != 2 {
+		t.Errorf("expecting cap 2 but got %d", q.Cap())
+	}
+	q.Put("a")
+	q.Put("b")
+	err = q.Put("c")
+	if err == nil {
+		t.Errorf("expecting error on full queue")
+	}
+	q.Clear()
+	if q.Len() != 0 {
+		t.Errorf("expecting empty queue but got %d", q.Len())
+	}
+}
+
+func TestQueueBlocking(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(Cfg{Dir: dir, MaxLen: 1})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	q.Put("a")
+	done := make(chan struct{})
+	go func() {
+		q.Put("b")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("expecting put to block on full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Get()
+	<-done
+	item, _ := q.Get()
+	if item != "b" {
+		t.Errorf("expecting b but got %v", item)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Close()
+	}()
+	_, err = q.Get()
+	if err == nil {
+		t.Errorf("expecting error after close")
+	}
+}
+
+func TestQueueMonitor(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(Cfg{Dir: dir})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	q.Put("a")
+	mc := &icd.MonitorControl{
+		StatsChan:      make(chan interface{}, 1),
+		FinalStatsChan: make(chan interface{}, 1),
+		ClearChan:      make(chan struct{}, 1),
+		DoneChan:       make(chan struct{}, 1),
+		WaitGroup:      &sync.WaitGroup{},
+	}
+	mc.WaitGroup.Add(1)
+	go q.Monitor(mc)
+	stats := (<-mc.StatsChan).(Stats)
+	if stats.Len != 1 || stats.MessagesReceived != 1 || stats.Running == false {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	mc.DoneChan <- struct{}{}
+	mc.WaitGroup.Wait()
+	stats = (<-mc.FinalStatsChan).(Stats)
+	if stats.Running == true {
+		t.Errorf("expecting final stats not running")
+	}
+}
@@ -0,0 +1,244 @@
+// Package env provides an optional envelope around messages. An envelope
+// carries an id, the time the message was ingested and headers such as the
+// source, a trace id, a tenant or routing keys next to the payload, so
+// digesters do not have to parse payloads to find them.
+//
+// Ingesters put a *Envelope into their queue, digesters read and modify it
+// and expellers take the payload out. The host recognizes envelopes: it
+// stamps them when put into an ingester queue, measures latency from their
+// ingest time, routes them at fan-outs by the route header and keeps them
+// whole through out-of-process plugins, disk queues and taps.
+package env
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Well known headers
+const (
+	HeaderSource = "source"
+	HeaderTrace  = "trace"
+	HeaderTenant = "tenant"
+	// HeaderRoute lists the downstream node ids, comma separated, a fan-out
+	// sends the message to, every downstream node when absent
+	HeaderRoute = "route"
+	// HeaderAttempt is set by the host on envelopes awaiting acknowledgement
+	// to the delivery attempt, acknowledgements of earlier attempts are
+	// ignored
+	HeaderAttempt = "attempt"
+)
+
+// Payload types kept when marshaling
+const (
+	TypeBytes  = "bytes"
+	TypeString = "string"
+	TypeJSON   = "json"
+)
+
+// Envelope is a message with metadata
+type Envelope struct {
+	ID       string
+	Ingested time.Time
+	Headers  map[string]string
+	Payload  interface{}
+}
+
+// wire is the json form of an envelope, the payload type is kept so byte
+// slices and strings come back as such
+type wire struct {
+	ID       string            `json:"id"`
+	Ingested time.Time         `json:"ingested"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Type     string            `json:"type"`
+	Payload  json.RawMessage   `json:"payload"`
+}
+
+// NewID returns a random id
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// New creates an envelope stamped now around a payload
+func New(payload interface{}) *Envelope {
+	o := new(Envelope)
+	o.Payload = payload
+	o.Headers = make(map[string]string)
+	o.Stamp(time.Now())
+	return o
+}
+
+// From returns the envelope of a message, if it is one
+func From(item interface{}) (*Envelope, bool) {
+	switch v := item.(type) {
+	case *Envelope:
+		return v, v != nil
+	case Envelope:
+		return &v, true
+	}
+	return nil, false
+}
+
+// Wrap returns the envelope of a message, creating one when it is not
+func Wrap(item interface{}) *Envelope {
+	e, ok := From(item)
+	if ok == true {
+		return e
+	}
+	return New(item)
+}
+
+// Payload returns the payload of an envelope or the message as is
+func Payload(item interface{}) interface{} {
+	e, ok := From(item)
+	if ok == true {
+		return e.Payload
+	}
+	return item
+}
+
+// Stamp sets the id and ingest time when not set
+func (o *Envelope) Stamp(now time.Time) {
+	if o.ID == "" {
+		o.ID = NewID()
+	}
+	if o.Ingested.IsZero() == true {
+		o.Ingested = now
+	}
+}
+
+// Get returns a header, empty when not set
+func (o *Envelope) Get(key string) string {
+	return o.Headers[key]
+}
+
+// Set sets a header
+func (o *Envelope) Set(key string, value string) {
+	if o.Headers == nil {
+		o.Headers = make(map[string]string)
+	}
+	o.Headers[key] = value
+}
+
+// Del removes a header
+func (o *Envelope) Del(key string) {
+	delete(o.Headers, key)
+}
+
+// Clone copies the envelope and its headers, byte slice payloads are
+// copied, other payloads are shared
+func (o *Envelope) Clone() *Envelope {
+	c := new(Envelope)
+	c.ID = o.ID
+	c.Ingested = o.Ingested
+	c.Headers = make(map[string]string, len(o.Headers))
+	for key, value := range o.Headers {
+		c.Headers[key] = value
+	}
+	c.Payload = o.Payload
+	b, ok := o.Payload.([]byte)
+	if ok == true {
+		c.Payload = append([]byte(nil), b...)
+	}
+	return c
+}
+
+// Routes returns the downstream node ids of the route header, nil when
+// routed everywhere
+func (o *Envelope) Routes() []string {
+	route := strings.TrimSpace(o.Get(HeaderRoute))
+	if route == "" {
+		return nil
+	}
+	routes := make([]string, 0)
+	for _, id := range strings.Split(route, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			routes = append(routes, id)
+		}
+	}
+	return routes
+}
+
+// Routed returns whether the envelope goes to a downstream node
+func (o *Envelope) Routed(id string) bool {
+	routes := o.Routes()
+	if routes == nil {
+		return true
+	}
+	for _, route := range routes {
+		if route == id {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON marshals the envelope keeping the payload type
+func (o Envelope) MarshalJSON() ([]byte, error) {
+	w := wire{
+		ID:       o.ID,
+		Ingested: o.Ingested,
+		Headers:  o.Headers,
+	}
+	var err error
+	switch v := o.Payload.(type) {
+	case []byte:
+		w.Type = TypeBytes
+		w.Payload, err = json.Marshal(base64.StdEncoding.EncodeToString(v))
+	case string:
+		w.Type = TypeString
+		w.Payload, err = json.Marshal(v)
+	default:
+		w.Type = TypeJSON
+		w.Payload, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(w)
+}
+
+// UnmarshalJSON unmarshals an envelope, a missing type is taken as json
+func (o *Envelope) UnmarshalJSON(data []byte) error {
+	w := wire{}
+	err := json.Unmarshal(data, &w)
+	if err != nil {
+		return err
+	}
+	o.ID = w.ID
+	o.Ingested = w.Ingested
+	o.Headers = w.Headers
+	if o.Headers == nil {
+		o.Headers = make(map[string]string)
+	}
+	o.Payload = nil
+	if len(w.Payload) == 0 {
+		return nil
+	}
+	switch w.Type {
+	case TypeBytes:
+		s := ""
+		err = json.Unmarshal(w.Payload, &s)
+		if err != nil {
+			return err
+		}
+		o.Payload, err = base64.StdEncoding.DecodeString(s)
+		return err
+	case TypeString:
+		s := ""
+		err = json.Unmarshal(w.Payload, &s)
+		o.Payload = s
+		return err
+	case "", TypeJSON:
+		return json.Unmarshal(w.Payload, &o.Payload)
+	}
+	return fmt.Errorf("%s: unknown payload type", w.Type)
+}
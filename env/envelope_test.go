@@ -0,0 +1,89 @@
+package env
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	e := New("payload")
+	if e.ID == "" || e.Ingested.IsZero() == true || e.ID == NewID() {
+		t.Errorf("expecting a stamped envelope, got %+v", e)
+	}
+	ingested := e.Ingested
+	e.Stamp(ingested.Add(time.Hour))
+	if e.Ingested != ingested {
+		t.Errorf("expecting stamp to keep the ingest time")
+	}
+
+	if Wrap(e) != e || Payload(e) != "payload" || Payload(1) != 1 {
+		t.Errorf("expecting envelopes unwrapped and other messages as is")
+	}
+	_, ok := From(Envelope{Payload: 1})
+	if ok == false {
+		t.Errorf("expecting an envelope value to be an envelope")
+	}
+	var none *Envelope
+	_, ok = From(none)
+	if ok == true {
+		t.Errorf("expecting a nil envelope not to be an envelope")
+	}
+
+	e.Set(HeaderTenant, "acme")
+	c := e.Clone()
+	c.Set(HeaderTenant, "other")
+	if e.Get(HeaderTenant) != "acme" || c.ID != e.ID {
+		t.Errorf("expecting clone headers to be a copy")
+	}
+	e.Del(HeaderTenant)
+	if e.Get(HeaderTenant) != "" {
+		t.Errorf("expecting header removed")
+	}
+}
+
+func TestEnvelopeRoutes(t *testing.T) {
+	e := New(nil)
+	if e.Routes() != nil || e.Routed("any") == false {
+		t.Errorf("expecting routed everywhere without route header")
+	}
+	e.Set(HeaderRoute, " a, b ,,")
+	if reflect.DeepEqual(e.Routes(), []string{"a", "b"}) == false {
+		t.Errorf("expecting routes a and b, got %v", e.Routes())
+	}
+	if e.Routed("b") == false || e.Routed("c") == true {
+		t.Errorf("expecting only a and b routed")
+	}
+}
+
+func TestEnvelopeJSON(t *testing.T) {
+	payloads := []interface{}{[]byte{0, 1, 2}, "string", map[string]interface{}{"key": 1.0}}
+	for _, payload := range payloads {
+		e := New(payload)
+		e.Set(HeaderTrace, "t1")
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatalf("error marshaling: %v", err)
+		}
+		decoded := new(Envelope)
+		err = json.Unmarshal(b, decoded)
+		if err != nil {
+			t.Fatalf("error unmarshaling %s: %v", b, err)
+		}
+		if reflect.DeepEqual(decoded.Payload, payload) == false || decoded.ID != e.ID ||
+			decoded.Ingested.Equal(e.Ingested) == false || decoded.Get(HeaderTrace) != "t1" {
+			t.Errorf("expecting %+v but got %+v", e, decoded)
+		}
+	}
+
+	decoded := new(Envelope)
+	err := json.Unmarshal([]byte(`{"payload": {"a": 1}}`), decoded)
+	if err != nil || reflect.DeepEqual(decoded.Payload, map[string]interface{}{"a": 1.0}) == false {
+		t.Errorf("expecting json payload without type, got %+v (%v)", decoded, err)
+	}
+	err = json.Unmarshal([]byte(`{"type": "xml", "payload": 1}`), decoded)
+	if err == nil {
+		t.Errorf("expecting error for unknown payload type")
+	}
+}
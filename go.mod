@@ -3,10 +3,12 @@ module github.com/reservoird/reservoird
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/golang/mock v1.4.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/reservoird/icd v1.0.16
 	github.com/reservoird/proxy v0.0.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,167 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrClosed is returned by calls on a closed connection
+var ErrClosed = errors.New("connection closed")
+
+// Handler answers calls and notifications from the other side, the result
+// of a notification is discarded
+type Handler func(method string, params json.RawMessage) (interface{}, error)
+
+// Conn multiplexes calls in both directions over a reader and writer
+type Conn struct {
+	r       io.Reader
+	w       io.Writer
+	handler Handler
+	next    uint64
+	pending map[uint64]chan Frame
+	done    chan struct{}
+	err     error
+	lock    sync.Mutex
+	wlock   sync.Mutex
+}
+
+// NewConn creates a connection and starts reading frames
+func NewConn(r io.Reader, w io.Writer, handler Handler) *Conn {
+	o := new(Conn)
+	o.r = r
+	o.w = w
+	o.handler = handler
+	o.pending = make(map[uint64]chan Frame)
+	o.done = make(chan struct{})
+	go o.read()
+	return o
+}
+
+// Done is closed once the connection fails or the other side goes away
+func (o *Conn) Done() <-chan struct{} {
+	return o.done
+}
+
+// Err returns why the connection closed
+func (o *Conn) Err() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.err
+}
+
+// write sends a frame
+func (o *Conn) write(frame Frame) error {
+	o.wlock.Lock()
+	defer o.wlock.Unlock()
+	return WriteFrame(o.w, frame)
+}
+
+// read dispatches frames until the reader fails
+func (o *Conn) read() {
+	for {
+		frame, err := ReadFrame(o.r)
+		if err != nil {
+			o.close(err)
+			return
+		}
+		if frame.Reply == true {
+			o.lock.Lock()
+			reply, ok := o.pending[frame.ID]
+			delete(o.pending, frame.ID)
+			o.lock.Unlock()
+			if ok == true {
+				reply <- frame
+			}
+		} else if frame.ID == 0 {
+			// notifications are handled in order
+			o.handler(frame.Method, frame.Params)
+		} else {
+			go o.answer(frame)
+		}
+	}
+}
+
+// answer handles a call and replies
+func (o *Conn) answer(frame Frame) {
+	reply := Frame{ID: frame.ID, Reply: true}
+	result, err := o.handler(frame.Method, frame.Params)
+	if err == nil {
+		reply.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		reply.Result = nil
+	}
+	o.write(reply)
+}
+
+// close fails pending calls
+func (o *Conn) close(err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.err != nil {
+		return
+	}
+	o.err = err
+	for id, reply := range o.pending {
+		close(reply)
+		delete(o.pending, id)
+	}
+	close(o.done)
+}
+
+// Call calls method on the other side waiting for the result, result may
+// be nil when it is not needed
+func (o *Conn) Call(method string, params interface{}, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	reply := make(chan Frame, 1)
+	o.lock.Lock()
+	if o.err != nil {
+		o.lock.Unlock()
+		return ErrClosed
+	}
+	o.next = o.next + 1
+	id := o.next
+	o.pending[id] = reply
+	o.lock.Unlock()
+
+	err = o.write(Frame{ID: id, Method: method, Params: data})
+	if err != nil {
+		o.lock.Lock()
+		delete(o.pending, id)
+		o.lock.Unlock()
+		return err
+	}
+	frame, ok := <-reply
+	if ok == false {
+		return ErrClosed
+	}
+	if frame.Error != "" {
+		return errors.New(frame.Error)
+	}
+	if result != nil && len(frame.Result) > 0 {
+		err = json.Unmarshal(frame.Result, result)
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+	}
+	return nil
+}
+
+// Notify sends method to the other side without waiting
+func (o *Conn) Notify(method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if o.Err() != nil {
+		return ErrClosed
+	}
+	return o.write(Frame{Method: method, Params: data})
+}
@@ -0,0 +1,134 @@
+// Package ipc runs plugins out of process. The host starts the plugin
+// executable and exchanges frames with it over the plugin's stdin and
+// stdout. Each frame is a 4 byte big endian length followed by that many
+// bytes of json encoded Frame.
+//
+// A frame with a method and an id is a call and is answered by a reply
+// frame with the same id, a frame with a method and no id is a
+// notification. Either side may call the other.
+package ipc
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/reservoird/reservoird/env"
+)
+
+// MaxFrameSize is the largest frame accepted
+const MaxFrameSize = 64 * 1024 * 1024
+
+// Value types
+const (
+	TypeBytes    = "bytes"
+	TypeString   = "string"
+	TypeJSON     = "json"
+	TypeEnvelope = "envelope"
+)
+
+// Frame is a call, notification or reply
+type Frame struct {
+	ID     uint64          `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Reply  bool            `json:"reply,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Value carries a message or stats across processes. Byte slices are
+// base64 encoded, strings are kept as strings and anything else is json
+// which is decoded on the other side.
+type Value struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// WriteFrame writes a length prefixed frame
+func WriteFrame(w io.Writer, frame Frame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds maximum of %d", len(data), MaxFrameSize)
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a length prefixed frame
+func ReadFrame(r io.Reader) (Frame, error) {
+	frame := Frame{}
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return frame, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > MaxFrameSize {
+		return frame, fmt.Errorf("frame of %d bytes exceeds maximum of %d", length, MaxFrameSize)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return frame, err
+	}
+	err = json.Unmarshal(data, &frame)
+	return frame, err
+}
+
+// Encode converts an item into a value
+func Encode(item interface{}) (Value, error) {
+	var data []byte
+	var err error
+	value := Value{}
+	switch v := item.(type) {
+	case []byte:
+		value.Type = TypeBytes
+		data, err = json.Marshal(base64.StdEncoding.EncodeToString(v))
+	case string:
+		value.Type = TypeString
+		data, err = json.Marshal(v)
+	case *env.Envelope, env.Envelope:
+		value.Type = TypeEnvelope
+		data, err = json.Marshal(v)
+	default:
+		value.Type = TypeJSON
+		data, err = json.Marshal(v)
+	}
+	value.Data = data
+	return value, err
+}
+
+// Decode converts a value back into an item
+func (o Value) Decode() (interface{}, error) {
+	switch o.Type {
+	case TypeBytes:
+		s := ""
+		err := json.Unmarshal(o.Data, &s)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(s)
+	case TypeString:
+		s := ""
+		err := json.Unmarshal(o.Data, &s)
+		return s, err
+	case TypeJSON:
+		var item interface{}
+		err := json.Unmarshal(o.Data, &item)
+		return item, err
+	case TypeEnvelope:
+		e := new(env.Envelope)
+		err := json.Unmarshal(o.Data, e)
+		return e, err
+	}
+	return nil, fmt.Errorf("%s: unknown value type", o.Type)
+}
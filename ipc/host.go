@@ -0,0 +1,477 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/reservoird/icd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// closeTimeout is how long Close lets a plugin exit once its stdin is
+// closed before killing it
+const closeTimeout = 5 * time.Second
+
+// ErrProcessClosed is returned when using a closed plugin process
+var ErrProcessClosed = errors.New("plugin process closed")
+
+var (
+	failHandler func(*icd.MonitorControl, interface{}, error) error
+	ackHandler  func(interface{}) error
+	nackHandler func(interface{}, error) error
+	handlerLock = sync.Mutex{}
+)
+
+// HandleFail sets how the host handles messages plugins fail, the run
+// package hands them to dead-letter queues
+func HandleFail(handler func(*icd.MonitorControl, interface{}, error) error) {
+	handlerLock.Lock()
+	defer handlerLock.Unlock()
+	failHandler = handler
+}
+
+// HandleDelivery sets how the host handles envelopes plugins ack and nack,
+// the run package hands them to the delivery of their ingester
+func HandleDelivery(ack func(interface{}) error, nack func(interface{}, error) error) {
+	handlerLock.Lock()
+	defer handlerLock.Unlock()
+	ackHandler = ack
+	nackHandler = nack
+}
+
+// Process is a plugin executable running as a subprocess. It is started
+// again on the next run when it exits, so a crashing plugin is restarted
+// by the supervisor rather than taking down the host, until closed. Lock is
+// held while starting the plugin, the name, connection and running state
+// are also set under state so Name and Running never wait on the plugin.
+type Process struct {
+	Path       string
+	Kind       string
+	Config     string
+	name       string
+	cmd        *exec.Cmd
+	conn       *Conn
+	stdin      io.Closer
+	exited     chan struct{}
+	closed     bool
+	running    bool
+	refreshing bool
+	runs       uint64
+	queues     []icd.Queue
+	mc         *icd.MonitorControl
+	lock       sync.Mutex
+	state      sync.Mutex
+}
+
+// NewProcess starts a plugin executable and creates its component
+func NewProcess(path string, kind string, config string) (*Process, error) {
+	o := new(Process)
+	o.Path = path
+	o.Kind = kind
+	o.Config = config
+	_, err := o.connection()
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// connection returns the connection to the plugin, starting it when needed
+func (o *Process) connection() (*Conn, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed == true {
+		return nil, fmt.Errorf("%s: %w", o.Path, ErrProcessClosed)
+	}
+	if o.conn != nil {
+		select {
+		case <-o.conn.Done():
+			log.WithFields(log.Fields{
+				"path": o.Path,
+				"err":  o.conn.Err(),
+			}).Warn("plugin process exited, starting again")
+		default:
+			return o.conn, nil
+		}
+	}
+
+	cmd := exec.Command(o.Path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	conn := NewConn(stdout, stdin, o.handle)
+	exited := make(chan struct{})
+	go func() {
+		<-conn.Done()
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		close(exited)
+	}()
+
+	result := NewResult{}
+	err = conn.Call(MethodNew, NewParams{Kind: o.Kind, Config: o.Config}, &result)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("%s: %v", o.Path, err)
+	}
+	running := false
+	err = conn.Call(MethodRunning, nil, &running)
+	if err != nil {
+		running = false
+	}
+	o.cmd = cmd
+	o.stdin = stdin
+	o.exited = exited
+	o.state.Lock()
+	o.name = result.Name
+	o.conn = conn
+	o.running = running
+	o.state.Unlock()
+	return conn, nil
+}
+
+// Close stops the plugin process and waits for it to exit. Its stdin is
+// closed so it can return on its own, it is killed when it does not within
+// the close timeout. It is not started again.
+func (o *Process) Close() error {
+	o.lock.Lock()
+	if o.closed == true {
+		o.lock.Unlock()
+		return nil
+	}
+	o.closed = true
+	cmd := o.cmd
+	stdin := o.stdin
+	exited := o.exited
+	o.lock.Unlock()
+	o.state.Lock()
+	o.running = false
+	o.state.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	stdin.Close()
+	select {
+	case <-exited:
+	case <-time.After(closeTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+	return nil
+}
+
+// Release closes the plugin process once its reservoir is disposed
+func (o *Process) Release() error {
+	return o.Close()
+}
+
+// handle answers calls from the plugin
+func (o *Process) handle(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case MethodStats, MethodFinal:
+		value := Value{}
+		err := json.Unmarshal(params, &value)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := value.Decode()
+		if err != nil {
+			return nil, err
+		}
+		o.state.Lock()
+		mc := o.mc
+		o.state.Unlock()
+		if mc == nil {
+			return nil, nil
+		}
+		statsChan := mc.StatsChan
+		if method == MethodFinal {
+			statsChan = mc.FinalStatsChan
+		}
+		select {
+		case statsChan <- stats:
+		default:
+		}
+		return nil, nil
+	case MethodFail:
+		p := FailParams{}
+		err := json.Unmarshal(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		item, err := p.Value.Decode()
+		if err != nil {
+			return nil, err
+		}
+		o.state.Lock()
+		mc := o.mc
+		o.state.Unlock()
+		handlerLock.Lock()
+		handler := failHandler
+		handlerLock.Unlock()
+		if mc == nil || handler == nil {
+			return nil, fmt.Errorf("%s: not handled by the host", method)
+		}
+		return nil, handler(mc, item, errors.New(p.Reason))
+	case MethodAck, MethodNack:
+		p := AckParams{}
+		err := json.Unmarshal(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		item, err := p.Value.Decode()
+		if err != nil {
+			return nil, err
+		}
+		handlerLock.Lock()
+		ack := ackHandler
+		nack := nackHandler
+		handlerLock.Unlock()
+		if ack == nil || nack == nil {
+			return nil, fmt.Errorf("%s: not handled by the host", method)
+		}
+		if method == MethodAck {
+			return nil, ack(item)
+		}
+		return nil, nack(item, errors.New(p.Reason))
+	}
+	p := QueueParams{}
+	err := json.Unmarshal(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	o.state.Lock()
+	if p.Queue < 0 || p.Queue >= len(o.queues) {
+		o.state.Unlock()
+		return nil, fmt.Errorf("%d: unknown queue", p.Queue)
+	}
+	queue := o.queues[p.Queue]
+	o.state.Unlock()
+	return serveQueue(queue, method, p)
+}
+
+// run runs the component in the plugin until it returns, forwarding stop
+// and clear to it
+func (o *Process) run(queues []icd.Queue, mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+
+	conn, err := o.connection()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": o.Path,
+			"err":  err,
+		}).Error("starting plugin process")
+		return
+	}
+	names := make([]string, len(queues))
+	for q := range queues {
+		names[q] = queues[q].Name()
+	}
+	o.state.Lock()
+	o.runs = o.runs + 1
+	ref := RunRef{Run: o.runs}
+	o.queues = queues
+	o.mc = mc
+	o.state.Unlock()
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-mc.DoneChan:
+				conn.Notify(MethodStop, ref)
+			case <-mc.ClearChan:
+				conn.Notify(MethodClear, ref)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	err = conn.Call(MethodRun, RunParams{Run: ref.Run, Queues: names}, nil)
+	close(stop)
+	o.refresh(conn)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": o.Path,
+			"err":  err,
+		}).Error("running plugin process")
+	}
+}
+
+// Name returns the name of the plugin component
+func (o *Process) Name() string {
+	o.state.Lock()
+	defer o.state.Unlock()
+	return o.name
+}
+
+// Running returns whether the plugin component is running as last reported
+// and asks the plugin again in the background, so a plugin that stops
+// answering never blocks the caller
+func (o *Process) Running() bool {
+	o.state.Lock()
+	defer o.state.Unlock()
+	if o.conn == nil {
+		return false
+	}
+	select {
+	case <-o.conn.Done():
+		return false
+	default:
+	}
+	if o.refreshing == false {
+		o.refreshing = true
+		go o.refresh(o.conn)
+	}
+	return o.running
+}
+
+// refresh asks the plugin whether its component is running
+func (o *Process) refresh(conn *Conn) {
+	running := false
+	err := conn.Call(MethodRunning, nil, &running)
+	o.state.Lock()
+	defer o.state.Unlock()
+	o.refreshing = false
+	if o.conn == conn {
+		o.running = err == nil && running
+	}
+}
+
+// Ingester is an ingester running in a plugin process
+type Ingester struct {
+	*Process
+}
+
+// NewIngester starts an ingester plugin executable
+func NewIngester(path string, config string) (icd.Ingester, error) {
+	process, err := NewProcess(path, KindIngester, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Ingester{Process: process}, nil
+}
+
+// Ingest runs the ingester in the plugin process
+func (o *Ingester) Ingest(snd icd.Queue, mc *icd.MonitorControl) {
+	o.run([]icd.Queue{snd}, mc)
+}
+
+// Digester is a digester running in a plugin process
+type Digester struct {
+	*Process
+}
+
+// NewDigester starts a digester plugin executable
+func NewDigester(path string, config string) (icd.Digester, error) {
+	process, err := NewProcess(path, KindDigester, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Digester{Process: process}, nil
+}
+
+// Digest runs the digester in the plugin process
+func (o *Digester) Digest(rcv icd.Queue, snd icd.Queue, mc *icd.MonitorControl) {
+	o.run([]icd.Queue{rcv, snd}, mc)
+}
+
+// Expeller is an expeller running in a plugin process
+type Expeller struct {
+	*Process
+}
+
+// NewExpeller starts an expeller plugin executable
+func NewExpeller(path string, config string) (icd.Expeller, error) {
+	process, err := NewProcess(path, KindExpeller, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Expeller{Process: process}, nil
+}
+
+// Expel runs the expeller in the plugin process
+func (o *Expeller) Expel(rcv []icd.Queue, mc *icd.MonitorControl) {
+	o.run(rcv, mc)
+}
+
+// Queue is a queue running in a plugin process
+type Queue struct {
+	*Process
+	remote *remoteQueue
+}
+
+// NewQueue starts a queue plugin executable
+func NewQueue(path string, config string) (icd.Queue, error) {
+	process, err := NewProcess(path, KindQueue, config)
+	if err != nil {
+		return nil, err
+	}
+	o := new(Queue)
+	o.Process = process
+	o.remote = &remoteQueue{conn: process.connection, index: 0, name: process.Name()}
+	return o, nil
+}
+
+// Put puts an item on the queue
+func (o *Queue) Put(item interface{}) error {
+	return o.remote.Put(item)
+}
+
+// Get gets an item from the queue
+func (o *Queue) Get() (interface{}, error) {
+	return o.remote.Get()
+}
+
+// Len returns the number of items
+func (o *Queue) Len() int {
+	return o.remote.Len()
+}
+
+// Cap returns the capacity
+func (o *Queue) Cap() int {
+	return o.remote.Cap()
+}
+
+// Clear clears the queue
+func (o *Queue) Clear() {
+	o.remote.Clear()
+}
+
+// Reset resets the queue
+func (o *Queue) Reset() {
+	o.remote.Reset()
+}
+
+// Close closes the queue
+func (o *Queue) Close() error {
+	return o.remote.Close()
+}
+
+// Closed returns whether the queue is closed
+func (o *Queue) Closed() bool {
+	return o.remote.Closed()
+}
+
+// Monitor runs the queue monitor in the plugin process
+func (o *Queue) Monitor(mc *icd.MonitorControl) {
+	o.run(nil, mc)
+}
@@ -0,0 +1,438 @@
+package ipc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/env"
+)
+
+const pluginEnv = "RESERVOIRD_IPC_TEST_PLUGIN"
+
+// TestMain runs the test binary as a plugin when asked to
+func TestMain(m *testing.M) {
+	switch os.Getenv(pluginEnv) {
+	case KindIngester:
+		ServeIngester(func(config string) (icd.Ingester, error) {
+			return &testIngester{config: config}, nil
+		})
+		os.Exit(0)
+	case KindDigester:
+		ServeDigester(func(config string) (icd.Digester, error) {
+			return &testDigester{fail: config == "fail", ack: config == "ack"}, nil
+		})
+		os.Exit(0)
+	case KindQueue:
+		ServeQueue(func(config string) (icd.Queue, error) {
+			return &testQueue{name: config}, nil
+		})
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testQueue is an unbounded queue returning an error when empty
+type testQueue struct {
+	name   string
+	items  []interface{}
+	closed bool
+	lock   sync.Mutex
+}
+
+func (o *testQueue) Name() string { return o.name }
+
+func (o *testQueue) Put(item interface{}) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.items = append(o.items, item)
+	return nil
+}
+
+func (o *testQueue) Get() (interface{}, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.items) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	item := o.items[0]
+	o.items = o.items[1:]
+	return item, nil
+}
+
+func (o *testQueue) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.items)
+}
+
+func (o *testQueue) Cap() int      { return -1 }
+func (o *testQueue) Clear()        { o.lock.Lock(); o.items = nil; o.lock.Unlock() }
+func (o *testQueue) Reset()        { o.lock.Lock(); o.closed = false; o.lock.Unlock() }
+func (o *testQueue) Close() error  { o.lock.Lock(); o.closed = true; o.lock.Unlock(); return nil }
+func (o *testQueue) Closed() bool  { o.lock.Lock(); defer o.lock.Unlock(); return o.closed }
+func (o *testQueue) Running() bool { return true }
+func (o *testQueue) Monitor(mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	<-mc.DoneChan
+	mc.FinalStatsChan <- o.Len()
+}
+
+// testIngester puts config items then waits, or exits with crash, or
+// stops answering whether it is running after the first time with hang
+type testIngester struct {
+	config string
+	asked  int32
+}
+
+func (o *testIngester) Name() string { return "testingester" }
+
+func (o *testIngester) Running() bool {
+	if o.config == "hang" && atomic.AddInt32(&o.asked, 1) > 1 {
+		select {}
+	}
+	return true
+}
+
+func (o *testIngester) Ingest(snd icd.Queue, mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	if o.config == "crash" {
+		os.Exit(1)
+	}
+	count, _ := strconv.Atoi(o.config)
+	for i := 0; i < count; i++ {
+		snd.Put([]byte(strconv.Itoa(i)))
+	}
+	mc.StatsChan <- map[string]interface{}{"count": count}
+	<-mc.DoneChan
+	mc.FinalStatsChan <- map[string]interface{}{"count": count}
+}
+
+// testDigester upper cases strings until stopped, or fails them with fail
+// or acks them with ack
+type testDigester struct {
+	fail bool
+	ack  bool
+}
+
+func (o *testDigester) Name() string  { return "testdigester" }
+func (o *testDigester) Running() bool { return true }
+
+func (o *testDigester) Digest(rcv icd.Queue, snd icd.Queue, mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	for {
+		select {
+		case <-mc.DoneChan:
+			return
+		default:
+		}
+		item, err := rcv.Get()
+		if err != nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if o.fail == true {
+			Fail(mc, item, fmt.Errorf("cannot digest %v", item))
+			continue
+		}
+		if o.ack == true {
+			Ack(item)
+			Nack(item, fmt.Errorf("cannot digest %v", item))
+			continue
+		}
+		snd.Put(strings.ToUpper(item.(string)))
+	}
+}
+
+func newMonitorControl() *icd.MonitorControl {
+	return &icd.MonitorControl{
+		StatsChan:      make(chan interface{}, 1),
+		FinalStatsChan: make(chan interface{}, 1),
+		ClearChan:      make(chan struct{}, 1),
+		DoneChan:       make(chan struct{}, 1),
+		WaitGroup:      &sync.WaitGroup{},
+	}
+}
+
+// waitLen waits for a queue to reach n items
+func waitLen(t *testing.T, queue icd.Queue, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting %d items but got %d", n, queue.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WriteFrame(buf, Frame{ID: 1, Method: MethodRun, Params: []byte(`{"run":1}`)})
+	if err != nil {
+		t.Fatalf("error writing frame: %v", err)
+	}
+	frame, err := ReadFrame(buf)
+	if err != nil || frame.ID != 1 || frame.Method != MethodRun || string(frame.Params) != `{"run":1}` {
+		t.Errorf("unexpected frame %+v (%v)", frame, err)
+	}
+	_, err = ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	if err == nil {
+		t.Errorf("expecting error for oversized frame")
+	}
+}
+
+func TestValue(t *testing.T) {
+	items := []interface{}{[]byte{0, 1, 2}, "string", map[string]interface{}{"key": 1.0}}
+	for _, item := range items {
+		value, err := Encode(item)
+		if err != nil {
+			t.Fatalf("error encoding %v: %v", item, err)
+		}
+		decoded, err := value.Decode()
+		if err != nil || fmt.Sprintf("%#v", decoded) != fmt.Sprintf("%#v", item) {
+			t.Errorf("expecting %#v but got %#v (%v)", item, decoded, err)
+		}
+	}
+
+	e := env.New([]byte{3})
+	value, err := Encode(e)
+	if err != nil || value.Type != TypeEnvelope {
+		t.Fatalf("expecting envelope value, got %v (%v)", value.Type, err)
+	}
+	decoded, err := value.Decode()
+	d, ok := decoded.(*env.Envelope)
+	if err != nil || ok == false || d.ID != e.ID || reflect.DeepEqual(d.Payload, []byte{3}) == false {
+		t.Errorf("expecting %+v but got %+v (%v)", e, decoded, err)
+	}
+}
+
+func TestIngester(t *testing.T) {
+	os.Setenv(pluginEnv, KindIngester)
+	defer os.Unsetenv(pluginEnv)
+	ingester, err := NewIngester(os.Args[0], "10")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	if ingester.Name() != "testingester" || ingester.Running() == false {
+		t.Errorf("unexpected name %s", ingester.Name())
+	}
+	queue := &testQueue{name: "queue"}
+	mc := newMonitorControl()
+	mc.WaitGroup.Add(1)
+	go ingester.Ingest(queue, mc)
+	waitLen(t, queue, 10)
+	item, _ := queue.Get()
+	if b, ok := item.([]byte); ok == false || string(b) != "0" {
+		t.Errorf("expecting bytes 0 but got %#v", item)
+	}
+	stats := <-mc.StatsChan
+	if stats.(map[string]interface{})["count"] != 10.0 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+	mc.DoneChan <- struct{}{}
+	mc.WaitGroup.Wait()
+	final := <-mc.FinalStatsChan
+	if final.(map[string]interface{})["count"] != 10.0 {
+		t.Errorf("unexpected final stats %v", final)
+	}
+}
+
+func TestDigester(t *testing.T) {
+	os.Setenv(pluginEnv, KindDigester)
+	defer os.Unsetenv(pluginEnv)
+	digester, err := NewDigester(os.Args[0], "")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	rcv := &testQueue{name: "rcv"}
+	snd := &testQueue{name: "snd"}
+	rcv.Put("a")
+	rcv.Put("b")
+	mc := newMonitorControl()
+	mc.WaitGroup.Add(1)
+	go digester.Digest(rcv, snd, mc)
+	waitLen(t, snd, 2)
+	mc.DoneChan <- struct{}{}
+	mc.WaitGroup.Wait()
+	item, _ := snd.Get()
+	if item != "A" {
+		t.Errorf("expecting A but got %v", item)
+	}
+}
+
+func TestDigesterFail(t *testing.T) {
+	os.Setenv(pluginEnv, KindDigester)
+	defer os.Unsetenv(pluginEnv)
+	digester, err := NewDigester(os.Args[0], "fail")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	defer digester.(*Digester).Close()
+	mc := newMonitorControl()
+	failed := &testQueue{name: "failed"}
+	HandleFail(func(from *icd.MonitorControl, item interface{}, reason error) error {
+		if from != mc {
+			return fmt.Errorf("unknown monitor and control")
+		}
+		return failed.Put(reason.Error())
+	})
+	defer HandleFail(nil)
+	rcv := &testQueue{name: "rcv"}
+	rcv.Put("a")
+	mc.WaitGroup.Add(1)
+	go digester.Digest(rcv, &testQueue{name: "snd"}, mc)
+	waitLen(t, failed, 1)
+	mc.DoneChan <- struct{}{}
+	mc.WaitGroup.Wait()
+	item, _ := failed.Get()
+	if item != "cannot digest a" {
+		t.Errorf("expecting the reason of the failed message but got %v", item)
+	}
+	err = Fail(mc, "a", fmt.Errorf("bad"))
+	if err == nil {
+		t.Errorf("expecting error failing outside a plugin executable")
+	}
+}
+
+func TestDigesterAck(t *testing.T) {
+	os.Setenv(pluginEnv, KindDigester)
+	defer os.Unsetenv(pluginEnv)
+	digester, err := NewDigester(os.Args[0], "ack")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	defer digester.(*Digester).Close()
+	outcomes := &testQueue{name: "outcomes"}
+	HandleDelivery(func(item interface{}) error {
+		return outcomes.Put(fmt.Sprintf("ack %v", item))
+	}, func(item interface{}, reason error) error {
+		return outcomes.Put(fmt.Sprintf("nack %v", reason))
+	})
+	defer HandleDelivery(nil, nil)
+	mc := newMonitorControl()
+	rcv := &testQueue{name: "rcv"}
+	rcv.Put("a")
+	mc.WaitGroup.Add(1)
+	go digester.Digest(rcv, &testQueue{name: "snd"}, mc)
+	waitLen(t, outcomes, 2)
+	mc.DoneChan <- struct{}{}
+	mc.WaitGroup.Wait()
+	ack, _ := outcomes.Get()
+	nack, _ := outcomes.Get()
+	if ack != "ack a" || nack != "nack cannot digest a" {
+		t.Errorf("expecting the ack and nack of a but got %v %v", ack, nack)
+	}
+	if Ack("a") == nil {
+		t.Errorf("expecting error acking outside a plugin executable")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	os.Setenv(pluginEnv, KindQueue)
+	defer os.Unsetenv(pluginEnv)
+	queue, err := NewQueue(os.Args[0], "remote")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	if queue.Name() != "remote" {
+		t.Errorf("expecting remote but got %s", queue.Name())
+	}
+	queue.Put("a")
+	queue.Put(1)
+	if queue.Len() != 2 {
+		t.Errorf("expecting 2 items but got %d", queue.Len())
+	}
+	item, err := queue.Get()
+	if err != nil || item != "a" {
+		t.Errorf("expecting a but got %v (%v)", item, err)
+	}
+	mc := newMonitorControl()
+	mc.WaitGroup.Add(1)
+	go queue.Monitor(mc)
+	mc.DoneChan <- struct{}{}
+	mc.WaitGroup.Wait()
+	if final := <-mc.FinalStatsChan; final != 1.0 {
+		t.Errorf("expecting final stats 1 but got %v", final)
+	}
+	queue.Close()
+	if queue.Closed() == false {
+		t.Errorf("expecting closed queue")
+	}
+}
+
+func TestCrash(t *testing.T) {
+	os.Setenv(pluginEnv, KindIngester)
+	defer os.Unsetenv(pluginEnv)
+	ingester, err := NewIngester(os.Args[0], "crash")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		mc := newMonitorControl()
+		mc.WaitGroup.Add(1)
+		ingester.Ingest(&testQueue{name: "queue"}, mc)
+		mc.WaitGroup.Wait()
+	}
+	if ingester.Running() == true {
+		t.Errorf("expecting crashed plugin not running")
+	}
+}
+
+func TestRunningHung(t *testing.T) {
+	os.Setenv(pluginEnv, KindIngester)
+	defer os.Unsetenv(pluginEnv)
+	ingester, err := NewIngester(os.Args[0], "hang")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	defer ingester.(*Ingester).Close()
+	answered := make(chan bool)
+	go func() {
+		ingester.Running()
+		answered <- ingester.Running()
+	}()
+	select {
+	case running := <-answered:
+		if running == false {
+			t.Errorf("expecting the last running state")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expecting running not to wait on a hung plugin")
+	}
+}
+
+func TestProcessClose(t *testing.T) {
+	os.Setenv(pluginEnv, KindIngester)
+	defer os.Unsetenv(pluginEnv)
+	process, err := NewProcess(os.Args[0], KindIngester, "")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	err = process.Close()
+	if err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	if process.cmd.ProcessState == nil {
+		t.Errorf("expecting plugin process exited")
+	}
+	if process.Running() == true {
+		t.Errorf("expecting closed plugin not running")
+	}
+	_, err = process.connection()
+	if errors.Is(err, ErrProcessClosed) == false {
+		t.Errorf("expecting closed plugin not started again, got %v", err)
+	}
+	err = process.Close()
+	if err != nil {
+		t.Errorf("expecting closing twice to succeed, got %v", err)
+	}
+}
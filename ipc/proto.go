@@ -0,0 +1,99 @@
+package ipc
+
+// Kinds of component a plugin serves, the same as in cfg and run
+const (
+	KindIngester = "ingester"
+	KindDigester = "digester"
+	KindExpeller = "expeller"
+	KindQueue    = "queue"
+)
+
+// Methods called by the host on the plugin
+const (
+	// MethodNew creates the component with NewParams returning NewResult
+	MethodNew = "new"
+	// MethodRunning returns whether the component is running
+	MethodRunning = "running"
+	// MethodRun runs Ingest, Digest, Expel or Monitor with RunParams
+	// returning once it does
+	MethodRun = "run"
+	// MethodStop notifies a run, given by RunRef, to stop
+	MethodStop = "stop"
+	// MethodClear notifies a run, given by RunRef, to clear its stats
+	MethodClear = "clear"
+)
+
+// Methods called by the plugin on the host
+const (
+	// MethodStats notifies the host of stats as a Value
+	MethodStats = "stats"
+	// MethodFinal notifies the host of final stats as a Value
+	MethodFinal = "final"
+	// MethodFail hands a message the component could not process to the
+	// host with FailParams, see Fail
+	MethodFail = "fail"
+	// MethodAck acknowledges a delivered envelope with AckParams, see Ack
+	MethodAck = "ack"
+	// MethodNack tells an envelope was not delivered with AckParams and a
+	// reason, see Nack. Outcomes are not sent to plugins, an ingester
+	// served by a plugin executable cannot read them.
+	MethodNack = "nack"
+)
+
+// Queue methods take QueueParams. The plugin calls them on the host for
+// the queues passed in RunParams and the host calls them on a queue plugin
+// with queue 0.
+const (
+	MethodQueuePut    = "queue.put"
+	MethodQueueGet    = "queue.get"
+	MethodQueueLen    = "queue.len"
+	MethodQueueCap    = "queue.cap"
+	MethodQueueClear  = "queue.clear"
+	MethodQueueReset  = "queue.reset"
+	MethodQueueClose  = "queue.close"
+	MethodQueueClosed = "queue.closed"
+)
+
+// NewParams are the params of MethodNew, config is a path or inline json
+type NewParams struct {
+	Kind   string `json:"kind"`
+	Config string `json:"config"`
+}
+
+// NewResult is the result of MethodNew
+type NewResult struct {
+	Name string `json:"name"`
+}
+
+// RunParams are the params of MethodRun. Run numbers each run of the
+// component and Queues names the queues it uses in the order of Ingest
+// (snd), Digest (rcv, snd) or Expel (rcv...).
+type RunParams struct {
+	Run    uint64   `json:"run"`
+	Queues []string `json:"queues"`
+}
+
+// RunRef are the params of MethodStop and MethodClear
+type RunRef struct {
+	Run uint64 `json:"run"`
+}
+
+// FailParams are the params of MethodFail
+type FailParams struct {
+	Value  Value  `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// AckParams are the params of MethodAck and MethodNack, reason is only set
+// for MethodNack
+type AckParams struct {
+	Value  Value  `json:"value"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// QueueParams are the params of the queue methods, value is only set for
+// MethodQueuePut
+type QueueParams struct {
+	Queue int    `json:"queue"`
+	Value *Value `json:"value,omitempty"`
+}
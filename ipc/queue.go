@@ -0,0 +1,127 @@
+package ipc
+
+import (
+	"fmt"
+
+	"github.com/reservoird/icd"
+)
+
+// remoteQueue is a queue on the other side of a connection
+type remoteQueue struct {
+	conn  func() (*Conn, error)
+	index int
+	name  string
+}
+
+// call calls a queue method on the other side
+func (o *remoteQueue) call(method string, value *Value, result interface{}) error {
+	conn, err := o.conn()
+	if err != nil {
+		return err
+	}
+	return conn.Call(method, QueueParams{Queue: o.index, Value: value}, result)
+}
+
+// Name returns the name of the queue
+func (o *remoteQueue) Name() string {
+	return o.name
+}
+
+// Put puts an item on the queue
+func (o *remoteQueue) Put(item interface{}) error {
+	value, err := Encode(item)
+	if err != nil {
+		return err
+	}
+	return o.call(MethodQueuePut, &value, nil)
+}
+
+// Get gets an item from the queue
+func (o *remoteQueue) Get() (interface{}, error) {
+	value := Value{}
+	err := o.call(MethodQueueGet, nil, &value)
+	if err != nil {
+		return nil, err
+	}
+	return value.Decode()
+}
+
+// Len returns the number of items, 0 when unreachable
+func (o *remoteQueue) Len() int {
+	n := 0
+	o.call(MethodQueueLen, nil, &n)
+	return n
+}
+
+// Cap returns the capacity, 0 when unreachable
+func (o *remoteQueue) Cap() int {
+	n := 0
+	o.call(MethodQueueCap, nil, &n)
+	return n
+}
+
+// Clear clears the queue
+func (o *remoteQueue) Clear() {
+	o.call(MethodQueueClear, nil, nil)
+}
+
+// Reset resets the queue
+func (o *remoteQueue) Reset() {
+	o.call(MethodQueueReset, nil, nil)
+}
+
+// Close closes the queue
+func (o *remoteQueue) Close() error {
+	return o.call(MethodQueueClose, nil, nil)
+}
+
+// Closed returns whether the queue is closed, true when unreachable
+func (o *remoteQueue) Closed() bool {
+	closed := true
+	err := o.call(MethodQueueClosed, nil, &closed)
+	if err != nil {
+		return true
+	}
+	return closed
+}
+
+// Monitor does nothing, queues passed to a plugin are monitored by the host
+func (o *remoteQueue) Monitor(mc *icd.MonitorControl) {
+	mc.WaitGroup.Done()
+}
+
+// serveQueue answers a queue method using a local queue
+func serveQueue(queue icd.Queue, method string, p QueueParams) (interface{}, error) {
+	switch method {
+	case MethodQueuePut:
+		if p.Value == nil {
+			return nil, fmt.Errorf("%s: missing value", method)
+		}
+		item, err := p.Value.Decode()
+		if err != nil {
+			return nil, err
+		}
+		return nil, queue.Put(item)
+	case MethodQueueGet:
+		item, err := queue.Get()
+		if err != nil {
+			return nil, err
+		}
+		return Encode(item)
+	case MethodQueueLen:
+		return queue.Len(), nil
+	case MethodQueueCap:
+		return queue.Cap(), nil
+	case MethodQueueClear:
+		queue.Clear()
+		return nil, nil
+	case MethodQueueReset:
+		queue.Reset()
+		return nil, nil
+	case MethodQueueClose:
+		return nil, queue.Close()
+	case MethodQueueClosed:
+		return queue.Closed(), nil
+	}
+	return nil, fmt.Errorf("%s: unknown method", method)
+}
@@ -0,0 +1,323 @@
+package ipc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/cfg"
+)
+
+// server runs a component in the plugin process on behalf of the host
+type server struct {
+	kind      string
+	function  func(string) (interface{}, error)
+	conn      *Conn
+	component interface{}
+	mcs       map[uint64]*icd.MonitorControl
+	finished  uint64
+	lock      sync.Mutex
+}
+
+var (
+	served     *server
+	servedLock = sync.Mutex{}
+)
+
+// Fail hands a message a digester or expeller could not process to the
+// host with the reason, the same as run.Fail for components served by a
+// plugin executable. mc is the monitor and control passed to Digest or
+// Expel.
+func Fail(mc *icd.MonitorControl, item interface{}, reason error) error {
+	servedLock.Lock()
+	o := served
+	servedLock.Unlock()
+	if o == nil {
+		return fmt.Errorf("%s: not served by a plugin executable", MethodFail)
+	}
+	running := false
+	o.lock.Lock()
+	for _, current := range o.mcs {
+		if current == mc {
+			running = true
+		}
+	}
+	o.lock.Unlock()
+	if running == false {
+		return fmt.Errorf("%s: not a running component", MethodFail)
+	}
+	value, err := Encode(item)
+	if err != nil {
+		return err
+	}
+	return o.conn.Call(MethodFail, FailParams{Value: value, Reason: fmt.Sprintf("%v", reason)}, nil)
+}
+
+// Ack acknowledges an envelope was delivered, the same as run.Ack for
+// components served by a plugin executable
+func Ack(item interface{}) error {
+	return callDelivery(MethodAck, item, "")
+}
+
+// Nack tells an envelope was not delivered, the same as run.Nack for
+// components served by a plugin executable
+func Nack(item interface{}, reason error) error {
+	return callDelivery(MethodNack, item, fmt.Sprintf("%v", reason))
+}
+
+// callDelivery calls MethodAck or MethodNack on the host
+func callDelivery(method string, item interface{}, reason string) error {
+	servedLock.Lock()
+	o := served
+	servedLock.Unlock()
+	if o == nil {
+		return fmt.Errorf("%s: not served by a plugin executable", method)
+	}
+	value, err := Encode(item)
+	if err != nil {
+		return err
+	}
+	return o.conn.Call(method, AckParams{Value: value, Reason: reason}, nil)
+}
+
+// ServeIngester serves an ingester over stdin and stdout until the host
+// goes away, function is the same New used to build a .so plugin
+func ServeIngester(function func(string) (icd.Ingester, error)) error {
+	return serve(KindIngester, func(config string) (interface{}, error) {
+		return function(config)
+	})
+}
+
+// ServeDigester serves a digester over stdin and stdout
+func ServeDigester(function func(string) (icd.Digester, error)) error {
+	return serve(KindDigester, func(config string) (interface{}, error) {
+		return function(config)
+	})
+}
+
+// ServeExpeller serves an expeller over stdin and stdout
+func ServeExpeller(function func(string) (icd.Expeller, error)) error {
+	return serve(KindExpeller, func(config string) (interface{}, error) {
+		return function(config)
+	})
+}
+
+// ServeQueue serves a queue over stdin and stdout
+func ServeQueue(function func(string) (icd.Queue, error)) error {
+	return serve(KindQueue, func(config string) (interface{}, error) {
+		return function(config)
+	})
+}
+
+// serve answers the host until stdin closes, stdout is reserved for frames
+// so plugins should log to stderr
+func serve(kind string, function func(string) (interface{}, error)) error {
+	o := new(server)
+	o.kind = kind
+	o.function = function
+	o.mcs = make(map[uint64]*icd.MonitorControl)
+	o.conn = NewConn(os.Stdin, os.Stdout, o.handle)
+	servedLock.Lock()
+	served = o
+	servedLock.Unlock()
+	<-o.conn.Done()
+	err := o.conn.Err()
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// connection returns the connection to the host
+func (o *server) connection() (*Conn, error) {
+	return o.conn, nil
+}
+
+// get returns the component once created
+func (o *server) get() (interface{}, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.component == nil {
+		return nil, fmt.Errorf("%s: not created", o.kind)
+	}
+	return o.component, nil
+}
+
+// monitorControl returns the monitor and control of a run, nil once the
+// run finished. Stop may arrive before the run starts so either creates it.
+func (o *server) monitorControl(run uint64) *icd.MonitorControl {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if run <= o.finished {
+		return nil
+	}
+	mc, ok := o.mcs[run]
+	if ok == false {
+		mc = &icd.MonitorControl{
+			StatsChan:      make(chan interface{}, 1),
+			FinalStatsChan: make(chan interface{}, 1),
+			ClearChan:      make(chan struct{}, 1),
+			DoneChan:       make(chan struct{}, 1),
+			WaitGroup:      &sync.WaitGroup{},
+		}
+		o.mcs[run] = mc
+	}
+	return mc
+}
+
+// handle answers calls from the host
+func (o *server) handle(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case MethodNew:
+		p := NewParams{}
+		err := json.Unmarshal(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		if p.Kind != o.kind {
+			return nil, fmt.Errorf("plugin serves %s not %s", o.kind, p.Kind)
+		}
+		var component interface{}
+		err = cfg.Config(p.Config).WithPath(func(path string) error {
+			component, err = o.function(path)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		named, ok := component.(interface{ Name() string })
+		if ok == false {
+			return nil, fmt.Errorf("%s: component has no name", o.kind)
+		}
+		o.lock.Lock()
+		o.component = component
+		o.lock.Unlock()
+		return NewResult{Name: named.Name()}, nil
+	case MethodRunning:
+		component, err := o.get()
+		if err != nil {
+			return nil, err
+		}
+		runner, ok := component.(interface{ Running() bool })
+		if ok == false {
+			return true, nil
+		}
+		return runner.Running(), nil
+	case MethodRun:
+		return nil, o.run(params)
+	case MethodStop, MethodClear:
+		ref := RunRef{}
+		err := json.Unmarshal(params, &ref)
+		if err != nil {
+			return nil, err
+		}
+		mc := o.monitorControl(ref.Run)
+		if mc == nil {
+			return nil, nil
+		}
+		ch := mc.DoneChan
+		if method == MethodClear {
+			ch = mc.ClearChan
+		}
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+		return nil, nil
+	}
+	if o.kind != KindQueue {
+		return nil, fmt.Errorf("%s: unknown method", method)
+	}
+	component, err := o.get()
+	if err != nil {
+		return nil, err
+	}
+	p := QueueParams{}
+	err = json.Unmarshal(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	return serveQueue(component.(icd.Queue), method, p)
+}
+
+// run runs the component until it returns, sending its stats to the host
+func (o *server) run(params json.RawMessage) error {
+	p := RunParams{}
+	err := json.Unmarshal(params, &p)
+	if err != nil {
+		return err
+	}
+	component, err := o.get()
+	if err != nil {
+		return err
+	}
+	mc := o.monitorControl(p.Run)
+	if mc == nil {
+		return fmt.Errorf("run %d already finished", p.Run)
+	}
+	queues := make([]icd.Queue, len(p.Queues))
+	for q := range p.Queues {
+		queues[q] = &remoteQueue{conn: o.connection, index: q, name: p.Queues[q]}
+	}
+	expected := map[string]int{KindIngester: 1, KindDigester: 2, KindQueue: 0}
+	n, ok := expected[o.kind]
+	if ok == true && n != len(queues) {
+		return fmt.Errorf("%s: expecting %d queues but got %d", o.kind, n, len(queues))
+	}
+
+	stop := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case stats := <-mc.StatsChan:
+				o.notify(MethodStats, stats)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	mc.WaitGroup.Add(1)
+	switch o.kind {
+	case KindIngester:
+		component.(icd.Ingester).Ingest(queues[0], mc)
+	case KindDigester:
+		component.(icd.Digester).Digest(queues[0], queues[1], mc)
+	case KindExpeller:
+		component.(icd.Expeller).Expel(queues, mc)
+	case KindQueue:
+		component.(icd.Queue).Monitor(mc)
+	}
+	mc.WaitGroup.Wait()
+	close(stop)
+	<-forwarded
+
+	select {
+	case stats := <-mc.FinalStatsChan:
+		o.notify(MethodFinal, stats)
+	default:
+	}
+
+	o.lock.Lock()
+	delete(o.mcs, p.Run)
+	if p.Run > o.finished {
+		o.finished = p.Run
+	}
+	o.lock.Unlock()
+	return nil
+}
+
+// notify sends stats to the host
+func (o *server) notify(method string, stats interface{}) {
+	value, err := Encode(stats)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "encoding %s: %v\n", method, err)
+		return
+	}
+	o.conn.Notify(method, value)
+}
@@ -0,0 +1,277 @@
+package run
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/ipc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoDeadLetter is returned by Fail when the component has no dead-letter
+// queue configured, the message is dropped
+var ErrNoDeadLetter = errors.New("no dead-letter queue")
+
+// ErrDeadLetterFull is returned by Fail when the dead-letter queue is full,
+// the message is dropped rather than blocking the component
+var ErrDeadLetterFull = errors.New("dead-letter queue full")
+
+func init() {
+	ipc.HandleFail(Fail)
+}
+
+// DeadLetter is a message a digester or expeller failed to process
+type DeadLetter struct {
+	Item   interface{} `json:"item"`
+	Reason string      `json:"reason"`
+	Node   string      `json:"node"`
+	Time   time.Time   `json:"time"`
+}
+
+// letter is what a dead-letter queue holds, the item is kept as is for
+// queues holding values and encoded for queues that serialize so byte
+// slices and envelopes come back as such
+type letter struct {
+	Value  ipc.Value `json:"value"`
+	Reason string    `json:"reason"`
+	Node   string    `json:"node"`
+	Time   time.Time `json:"time"`
+	item   interface{}
+}
+
+// DeadLetterItem is the dead-letter queue of a node. Only Fail puts into it
+// and only Peek, Replay and Clear get from it, all holding the lock, so Fail
+// knows whether there is room and never blocks.
+type DeadLetterItem struct {
+	QueueItem *QueueItem
+	node      string
+	mc        *icd.MonitorControl
+	dropped   uint64
+	lock      sync.Mutex
+}
+
+var (
+	deadLetters     = make(map[*icd.MonitorControl]*DeadLetterItem)
+	deadLettersLock = sync.Mutex{}
+)
+
+// NewDeadLetterItem creates the dead-letter queue of a node, routing Fail
+// calls made with the node's monitor and control to it
+func NewDeadLetterItem(node string, queueItem *QueueItem, mc *icd.MonitorControl) *DeadLetterItem {
+	o := new(DeadLetterItem)
+	o.QueueItem = queueItem
+	o.node = node
+	o.mc = mc
+	deadLettersLock.Lock()
+	deadLetters[mc] = o
+	deadLettersLock.Unlock()
+	return o
+}
+
+// Close stops routing Fail calls to the dead-letter queue
+func (o *DeadLetterItem) Close() {
+	deadLettersLock.Lock()
+	defer deadLettersLock.Unlock()
+	if deadLetters[o.mc] == o {
+		delete(deadLetters, o.mc)
+	}
+}
+
+// Fail hands a message a plugin could not process back to the host with
+// the reason, mc is the monitor and control passed to Digest or Expel. The
+// message goes to the component's dead-letter queue, without one it is
+// dropped and ErrNoDeadLetter returned, when the queue is full it is
+// dropped and ErrDeadLetterFull returned. An envelope tracked for delivery
+// is failed once dead-lettered so it is not delivered again.
+func Fail(mc *icd.MonitorControl, item interface{}, reason error) error {
+	deadLettersLock.Lock()
+	o, ok := deadLetters[mc]
+	deadLettersLock.Unlock()
+	if ok == false {
+		log.WithFields(log.Fields{
+			"reason": reason,
+		}).Warn("dropping failed message")
+		return ErrNoDeadLetter
+	}
+	value, err := ipc.Encode(item)
+	if err != nil {
+		return fmt.Errorf("%s: %v", o.node, err)
+	}
+	l := letter{
+		Value:  value,
+		Reason: fmt.Sprintf("%v", reason),
+		Node:   o.node,
+		Time:   time.Now(),
+		item:   item,
+	}
+	o.lock.Lock()
+	if o.full() == true {
+		o.dropped = o.dropped + 1
+		o.lock.Unlock()
+		log.WithFields(log.Fields{
+			"node":   o.node,
+			"reason": reason,
+		}).Warn("dead-letter queue full, dropping failed message")
+		return fmt.Errorf("%s: %w", o.node, ErrDeadLetterFull)
+	}
+	err = o.QueueItem.Queue.Put(l)
+	o.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	// a dead-lettered envelope is done with, it is not delivered again
+	settle(item, reason)
+	return nil
+}
+
+// full returns whether the dead-letter queue has no room, the lock must be
+// held
+func (o *DeadLetterItem) full() bool {
+	queue := o.QueueItem.Queue
+	capacity := queue.Cap()
+	return capacity > 0 && queue.Len() >= capacity
+}
+
+// restore puts letters back without blocking, returning how many were lost
+// and the last error, the lock must be held
+func (o *DeadLetterItem) restore(letters []letter) (int, error) {
+	lost := 0
+	var err error
+	for l := range letters {
+		if o.full() == true {
+			lost = lost + 1
+			err = ErrDeadLetterFull
+			continue
+		}
+		perr := o.QueueItem.Queue.Put(letters[l])
+		if perr != nil {
+			lost = lost + 1
+			err = perr
+		}
+	}
+	if lost > 0 {
+		log.WithFields(log.Fields{
+			"node": o.node,
+			"lost": lost,
+			"err":  err,
+		}).Error("dead letters lost putting them back")
+	}
+	return lost, err
+}
+
+// Dropped returns the number of failed messages dropped as the dead-letter
+// queue was full
+func (o *DeadLetterItem) Dropped() uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.dropped
+}
+
+// toLetter converts what a dead-letter queue returns into a letter, queues
+// that serialize return maps rather than letters
+func toLetter(x interface{}) letter {
+	switch v := x.(type) {
+	case letter:
+		return v
+	case map[string]interface{}:
+		l := letter{}
+		l.Reason, _ = v["reason"].(string)
+		l.Node, _ = v["node"].(string)
+		s, _ := v["time"].(string)
+		l.Time, _ = time.Parse(time.RFC3339Nano, s)
+		data, err := json.Marshal(v["value"])
+		if err == nil {
+			err = json.Unmarshal(data, &l.Value)
+		}
+		if err == nil {
+			l.item, err = l.Value.Decode()
+		}
+		if err != nil {
+			l.item = v["value"]
+		}
+		return l
+	}
+	return letter{item: x}
+}
+
+// deadLetter returns the letter as shown to users
+func (o letter) deadLetter() DeadLetter {
+	return DeadLetter{
+		Item:   o.item,
+		Reason: o.Reason,
+		Node:   o.Node,
+		Time:   o.Time,
+	}
+}
+
+// take removes up to count letters, all when count is negative, the lock
+// must be held
+func (o *DeadLetterItem) take(count int) ([]letter, error) {
+	queue := o.QueueItem.Queue
+	n := queue.Len()
+	if count >= 0 && count < n {
+		n = count
+	}
+	letters := make([]letter, 0, n)
+	for i := 0; i < n; i++ {
+		x, err := queue.Get()
+		if err != nil {
+			return letters, err
+		}
+		letters = append(letters, toLetter(x))
+	}
+	return letters, nil
+}
+
+// Peek returns up to count letters leaving them queued in order. Queues
+// cannot be read without getting, so every letter is taken and put back,
+// letters that cannot be put back are lost and reported in the error.
+func (o *DeadLetterItem) Peek(count int) ([]DeadLetter, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	letters, err := o.take(-1)
+	lost, perr := o.restore(letters)
+	if count >= 0 && count < len(letters) {
+		letters = letters[:count]
+	}
+	deadLetters := make([]DeadLetter, 0, len(letters))
+	for l := range letters {
+		deadLetters = append(deadLetters, letters[l].deadLetter())
+	}
+	if lost > 0 {
+		return deadLetters, fmt.Errorf("%s: %d dead letters lost putting them back: %v", o.node, lost, perr)
+	}
+	return deadLetters, err
+}
+
+// Replay moves up to count letters back onto queue, all when count is
+// negative, returning how many were moved. Letters are taken under the lock
+// and put outside it as queue may block, letters that cannot be put are
+// returned to the dead-letter queue while there is room.
+func (o *DeadLetterItem) Replay(queue icd.Queue, count int) (int, error) {
+	o.lock.Lock()
+	letters, err := o.take(count)
+	o.lock.Unlock()
+	for l := range letters {
+		perr := queue.Put(letters[l].item)
+		if perr != nil {
+			o.lock.Lock()
+			o.restore(letters[l:])
+			o.lock.Unlock()
+			return l, perr
+		}
+	}
+	return len(letters), err
+}
+
+// Clear removes every letter
+func (o *DeadLetterItem) Clear() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.QueueItem.Queue.Clear()
+}
@@ -0,0 +1,152 @@
+package run
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/dsk"
+	"github.com/reservoird/reservoird/env"
+)
+
+func TestDeadLetterFail(t *testing.T) {
+	err := Fail(newFakeMonitorControl(), 1, errors.New("bad"))
+	if errors.Is(err, ErrNoDeadLetter) == false {
+		t.Errorf("expecting no dead-letter queue, got %v", err)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	config := cfg.ReservoirCfg{
+		Name: "deadletter",
+		IngesterItems: []cfg.IngesterItemCfg{
+			{
+				Config:    "10",
+				QueueItem: cfg.QueueItemCfg{Config: "ingestqueue"},
+				Digesters: []cfg.DigesterItemCfg{
+					{
+						Config:     "fail",
+						QueueItem:  cfg.QueueItemCfg{Config: "digestqueue"},
+						DeadLetter: &cfg.QueueItemCfg{Config: "deadletters"},
+					},
+				},
+			},
+		},
+		ExpellerItems: []cfg.ExpellerItemCfg{{}},
+	}
+	reservoir, expellers, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	reservoirMap, _ := NewReservoirMap(cfg.Cfg{}, nil)
+	reservoirMap.Map[reservoir.Name] = reservoir
+	reservoirMap.Disposed[reservoir.Name] = false
+	reservoirMap.Stopped[reservoir.Name] = true
+
+	err = reservoirMap.Start("deadletter")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	node := "ingester0.digester0"
+	letters := make([]DeadLetter, 0)
+	for i := 0; i < 100 && len(letters) < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		letters, _ = reservoirMap.GetDeadLetters("deadletter", node, -1)
+	}
+	if len(letters) != 5 || letters[0].Item != 1 || letters[0].Reason != "odd" || letters[0].Node != node {
+		t.Fatalf("expecting 5 dead letters starting with 1, got %v", letters)
+	}
+	letters, _ = reservoirMap.GetDeadLetters("deadletter", node, 2)
+	if len(letters) != 2 {
+		t.Errorf("expecting 2 dead letters, got %d", len(letters))
+	}
+
+	_, err = reservoirMap.GetDeadLetters("deadletter", "expeller0", -1)
+	if errors.Is(err, ErrNotFound) == false {
+		t.Errorf("expecting not found without dead-letter queue, got %v", err)
+	}
+
+	// replayed items fail again and come back
+	replayed, err := reservoirMap.ReplayDeadLetters("deadletter", node, 3)
+	if err != nil || replayed != 3 {
+		t.Errorf("expecting 3 replayed, got %d (%v)", replayed, err)
+	}
+	for i := 0; i < 100 && len(letters) != 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		letters, _ = reservoirMap.GetDeadLetters("deadletter", node, -1)
+	}
+	if len(letters) != 5 || letters[4].Item != 5 {
+		t.Errorf("expecting replayed letters at the end, got %v", letters)
+	}
+
+	err = reservoirMap.ClearDeadLetters("deadletter", node)
+	if err != nil {
+		t.Errorf("error clearing: %v", err)
+	}
+	letters, _ = reservoirMap.GetDeadLetters("deadletter", node, -1)
+	if len(letters) != 0 {
+		t.Errorf("expecting no dead letters after clear, got %v", letters)
+	}
+
+	reservoir.Drain(5 * time.Second)
+	reservoir.UpdateFinal()
+	reservoir.Wait()
+	if expellers["expeller0"].Len() != 5 {
+		t.Errorf("expecting 5 items expelled, got %d", expellers["expeller0"].Len())
+	}
+}
+
+func TestDeadLetterSerialized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := dsk.NewQueue(dsk.Cfg{Dir: dir, MaxLen: 2})
+	if err != nil {
+		t.Fatalf("error creating queue: %v", err)
+	}
+	defer queue.Release()
+	mc := newFakeMonitorControl()
+	deadLetterItem := NewDeadLetterItem("digester0", &QueueItem{Queue: queue}, mc)
+
+	err = Fail(mc, []byte("bytes"), errors.New("bad"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = Fail(mc, env.New("enveloped"), errors.New("bad"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = Fail(mc, "dropped", errors.New("bad"))
+	if errors.Is(err, ErrDeadLetterFull) == false || deadLetterItem.Dropped() != 1 {
+		t.Errorf("expecting full dead-letter queue, got %v", err)
+	}
+
+	letters, err := deadLetterItem.Peek(-1)
+	if err != nil || len(letters) != 2 || letters[0].Reason != "bad" || letters[0].Node != "digester0" {
+		t.Fatalf("expecting 2 dead letters, got %v (%v)", letters, err)
+	}
+	replayed := newFakeQueue("replayed")
+	n, err := deadLetterItem.Replay(replayed, -1)
+	if err != nil || n != 2 {
+		t.Fatalf("expecting 2 replayed, got %d (%v)", n, err)
+	}
+	item, _ := replayed.Get()
+	if b, ok := item.([]byte); ok == false || string(b) != "bytes" {
+		t.Errorf("expecting bytes replayed, got %v", item)
+	}
+	item, _ = replayed.Get()
+	if e, ok := item.(*env.Envelope); ok == false || e.Payload != "enveloped" {
+		t.Errorf("expecting envelope replayed, got %v", item)
+	}
+
+	deadLetterItem.Close()
+	err = Fail(mc, "closed", errors.New("bad"))
+	if errors.Is(err, ErrNoDeadLetter) == false {
+		t.Errorf("expecting closed dead-letter queue unregistered, got %v", err)
+	}
+}
@@ -0,0 +1,495 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/env"
+	"github.com/reservoird/reservoird/ipc"
+	"github.com/reservoird/reservoird/sta"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Delivery defaults
+const (
+	DefaultInFlight    = 1000
+	DefaultAckTimeout  = 30 * time.Second
+	DefaultMaxAttempts = 3
+)
+
+var (
+	// ErrNoDelivery is returned by Deliveries when the ingester has no
+	// delivery configured
+	ErrNoDelivery = errors.New("no delivery configured")
+	// ErrNotInFlight is returned by Ack and Nack for messages not awaiting
+	// an acknowledgement
+	ErrNotInFlight = errors.New("message not in flight")
+	// ErrInFlightLimit is returned by Put when no acknowledgement or read
+	// outcome makes room within the timeout
+	ErrInFlightLimit = errors.New("in-flight limit reached")
+	// ErrDeliveryClosed is returned by Put once the delivery tracking of the
+	// ingester is closed
+	ErrDeliveryClosed = errors.New("delivery closed")
+	// ErrInFlight is returned by Put for an envelope whose ID is already in
+	// flight
+	ErrInFlight = errors.New("message already in flight")
+)
+
+func init() {
+	ipc.HandleDelivery(Ack, Nack)
+}
+
+// DeliveryPolicy determines how envelopes put by an ingester are tracked
+// until acknowledged
+type DeliveryPolicy struct {
+	InFlight    int
+	Timeout     time.Duration
+	MaxAttempts int
+}
+
+// NewDeliveryPolicy creates a delivery policy from config
+func NewDeliveryPolicy(config cfg.DeliveryCfg) (DeliveryPolicy, error) {
+	o := DeliveryPolicy{
+		InFlight:    config.InFlight,
+		Timeout:     DefaultAckTimeout,
+		MaxAttempts: config.MaxAttempts,
+	}
+	if o.InFlight < 0 {
+		return o, fmt.Errorf("%d: in flight cannot be negative", o.InFlight)
+	}
+	if o.InFlight == 0 {
+		o.InFlight = DefaultInFlight
+	}
+	if o.MaxAttempts < 0 {
+		return o, fmt.Errorf("%d: max attempts cannot be negative", o.MaxAttempts)
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = DefaultMaxAttempts
+	}
+	if config.Timeout != "" {
+		var err error
+		o.Timeout, err = time.ParseDuration(config.Timeout)
+		if err != nil {
+			return o, err
+		}
+		if o.Timeout <= 0 {
+			return o, fmt.Errorf("%s: timeout must be positive", config.Timeout)
+		}
+	}
+	return o, nil
+}
+
+// Delivery is the outcome of an envelope put by an ingester, acked once
+// every copy was acknowledged or failed after the last attempt
+type Delivery struct {
+	ID       string
+	Acked    bool
+	Reason   string
+	Attempts int
+}
+
+// inFlight is an envelope awaiting acknowledgements, pending counts the
+// copies of the current attempt not yet settled and failure is the reason a
+// copy was dead-lettered
+type inFlight struct {
+	envelope *env.Envelope
+	pending  int
+	attempts int
+	failure  string
+	timer    *time.Timer
+}
+
+// DeliveryItem tracks the envelopes put by an ingester until they are
+// acknowledged, delivering them again on nack or timeout. Ready is broadcast
+// whenever outcomes are kept or read or room is made in flight.
+type DeliveryItem struct {
+	Policy      DeliveryPolicy
+	node        string
+	queue       icd.Queue
+	mc          *icd.MonitorControl
+	deliveries  chan Delivery
+	inFlight    map[string]*inFlight
+	outcomes    []Delivery
+	reading     bool
+	closed      bool
+	ready       *sync.Cond
+	stop        chan struct{}
+	acked       uint64
+	nacked      uint64
+	expired     uint64
+	redelivered uint64
+	failed      uint64
+	dropped     uint64
+	lock        sync.Mutex
+}
+
+var (
+	deliveryItems    = make(map[*icd.MonitorControl]*DeliveryItem)
+	deliveryInFlight = make(map[string]*DeliveryItem)
+	deliveryLock     = sync.Mutex{}
+)
+
+// NewDeliveryItem creates the delivery tracking of an ingester, returned by
+// Deliveries for the ingester's monitor and control
+func NewDeliveryItem(node string, policy DeliveryPolicy, mc *icd.MonitorControl) *DeliveryItem {
+	o := new(DeliveryItem)
+	o.Policy = policy
+	o.node = node
+	o.mc = mc
+	o.deliveries = make(chan Delivery)
+	o.inFlight = make(map[string]*inFlight)
+	o.outcomes = make([]Delivery, 0)
+	o.ready = sync.NewCond(&o.lock)
+	o.stop = make(chan struct{})
+	deliveryLock.Lock()
+	deliveryItems[mc] = o
+	deliveryLock.Unlock()
+	return o
+}
+
+// Deliveries returns the outcomes of the envelopes an ingester put, mc is
+// the monitor and control passed to Ingest. Outcomes are kept from the first
+// call until read and count against the in-flight limit, so an ingester not
+// reading them is eventually refused puts. Plugin executables cannot read
+// outcomes, they are only counted in the stats.
+func Deliveries(mc *icd.MonitorControl) (<-chan Delivery, error) {
+	deliveryLock.Lock()
+	o, ok := deliveryItems[mc]
+	deliveryLock.Unlock()
+	if ok == false {
+		return nil, ErrNoDelivery
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.reading == false && o.closed == false {
+		o.reading = true
+		go o.send()
+	}
+	return o.deliveries, nil
+}
+
+// send hands the outcomes to the ingester in order, each is kept until read
+func (o *DeliveryItem) send() {
+	for {
+		o.lock.Lock()
+		for len(o.outcomes) == 0 && o.closed == false {
+			o.ready.Wait()
+		}
+		if o.closed == true {
+			o.lock.Unlock()
+			return
+		}
+		d := o.outcomes[0]
+		o.lock.Unlock()
+		select {
+		case o.deliveries <- d:
+		case <-o.stop:
+			return
+		}
+		o.lock.Lock()
+		if o.closed == false {
+			o.outcomes = o.outcomes[1:]
+			o.ready.Broadcast()
+		}
+		o.lock.Unlock()
+	}
+}
+
+// lookup returns the tracking and in-flight entry of the current attempt
+// of an envelope, the lock of the tracking is held when found
+func lookup(item interface{}) (*DeliveryItem, *inFlight, *env.Envelope, error) {
+	e, ok := env.From(item)
+	if ok == false {
+		return nil, nil, nil, ErrNotInFlight
+	}
+	deliveryLock.Lock()
+	o, ok := deliveryInFlight[e.ID]
+	deliveryLock.Unlock()
+	if ok == false {
+		return nil, nil, nil, ErrNotInFlight
+	}
+	o.lock.Lock()
+	f, ok := o.inFlight[e.ID]
+	if ok == false || strconv.Itoa(f.attempts) != e.Get(env.HeaderAttempt) {
+		o.lock.Unlock()
+		return nil, nil, nil, ErrNotInFlight
+	}
+	return o, f, e, nil
+}
+
+// Ack acknowledges an envelope was delivered, any component may ack, for
+// instance a digester dropping the message on purpose. The ingester is told
+// once every copy made by fan-outs is acknowledged or dead-lettered.
+func Ack(item interface{}) error {
+	o, f, e, err := lookup(item)
+	if err != nil {
+		return err
+	}
+	defer o.lock.Unlock()
+	f.pending = f.pending - 1
+	o.settled(e.ID, f)
+	return nil
+}
+
+// Nack tells an envelope was not delivered, it is delivered again until
+// the maximum attempts after which the ingester is told it failed
+func Nack(item interface{}, reason error) error {
+	o, f, e, err := lookup(item)
+	if err != nil {
+		return err
+	}
+	defer o.lock.Unlock()
+	o.nacked = o.nacked + 1
+	o.retry(e.ID, f, fmt.Sprintf("%v", reason))
+	return nil
+}
+
+// settle settles a copy of an envelope handed to a dead-letter queue so it
+// is not delivered again. Once every copy is settled the envelope fails with
+// the reason of the last dead-lettered copy, even if other copies were acked.
+func settle(item interface{}, reason error) {
+	o, f, e, err := lookup(item)
+	if err != nil {
+		return
+	}
+	defer o.lock.Unlock()
+	f.pending = f.pending - 1
+	f.failure = fmt.Sprintf("dead-lettered: %v", reason)
+	o.settled(e.ID, f)
+}
+
+// settled ends the tracking of an envelope once every copy is settled,
+// the lock must be held
+func (o *DeliveryItem) settled(id string, f *inFlight) {
+	if f.pending > 0 {
+		return
+	}
+	if f.failure != "" {
+		o.done(id, f, false, f.failure)
+		return
+	}
+	o.acked = o.acked + 1
+	o.done(id, f, true, "")
+}
+
+// copied adjusts the copies awaiting acknowledgement before a fan-out sends
+// an envelope down several or no queues
+func copied(item *env.Envelope, copies int) {
+	o, f, e, err := lookup(item)
+	if err != nil {
+		return
+	}
+	defer o.lock.Unlock()
+	f.pending = f.pending + copies - 1
+	o.settled(e.ID, f)
+}
+
+// track starts tracking an envelope, waiting for room in flight up to the
+// timeout
+func (o *DeliveryItem) track(e *env.Envelope) error {
+	deadline := time.Now().Add(o.Policy.Timeout)
+	e.Stamp(time.Now())
+	id := e.ID
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var expired *time.Timer
+	for len(o.inFlight)+len(o.outcomes) >= o.Policy.InFlight && o.closed == false {
+		_, ok := o.inFlight[id]
+		if ok == true {
+			return fmt.Errorf("%s: %w", id, ErrInFlight)
+		}
+		if time.Now().Before(deadline) == false {
+			return ErrInFlightLimit
+		}
+		if expired == nil {
+			// wake up to give up once the timeout passes
+			expired = time.AfterFunc(time.Until(deadline), func() {
+				o.lock.Lock()
+				o.ready.Broadcast()
+				o.lock.Unlock()
+			})
+			defer expired.Stop()
+		}
+		o.ready.Wait()
+	}
+	if o.closed == true {
+		return ErrDeliveryClosed
+	}
+	_, ok := o.inFlight[id]
+	if ok == true {
+		return fmt.Errorf("%s: %w", id, ErrInFlight)
+	}
+	f := &inFlight{
+		envelope: e.Clone(),
+		pending:  1,
+		attempts: 1,
+	}
+	e.Set(env.HeaderAttempt, "1")
+	f.timer = time.AfterFunc(o.Policy.Timeout, func() {
+		o.expire(id, f)
+	})
+	o.inFlight[id] = f
+	deliveryLock.Lock()
+	deliveryInFlight[id] = o
+	deliveryLock.Unlock()
+	return nil
+}
+
+// untrack stops tracking an envelope the queue refused
+func (o *DeliveryItem) untrack(id string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	f, ok := o.inFlight[id]
+	if ok == true {
+		f.timer.Stop()
+		o.forget(id)
+	}
+}
+
+// forget removes an envelope from flight making room for another, the lock
+// must be held
+func (o *DeliveryItem) forget(id string) {
+	delete(o.inFlight, id)
+	deliveryLock.Lock()
+	delete(deliveryInFlight, id)
+	deliveryLock.Unlock()
+	o.ready.Broadcast()
+}
+
+// done ends the tracking of an envelope keeping the outcome for the
+// ingester when it reads them, the lock must be held
+func (o *DeliveryItem) done(id string, f *inFlight, acked bool, reason string) {
+	f.timer.Stop()
+	o.forget(id)
+	if acked == false {
+		o.failed = o.failed + 1
+	}
+	if o.reading == true {
+		o.outcomes = append(o.outcomes, Delivery{ID: id, Acked: acked, Reason: reason, Attempts: f.attempts})
+		o.ready.Broadcast()
+	}
+}
+
+// expire delivers an envelope again when its attempt timed out
+func (o *DeliveryItem) expire(id string, f *inFlight) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	current, ok := o.inFlight[id]
+	if ok == false || current != f {
+		return
+	}
+	o.expired = o.expired + 1
+	o.retry(id, f, fmt.Sprintf("not acknowledged within %v", o.Policy.Timeout))
+}
+
+// retry delivers an envelope again or fails it after the last attempt, the
+// lock must be held
+func (o *DeliveryItem) retry(id string, f *inFlight, reason string) {
+	f.timer.Stop()
+	if f.attempts >= o.Policy.MaxAttempts {
+		o.done(id, f, false, reason)
+		return
+	}
+	f.attempts = f.attempts + 1
+	f.pending = 1
+	f.failure = ""
+	o.redelivered = o.redelivered + 1
+	e := f.envelope.Clone()
+	e.Set(env.HeaderAttempt, strconv.Itoa(f.attempts))
+	f.timer = time.AfterFunc(o.Policy.Timeout, func() {
+		o.expire(id, f)
+	})
+	// put outside the lock, the queue may block until the flow catches up
+	go func() {
+		o.lock.Lock()
+		closed := o.closed
+		o.lock.Unlock()
+		if closed == true {
+			return
+		}
+		err := o.queue.Put(e)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"node": o.node,
+				"id":   id,
+				"err":  err,
+			}).Warn("redelivering message")
+		}
+	}()
+}
+
+// Close stops tracking, the envelopes in flight are forgotten so they are
+// not delivered again and outcomes not read yet are dropped
+func (o *DeliveryItem) Close() {
+	deliveryLock.Lock()
+	if deliveryItems[o.mc] == o {
+		delete(deliveryItems, o.mc)
+	}
+	deliveryLock.Unlock()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed == true {
+		return
+	}
+	o.closed = true
+	for id, f := range o.inFlight {
+		f.timer.Stop()
+		o.forget(id)
+	}
+	o.dropped = o.dropped + uint64(len(o.outcomes))
+	o.outcomes = nil
+	o.ready.Broadcast()
+	close(o.stop)
+}
+
+// wrap wraps the ingester queue to track the envelopes put into it
+func (o *DeliveryItem) wrap(queueItem *QueueItem) {
+	o.queue = queueItem.Queue
+	queueItem.Queue = &deliveryQueue{Queue: queueItem.Queue, delivery: o}
+}
+
+// Stats returns the unacknowledged envelopes and what happened to the others
+func (o *DeliveryItem) Stats() sta.DeliveryStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return sta.DeliveryStats{
+		Unacked:     len(o.inFlight),
+		InFlight:    o.Policy.InFlight,
+		Acked:       o.acked,
+		Nacked:      o.nacked,
+		Expired:     o.expired,
+		Redelivered: o.redelivered,
+		Failed:      o.failed,
+		Dropped:     o.dropped,
+	}
+}
+
+// deliveryQueue tracks the *env.Envelope put into an ingester queue, other
+// messages pass untracked
+type deliveryQueue struct {
+	icd.Queue
+	delivery *DeliveryItem
+}
+
+// Put tracks an envelope then puts it into the wrapped queue
+func (o *deliveryQueue) Put(item interface{}) error {
+	e, ok := item.(*env.Envelope)
+	if ok == false || e == nil {
+		return o.Queue.Put(item)
+	}
+	err := o.delivery.track(e)
+	if err != nil {
+		return err
+	}
+	err = o.Queue.Put(item)
+	if err != nil {
+		o.delivery.untrack(e.ID)
+	}
+	return err
+}
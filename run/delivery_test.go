@@ -0,0 +1,268 @@
+package run
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/env"
+)
+
+func TestNewDeliveryPolicy(t *testing.T) {
+	policy, err := NewDeliveryPolicy(cfg.DeliveryCfg{})
+	if err != nil || policy.InFlight != DefaultInFlight || policy.Timeout != DefaultAckTimeout || policy.MaxAttempts != DefaultMaxAttempts {
+		t.Errorf("expecting defaults, got %+v (%v)", policy, err)
+	}
+	for _, config := range []cfg.DeliveryCfg{{InFlight: -1}, {MaxAttempts: -1}, {Timeout: "x"}, {Timeout: "-1s"}} {
+		_, err = NewDeliveryPolicy(config)
+		if err == nil {
+			t.Errorf("expecting error for %+v", config)
+		}
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	mc := newFakeMonitorControl()
+	_, err := Deliveries(mc)
+	if errors.Is(err, ErrNoDelivery) == false {
+		t.Errorf("expecting no delivery, got %v", err)
+	}
+	policy := DeliveryPolicy{InFlight: 2, Timeout: 50 * time.Millisecond, MaxAttempts: 2}
+	delivery := NewDeliveryItem("in", policy, mc)
+	queueItem := newFakeQueueItem("in")
+	delivery.wrap(queueItem)
+	deliveries, err := Deliveries(mc)
+	if err != nil {
+		t.Fatalf("error getting deliveries: %v", err)
+	}
+
+	acked := env.New("acked")
+	nacked := env.New("nacked")
+	queueItem.Queue.Put(acked)
+	queueItem.Queue.Put(nacked)
+	queueItem.Queue.Put("untracked")
+	if delivery.Stats().Unacked != 2 {
+		t.Fatalf("expecting 2 unacked, got %+v", delivery.Stats())
+	}
+
+	err = Ack(acked)
+	if err != nil {
+		t.Errorf("error acking: %v", err)
+	}
+	d := <-deliveries
+	if d.ID != acked.ID || d.Acked == false || d.Attempts != 1 {
+		t.Errorf("expecting acked delivery, got %+v", d)
+	}
+	if Ack(acked) != ErrNotInFlight || Ack("bare") != ErrNotInFlight {
+		t.Errorf("expecting messages not in flight")
+	}
+
+	// nacked messages come back with the next attempt, earlier attempts are
+	// no longer in flight and the last attempt expires
+	err = Nack(nacked, errors.New("down"))
+	if err != nil {
+		t.Errorf("error nacking: %v", err)
+	}
+	for i := 0; i < 100 && queueItem.Queue.Len() < 4; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if Ack(nacked) != ErrNotInFlight {
+		t.Errorf("expecting the first attempt no longer in flight")
+	}
+	d = <-deliveries
+	if d.ID != nacked.ID || d.Acked == true || d.Attempts != 2 || d.Reason == "" {
+		t.Errorf("expecting failed delivery after 2 attempts, got %+v", d)
+	}
+	stats := delivery.Stats()
+	if stats.Unacked != 0 || stats.Acked != 1 || stats.Nacked != 1 || stats.Redelivered != 1 || stats.Expired != 1 || stats.Failed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	queueItem.Queue.Get()
+	queueItem.Queue.Get()
+	queueItem.Queue.Get()
+	redelivered, _ := queueItem.Queue.Get()
+	e, ok := redelivered.(*env.Envelope)
+	if ok == false || e.ID != nacked.ID || e.Get(env.HeaderAttempt) != "2" {
+		t.Errorf("expecting the second attempt queued, got %+v", redelivered)
+	}
+}
+
+func TestDeliveryInFlightLimit(t *testing.T) {
+	delivery := NewDeliveryItem("in", DeliveryPolicy{InFlight: 1, Timeout: 20 * time.Millisecond, MaxAttempts: 3}, newFakeMonitorControl())
+	queueItem := newFakeQueueItem("in")
+	delivery.wrap(queueItem)
+	queueItem.Queue.Put(env.New("first"))
+	err := queueItem.Queue.Put(env.New("over"))
+	if errors.Is(err, ErrInFlightLimit) == false || delivery.Stats().Unacked != 1 {
+		t.Errorf("expecting in-flight limit with 1 unacked, got %v %+v", err, delivery.Stats())
+	}
+
+	// an ack makes room for a waiting put
+	delivery = NewDeliveryItem("in", DeliveryPolicy{InFlight: 1, Timeout: time.Minute, MaxAttempts: 3}, newFakeMonitorControl())
+	queueItem = newFakeQueueItem("in")
+	delivery.wrap(queueItem)
+	first := env.New("first")
+	queueItem.Queue.Put(first)
+	waiting := env.New("waiting")
+	put := make(chan error)
+	go func() {
+		put <- queueItem.Queue.Put(waiting)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	Ack(first)
+	select {
+	case err = <-put:
+		if err != nil {
+			t.Errorf("expecting the waiting put to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting the ack to wake the waiting put")
+	}
+	err = queueItem.Queue.Put(waiting.Clone())
+	if errors.Is(err, ErrInFlight) == false || delivery.Stats().Unacked != 1 {
+		t.Errorf("expecting a duplicate rejected, got %v %+v", err, delivery.Stats())
+	}
+}
+
+func TestDeliveryOutcomesKept(t *testing.T) {
+	mc := newFakeMonitorControl()
+	delivery := NewDeliveryItem("in", DeliveryPolicy{InFlight: 1, Timeout: 20 * time.Millisecond, MaxAttempts: 1}, mc)
+	queueItem := newFakeQueueItem("in")
+	delivery.wrap(queueItem)
+	deliveries, _ := Deliveries(mc)
+	first := env.New("first")
+	queueItem.Queue.Put(first)
+	Ack(first)
+	err := queueItem.Queue.Put(env.New("unread"))
+	if errors.Is(err, ErrInFlightLimit) == false {
+		t.Errorf("expecting the unread outcome to count in flight, got %v", err)
+	}
+	if d := <-deliveries; d.ID != first.ID || d.Acked == false {
+		t.Errorf("expecting the kept outcome, got %+v", d)
+	}
+	err = queueItem.Queue.Put(env.New("read"))
+	if err != nil {
+		t.Errorf("expecting room once the outcome is read, got %v", err)
+	}
+}
+
+func TestDeliveryClose(t *testing.T) {
+	mc := newFakeMonitorControl()
+	delivery := NewDeliveryItem("in", DeliveryPolicy{InFlight: 10, Timeout: 10 * time.Millisecond, MaxAttempts: 3}, mc)
+	queueItem := newFakeQueueItem("in")
+	delivery.wrap(queueItem)
+	Deliveries(mc)
+	acked := env.New("acked")
+	pending := env.New("pending")
+	queueItem.Queue.Put(acked)
+	queueItem.Queue.Put(pending)
+	Ack(acked)
+	delivery.Close()
+	delivery.Close()
+	time.Sleep(30 * time.Millisecond)
+	stats := delivery.Stats()
+	if stats.Unacked != 0 || stats.Redelivered != 0 || stats.Dropped != 1 || queueItem.Queue.Len() != 2 {
+		t.Errorf("expecting nothing in flight or redelivered and 1 dropped, got %+v", stats)
+	}
+	if Ack(pending) != ErrNotInFlight {
+		t.Errorf("expecting nothing in flight after close")
+	}
+	if _, err := Deliveries(mc); errors.Is(err, ErrNoDelivery) == false {
+		t.Errorf("expecting no delivery after close, got %v", err)
+	}
+	if err := queueItem.Queue.Put(env.New("late")); errors.Is(err, ErrDeliveryClosed) == false {
+		t.Errorf("expecting delivery closed, got %v", err)
+	}
+}
+
+func TestDeliveryDeadLettered(t *testing.T) {
+	mc := newFakeMonitorControl()
+	delivery := NewDeliveryItem("in", DeliveryPolicy{InFlight: 10, Timeout: time.Minute, MaxAttempts: 3}, mc)
+	delivery.wrap(newFakeQueueItem("in"))
+	deliveries, _ := Deliveries(mc)
+	digester := newFakeMonitorControl()
+	deadLetterItem := NewDeadLetterItem("digester0", newFakeQueueItem("failed"), digester)
+	defer deadLetterItem.Close()
+
+	// one copy is dead-lettered, the other acked afterwards
+	e := env.New("failing")
+	delivery.track(e)
+	copied(e, 2)
+	err := Fail(digester, e.Clone(), errors.New("bad"))
+	if err != nil {
+		t.Fatalf("error failing: %v", err)
+	}
+	if delivery.Stats().Unacked != 1 {
+		t.Errorf("expecting the other copy awaiting acknowledgement, got %+v", delivery.Stats())
+	}
+	err = Ack(e.Clone())
+	if err != nil {
+		t.Errorf("expecting the other copy acked, got %v", err)
+	}
+	d := <-deliveries
+	if d.ID != e.ID || d.Acked == true || d.Reason != "dead-lettered: bad" {
+		t.Errorf("expecting a failed delivery, got %+v", d)
+	}
+	stats := delivery.Stats()
+	if stats.Unacked != 0 || stats.Failed != 1 || stats.Acked != 0 {
+		t.Errorf("expecting the dead-lettered envelope settled, got %+v", stats)
+	}
+}
+
+func TestDeliveryCopies(t *testing.T) {
+	mc := newFakeMonitorControl()
+	delivery := NewDeliveryItem("in", DeliveryPolicy{InFlight: 10, Timeout: time.Minute, MaxAttempts: 1}, mc)
+	delivery.wrap(newFakeQueueItem("in"))
+	deliveries, _ := Deliveries(mc)
+
+	copies := env.New("copies")
+	delivery.track(copies)
+	copied(copies, 2)
+	Ack(copies.Clone())
+	if delivery.Stats().Unacked != 1 {
+		t.Errorf("expecting one copy awaiting acknowledgement")
+	}
+	Ack(copies.Clone())
+	if d := <-deliveries; d.ID != copies.ID || d.Acked == false {
+		t.Errorf("expecting acked once every copy is, got %+v", d)
+	}
+
+	unrouted := env.New("unrouted")
+	delivery.track(unrouted)
+	copied(unrouted, 0)
+	if d := <-deliveries; d.ID != unrouted.ID || d.Acked == false {
+		t.Errorf("expecting messages routed nowhere acked, got %+v", d)
+	}
+}
+
+func TestReservoirDelivery(t *testing.T) {
+	chain := fakeChain("", 0)
+	chain.Delivery = &cfg.DeliveryCfg{InFlight: 5}
+	config := cfg.ReservoirCfg{
+		Name:          "delivery",
+		IngesterItems: []cfg.IngesterItemCfg{chain},
+		ExpellerItems: []cfg.ExpellerItemCfg{{}},
+	}
+	reservoir, _, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	ingester := reservoir.Nodes[0]
+	if ingester.DeliveryItem == nil || ingester.DeliveryItem.Policy.InFlight != 5 {
+		t.Fatalf("expecting delivery on the ingester")
+	}
+	ingester.QueueItem().Inject(env.New("tracked"))
+	for _, c := range reservoir.GetMetrics() {
+		if c.ID == "ingester0" && (c.Delivery == nil || c.Delivery.Unacked != 1) {
+			t.Errorf("expecting 1 unacked in the ingester metrics, got %+v", c.Delivery)
+		}
+	}
+
+	chain.Delivery = &cfg.DeliveryCfg{Timeout: "soon"}
+	config.IngesterItems = []cfg.IngesterItemCfg{chain}
+	_, _, err = newFakeReservoir(config)
+	if err == nil {
+		t.Errorf("expecting error for a bad delivery timeout")
+	}
+}
@@ -0,0 +1,170 @@
+package run
+
+import (
+	"encoding/json"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/sta"
+)
+
+// links collects the connections between parts of a reservoir by id
+type links struct {
+	upstream   map[string][]string
+	downstream map[string][]string
+}
+
+// link connects from to to
+func (o *links) link(from string, to string) {
+	o.downstream[from] = append(o.downstream[from], to)
+	o.upstream[to] = append(o.upstream[to], from)
+}
+
+// ids returns the ids linked to id, never nil
+func ids(m map[string][]string, id string) []string {
+	if m[id] == nil {
+		return []string{}
+	}
+	return m[id]
+}
+
+// links connects the plugins, queues and stages of the reservoir
+func (o *Reservoir) links() *links {
+	l := &links{
+		upstream:   make(map[string][]string),
+		downstream: make(map[string][]string),
+	}
+	queueIDs := make(map[*QueueItem]string)
+	for _, m := range o.monitored() {
+		if m.queueItem != nil {
+			queueIDs[m.queueItem] = m.id
+		}
+	}
+	for _, node := range o.Nodes {
+		if node.MergeItem != nil {
+			for _, rcv := range node.MergeItem.RcvQueueItems {
+				l.link(queueIDs[rcv], node.ID+".merge")
+			}
+			l.link(node.ID+".merge", node.ID+".merge.queue")
+			l.link(node.ID+".merge.queue", node.ID)
+		} else {
+			for _, rcv := range node.RcvQueueItems {
+				l.link(queueIDs[rcv], node.ID)
+			}
+		}
+		if node.QueueItem() != nil {
+			l.link(node.ID, node.ID+".queue")
+		}
+		if node.DeadLetterItem != nil {
+			l.link(node.ID, node.ID+".deadletter")
+		}
+		if node.FanOutItem != nil {
+			l.link(node.ID+".queue", node.ID+".fanout")
+			for _, snd := range node.FanOutItem.SndQueueItems {
+				l.link(node.ID+".fanout", queueIDs[snd])
+			}
+		}
+	}
+	return l
+}
+
+// redacted replaces the values of inline configs
+const redacted = "redacted"
+
+// configJSON returns a config as json, nil when empty. Paths are returned as
+// is, inline configs may hold secrets so only their keys are returned with
+// every value redacted.
+func configJSON(config cfg.Config) json.RawMessage {
+	if config == "" {
+		return nil
+	}
+	if config.Inline() == true {
+		values := make(map[string]json.RawMessage)
+		err := json.Unmarshal([]byte(config), &values)
+		if err != nil {
+			return nil
+		}
+		keys := make(map[string]string)
+		for key := range values {
+			keys[key] = redacted
+		}
+		b, err := json.Marshal(keys)
+		if err != nil {
+			return nil
+		}
+		return b
+	}
+	b, err := config.MarshalJSON()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// locations returns the location and config of each part by id
+func (o *Reservoir) locations() map[string]cfg.QueueItemCfg {
+	locations := make(map[string]cfg.QueueItemCfg)
+	graph, err := o.config.ToGraph()
+	if err != nil {
+		return locations
+	}
+	for _, node := range o.Nodes {
+		nodeCfg, _ := graph.Node(node.ID)
+		locations[node.ID] = cfg.QueueItemCfg{
+			Location: nodeCfg.Location,
+			Config:   nodeCfg.Config,
+		}
+		queue := nodeCfg.QueueItem
+		locations[node.ID+".queue"] = queue
+		locations[node.ID+".merge.queue"] = queue
+		for _, down := range node.Downstream {
+			locations[node.ID+".fanout."+down] = queue
+		}
+		if nodeCfg.DeadLetter != nil {
+			locations[node.ID+".deadletter"] = *nodeCfg.DeadLetter
+		}
+	}
+	return locations
+}
+
+// Describe returns every part of the reservoir in flow order with how they
+// connect, their plugin locations, running state and stats
+func (o *Reservoir) Describe() []sta.Component {
+	l := o.links()
+	locations := o.locations()
+	components := make([]sta.Component, 0)
+	for _, m := range o.monitored() {
+		stats, updated := o.stats(m)
+		c := sta.Component{
+			ID:         m.id,
+			Kind:       m.kind,
+			Name:       m.name,
+			Location:   locations[m.id].Location,
+			Config:     configJSON(locations[m.id].Config),
+			Upstream:   ids(l.upstream, m.id),
+			Downstream: ids(l.downstream, m.id),
+			Running:    m.running(),
+			Updated:    updated,
+			Stats:      m.normalized(stats),
+		}
+		c.Supervisor = m.supervisor.Stats()
+		c.Supervisor.ID = m.id
+		if m.delivery != nil {
+			delivery := m.delivery.Stats()
+			c.Delivery = &delivery
+		}
+		if m.queueItem != nil {
+			length := m.queueItem.Queue.Len()
+			capacity := m.queueItem.Queue.Cap()
+			c.Len = &length
+			c.Cap = &capacity
+			counters := m.queueItem.Counters()
+			c.Counters = &counters
+			if m.queueItem.latency != nil {
+				latency := m.queueItem.latency.latency()
+				c.Latency = &latency
+			}
+		}
+		components = append(components, c)
+	}
+	return components
+}
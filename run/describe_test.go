@@ -0,0 +1,84 @@
+package run
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+func TestReservoirDescribe(t *testing.T) {
+	queue := cfg.QueueItemCfg{Location: "fifo.so", Config: "queue"}
+	config := cfg.ReservoirCfg{
+		Name: "describe",
+		Graph: &cfg.GraphCfg{
+			Nodes: []cfg.NodeCfg{
+				{ID: "a", Kind: cfg.KindIngester, Location: "in.so", Config: "1", QueueItem: queue},
+				{ID: "b", Kind: cfg.KindIngester, Location: "in.so", Config: "2", QueueItem: queue},
+				{ID: "join", Kind: cfg.KindDigester, QueueItem: queue, DeadLetter: &cfg.QueueItemCfg{Config: "dead"}},
+				{ID: "x", Kind: cfg.KindExpeller},
+				{ID: "y", Kind: cfg.KindExpeller},
+			},
+			Edges: []cfg.EdgeCfg{
+				{From: "a", To: "join"},
+				{From: "b", To: "join"},
+				{From: "join", To: "x"},
+				{From: "join", To: "y"},
+			},
+		},
+	}
+	reservoir, _, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	components := make(map[string]int)
+	described := reservoir.Describe()
+	for c := range described {
+		components[described[c].ID] = c
+	}
+	tests := map[string][2][]string{
+		"a":                {{}, {"a.queue"}},
+		"a.queue":          {{"a"}, {"join.merge"}},
+		"join.merge":       {{"a.queue", "b.queue"}, {"join.merge.queue"}},
+		"join.merge.queue": {{"join.merge"}, {"join"}},
+		"join":             {{"join.merge.queue"}, {"join.queue", "join.deadletter"}},
+		"join.queue":       {{"join"}, {"join.fanout"}},
+		"join.fanout":      {{"join.queue"}, {"join.fanout.x", "join.fanout.y"}},
+		"join.fanout.y":    {{"join.fanout"}, {"y"}},
+		"join.deadletter":  {{"join"}, {}},
+		"y":                {{"join.fanout.y"}, {}},
+	}
+	for id, expected := range tests {
+		c, ok := components[id]
+		if ok == false {
+			t.Errorf("%s: expecting component", id)
+			continue
+		}
+		component := described[c]
+		if reflect.DeepEqual(component.Upstream, expected[0]) == false || reflect.DeepEqual(component.Downstream, expected[1]) == false {
+			t.Errorf("%s: expecting %v -> %v, got %v -> %v", id, expected[0], expected[1], component.Upstream, component.Downstream)
+		}
+	}
+	a := described[components["a"]]
+	if a.Kind != cfg.KindIngester || a.Location != "in.so" || string(a.Config) != `"1"` || a.Len != nil {
+		t.Errorf("expecting ingester a from in.so, got %+v", a)
+	}
+	q := described[components["join.fanout.x"]]
+	if q.Kind != KindQueue || q.Location != "fifo.so" || q.Len == nil || *q.Len != 0 {
+		t.Errorf("expecting empty fifo.so queue, got %+v", q)
+	}
+}
+
+func TestDescribeConfigJSON(t *testing.T) {
+	for config, expected := range map[cfg.Config]string{
+		"":                                  "",
+		"/etc/reservoird/in.json":           `"/etc/reservoird/in.json"`,
+		`{"user":"me","password":"secret"}`: `{"password":"redacted","user":"redacted"}`,
+		`{"nested":{"token":"secret"}}`:     `{"nested":"redacted"}`,
+	} {
+		got := string(configJSON(config))
+		if got != expected {
+			t.Errorf("%s: expecting %s, got %s", config, expected, got)
+		}
+	}
+}
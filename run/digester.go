@@ -5,6 +5,7 @@ import (
 
 	"github.com/reservoird/icd"
 	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/cfg"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -14,6 +15,7 @@ type DigesterItem struct {
 	QueueItem      *QueueItem
 	Digester       icd.Digester
 	MonitorControl *icd.MonitorControl
+	Supervisor     *Supervisor
 	stats          interface{}
 }
 
@@ -25,11 +27,7 @@ func NewDigesterItem(
 	queueConfig string,
 	plugin proxy.Plugin,
 ) (*DigesterItem, error) {
-	plug, err := plugin.Open(loc)
-	if err != nil {
-		return nil, err
-	}
-	symbol, err := plug.Lookup("New")
+	symbol, err := lookupNew(loc, cfg.KindDigester, plugin)
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +35,11 @@ func NewDigesterItem(
 	if ok == false {
 		return nil, fmt.Errorf("error new digester function not found, expecting: New(string) (icd.Digester, error)")
 	}
-	digester, err := function(config)
+	var digester icd.Digester
+	err = callNew(loc, config, func(path string) error {
+		digester, err = function(path)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -47,6 +49,7 @@ func NewDigesterItem(
 		plugin,
 	)
 	if err != nil {
+		releaseComponent(digester)
 		return nil, err
 	}
 	o := new(DigesterItem)
@@ -59,6 +62,7 @@ func NewDigesterItem(
 		DoneChan:       make(chan struct{}, 1),
 		WaitGroup:      nil,
 	}
+	o.Supervisor = NewSupervisor(o.Digester.Name(), o.MonitorControl)
 	o.stats = nil
 	return o, nil
 }
@@ -5,6 +5,7 @@ import (
 
 	"github.com/reservoird/icd"
 	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/cfg"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -12,8 +13,8 @@ import (
 // ExpellerItem is what is needed to run an expeller
 type ExpellerItem struct {
 	Expeller       icd.Expeller
-	IngesterItems  []*IngesterItem
 	MonitorControl *icd.MonitorControl
+	Supervisor     *Supervisor
 	stats          interface{}
 }
 
@@ -21,14 +22,9 @@ type ExpellerItem struct {
 func NewExpellerItem(
 	loc string,
 	config string,
-	ingesters []*IngesterItem,
 	plugin proxy.Plugin,
 ) (*ExpellerItem, error) {
-	plug, err := plugin.Open(loc)
-	if err != nil {
-		return nil, err
-	}
-	symbol, err := plug.Lookup("New")
+	symbol, err := lookupNew(loc, cfg.KindExpeller, plugin)
 	if err != nil {
 		return nil, err
 	}
@@ -36,13 +32,16 @@ func NewExpellerItem(
 	if ok == false {
 		return nil, fmt.Errorf("error new queue function not found, expecting: New(string) (icd.Expeller, error)")
 	}
-	expeller, err := function(config)
+	var expeller icd.Expeller
+	err = callNew(loc, config, func(path string) error {
+		expeller, err = function(path)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	o := new(ExpellerItem)
 	o.Expeller = expeller
-	o.IngesterItems = ingesters
 	o.MonitorControl = &icd.MonitorControl{
 		StatsChan:      make(chan interface{}, 1),
 		FinalStatsChan: make(chan interface{}, 1),
@@ -50,6 +49,7 @@ func NewExpellerItem(
 		DoneChan:       make(chan struct{}, 1),
 		WaitGroup:      nil,
 	}
+	o.Supervisor = NewSupervisor(o.Expeller.Name(), o.MonitorControl)
 	o.stats = nil
 	return o, nil
 }
@@ -0,0 +1,280 @@
+package run
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/cfg"
+)
+
+// fakeQueue is an unbounded in memory queue
+type fakeQueue struct {
+	name   string
+	items  []interface{}
+	closed bool
+	lock   sync.Mutex
+}
+
+func newFakeQueue(name string) *fakeQueue {
+	return &fakeQueue{name: name, items: make([]interface{}, 0)}
+}
+
+func (o *fakeQueue) Name() string { return o.name }
+
+func (o *fakeQueue) Put(item interface{}) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed == true {
+		return fmt.Errorf("closed")
+	}
+	o.items = append(o.items, item)
+	return nil
+}
+
+func (o *fakeQueue) Get() (interface{}, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.items) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	item := o.items[0]
+	o.items = o.items[1:]
+	return item, nil
+}
+
+func (o *fakeQueue) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.items)
+}
+
+func (o *fakeQueue) Cap() int { return -1 }
+
+func (o *fakeQueue) Clear() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.items = o.items[:0]
+}
+
+func (o *fakeQueue) Reset() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.closed = false
+}
+
+func (o *fakeQueue) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.closed = true
+	return nil
+}
+
+func (o *fakeQueue) Closed() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.closed
+}
+
+func (o *fakeQueue) Monitor(mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	<-mc.DoneChan
+	mc.FinalStatsChan <- o.name
+}
+
+// fakeIngester puts count items then waits to be stopped
+type fakeIngester struct {
+	count int
+}
+
+func (o *fakeIngester) Name() string  { return "fakeingester" }
+func (o *fakeIngester) Running() bool { return true }
+
+func (o *fakeIngester) Ingest(snd icd.Queue, mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	for i := 0; i < o.count; i++ {
+		snd.Put(i)
+	}
+	<-mc.DoneChan
+	mc.FinalStatsChan <- "fakeingester"
+}
+
+// fakeDigester forwards items until stopped
+type fakeDigester struct{}
+
+func (o *fakeDigester) Name() string  { return "fakedigester" }
+func (o *fakeDigester) Running() bool { return true }
+
+func (o *fakeDigester) Digest(rcv icd.Queue, snd icd.Queue, mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	for {
+		select {
+		case <-mc.DoneChan:
+			mc.FinalStatsChan <- "fakedigester"
+			return
+		default:
+		}
+		item, err := rcv.Get()
+		if err == nil {
+			snd.Put(item)
+		}
+	}
+}
+
+// fakeFailDigester hands every odd item to Fail and forwards the rest
+type fakeFailDigester struct{}
+
+func (o *fakeFailDigester) Name() string  { return "fakefaildigester" }
+func (o *fakeFailDigester) Running() bool { return true }
+
+func (o *fakeFailDigester) Digest(rcv icd.Queue, snd icd.Queue, mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	for {
+		select {
+		case <-mc.DoneChan:
+			mc.FinalStatsChan <- "fakefaildigester"
+			return
+		default:
+		}
+		item, err := rcv.Get()
+		if err == nil {
+			if item.(int)%2 == 1 {
+				Fail(mc, item, fmt.Errorf("odd"))
+			} else {
+				snd.Put(item)
+			}
+		}
+	}
+}
+
+// fakeExpeller collects items until stopped
+type fakeExpeller struct {
+	items []interface{}
+	lock  sync.Mutex
+}
+
+func (o *fakeExpeller) Name() string  { return "fakeexpeller" }
+func (o *fakeExpeller) Running() bool { return true }
+
+func (o *fakeExpeller) Expel(rcv []icd.Queue, mc *icd.MonitorControl) {
+	defer mc.WaitGroup.Done()
+	for {
+		select {
+		case <-mc.DoneChan:
+			mc.FinalStatsChan <- "fakeexpeller"
+			return
+		default:
+		}
+		for r := range rcv {
+			item, err := rcv[r].Get()
+			if err == nil {
+				o.lock.Lock()
+				o.items = append(o.items, item)
+				o.lock.Unlock()
+			}
+		}
+	}
+}
+
+func (o *fakeExpeller) Len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.items)
+}
+
+func newFakeMonitorControl() *icd.MonitorControl {
+	return &icd.MonitorControl{
+		StatsChan:      make(chan interface{}, 1),
+		FinalStatsChan: make(chan interface{}, 1),
+		ClearChan:      make(chan struct{}, 1),
+		DoneChan:       make(chan struct{}, 1),
+	}
+}
+
+func newFakeQueueItem(name string) *QueueItem {
+	o := &QueueItem{
+		Queue:          newFakeQueue(name),
+		MonitorControl: newFakeMonitorControl(),
+	}
+	o.Supervisor = NewSupervisor(name, o.MonitorControl)
+	return o
+}
+
+// fakeBuilder creates fake nodes, the config of an ingester is the number of
+// items it puts, a digester configured with fail fails odd items and the
+// config of a queue is its name
+type fakeBuilder struct {
+	expellers map[string]*fakeExpeller
+}
+
+func (o *fakeBuilder) newNode(config cfg.NodeCfg) (*Node, error) {
+	node := &Node{
+		ID:            config.ID,
+		Kind:          config.Kind,
+		RcvQueueItems: make([]*QueueItem, 0),
+	}
+	switch config.Kind {
+	case cfg.KindIngester:
+		count, err := strconv.Atoi(string(config.Config))
+		if err != nil {
+			return nil, err
+		}
+		node.IngesterItem = &IngesterItem{
+			QueueItem:      newFakeQueueItem(string(config.QueueItem.Config)),
+			Ingester:       &fakeIngester{count: count},
+			MonitorControl: newFakeMonitorControl(),
+		}
+		node.IngesterItem.Supervisor = NewSupervisor(config.ID, node.IngesterItem.MonitorControl)
+	case cfg.KindDigester:
+		var digester icd.Digester = &fakeDigester{}
+		if config.Config == "fail" {
+			digester = &fakeFailDigester{}
+		}
+		node.DigesterItem = &DigesterItem{
+			QueueItem:      newFakeQueueItem(string(config.QueueItem.Config)),
+			Digester:       digester,
+			MonitorControl: newFakeMonitorControl(),
+		}
+		node.DigesterItem.Supervisor = NewSupervisor(config.ID, node.DigesterItem.MonitorControl)
+	case cfg.KindExpeller:
+		fake := &fakeExpeller{items: make([]interface{}, 0)}
+		o.expellers[config.ID] = fake
+		node.ExpellerItem = &ExpellerItem{
+			Expeller:       fake,
+			MonitorControl: newFakeMonitorControl(),
+		}
+		node.ExpellerItem.Supervisor = NewSupervisor(config.ID, node.ExpellerItem.MonitorControl)
+	}
+	policy, err := NewRestartPolicy(config.Restart)
+	if err != nil {
+		return nil, err
+	}
+	node.supervisor().Policy = policy
+	return node, nil
+}
+
+func (o *fakeBuilder) newQueueItem(config cfg.QueueItemCfg) (*QueueItem, error) {
+	return newFakeQueueItem(string(config.Config)), nil
+}
+
+// newFakeReservoir builds a reservoir from fakes instead of plugins
+func newFakeReservoir(config cfg.ReservoirCfg) (*Reservoir, map[string]*fakeExpeller, error) {
+	builder := &fakeBuilder{
+		expellers: make(map[string]*fakeExpeller),
+	}
+	reservoir, err := newReservoir(config, builder.newNode, builder.newQueueItem)
+	return reservoir, builder.expellers, err
+}
+
+// fakeChain returns an ingester putting count items through one digester
+func fakeChain(name string, count int) cfg.IngesterItemCfg {
+	return cfg.IngesterItemCfg{
+		Name:      name,
+		Config:    cfg.Config(strconv.Itoa(count)),
+		QueueItem: cfg.QueueItemCfg{Config: "ingestqueue"},
+		Digesters: []cfg.DigesterItemCfg{
+			{QueueItem: cfg.QueueItemCfg{Config: "digestqueue"}},
+		},
+	}
+}
@@ -0,0 +1,138 @@
+package run
+
+import (
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/env"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FanOutName is the name reported for fan-out stages
+const FanOutName = "com.github.reservoird.reservoird.fanout"
+
+const fanOutInterval = time.Millisecond
+
+// StageStats contains the stats of a host stage such as fan-out or merge
+type StageStats struct {
+	Name             string `json:"name"`
+	MessagesReceived uint64 `json:"messagesReceived"`
+	MessagesSent     uint64 `json:"messagesSent"`
+	Running          bool   `json:"running"`
+}
+
+// FanOutItem copies every message received from one queue into several
+// queues, one per downstream node. Envelopes are cloned per downstream node
+// and only sent to the nodes of their route header, copies of envelopes
+// awaiting acknowledgement are all awaited.
+type FanOutItem struct {
+	RcvQueueItem   *QueueItem
+	SndQueueItems  []*QueueItem
+	Downstream     []string
+	MonitorControl *icd.MonitorControl
+	Supervisor     *Supervisor
+	stats          interface{}
+}
+
+// NewFanOutItem creates a new fan-out stage
+func NewFanOutItem(
+	rcv *QueueItem,
+	snds []*QueueItem,
+	downstream []string,
+) *FanOutItem {
+	o := new(FanOutItem)
+	o.RcvQueueItem = rcv
+	o.SndQueueItems = snds
+	o.Downstream = downstream
+	o.MonitorControl = &icd.MonitorControl{
+		StatsChan:      make(chan interface{}, 1),
+		FinalStatsChan: make(chan interface{}, 1),
+		ClearChan:      make(chan struct{}, 1),
+		DoneChan:       make(chan struct{}, 1),
+		WaitGroup:      nil,
+	}
+	o.Supervisor = NewSupervisor(o.Name(), o.MonitorControl)
+	o.stats = nil
+	return o
+}
+
+// Name returns the name of the fan-out stage
+func (o *FanOutItem) Name() string {
+	return FanOutName
+}
+
+// routes returns the queues of the downstream nodes an envelope is routed to
+func (o *FanOutItem) routes(e *env.Envelope) []*QueueItem {
+	snds := make([]*QueueItem, 0, len(o.SndQueueItems))
+	for s := range o.SndQueueItems {
+		if e.Routed(o.Downstream[s]) == true {
+			snds = append(snds, o.SndQueueItems[s])
+		}
+	}
+	return snds
+}
+
+// FanOut copies messages until told to stop
+func (o *FanOutItem) FanOut() {
+	log.WithFields(log.Fields{
+		"name": o.Name(),
+		"func": "FanOutItem.FanOut(...)",
+	}).Debug("=== into ===")
+	defer o.MonitorControl.WaitGroup.Done()
+
+	stats := StageStats{
+		Name:    o.Name(),
+		Running: true,
+	}
+	run := true
+	for run == true {
+		item, err := o.RcvQueueItem.Queue.Get()
+		if err == nil {
+			stats.MessagesReceived = stats.MessagesReceived + 1
+			snds := o.SndQueueItems
+			e, ok := env.From(item)
+			if ok == true {
+				snds = o.routes(e)
+				copied(e, len(snds))
+			}
+			for s := range snds {
+				out := item
+				if ok == true {
+					out = e.Clone()
+				}
+				perr := snds[s].Queue.Put(out)
+				if perr == nil {
+					stats.MessagesSent = stats.MessagesSent + 1
+				}
+			}
+		}
+
+		select {
+		case <-o.MonitorControl.ClearChan:
+			stats = StageStats{
+				Name:    o.Name(),
+				Running: true,
+			}
+		default:
+		}
+
+		select {
+		case <-o.MonitorControl.DoneChan:
+			run = false
+		case o.MonitorControl.StatsChan <- stats:
+		default:
+		}
+
+		if err != nil && run == true {
+			time.Sleep(fanOutInterval)
+		}
+	}
+
+	stats.Running = false
+	o.MonitorControl.FinalStatsChan <- stats
+	log.WithFields(log.Fields{
+		"name": o.Name(),
+		"func": "FanOutItem.FanOut(...)",
+	}).Debug("=== outof ===")
+}
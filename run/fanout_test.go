@@ -0,0 +1,42 @@
+package run
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/env"
+)
+
+func TestFanOutRoutes(t *testing.T) {
+	rcv := newFakeQueueItem("rcv")
+	a := newFakeQueueItem("a")
+	b := newFakeQueueItem("b")
+	fanOut := NewFanOutItem(rcv, []*QueueItem{a, b}, []string{"a", "b"})
+	fanOut.MonitorControl.WaitGroup = &sync.WaitGroup{}
+
+	routed := env.New("routed")
+	routed.Set(env.HeaderRoute, "b")
+	everywhere := env.New("everywhere")
+	rcv.Queue.Put(routed)
+	rcv.Queue.Put(everywhere)
+	rcv.Queue.Put("bare")
+
+	fanOut.MonitorControl.WaitGroup.Add(1)
+	go fanOut.FanOut()
+	for i := 0; i < 100 && (a.Queue.Len() < 2 || b.Queue.Len() < 3); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fanOut.MonitorControl.DoneChan <- struct{}{}
+	fanOut.MonitorControl.WaitGroup.Wait()
+
+	if a.Queue.Len() != 2 || b.Queue.Len() != 3 {
+		t.Fatalf("expecting 2 messages to a and 3 to b, got %d and %d", a.Queue.Len(), b.Queue.Len())
+	}
+	first, _ := a.Queue.Get()
+	b.Queue.Get()
+	second, _ := b.Queue.Get()
+	if first == everywhere || second == everywhere || first.(*env.Envelope).ID != everywhere.ID {
+		t.Errorf("expecting a clone of the envelope per downstream node")
+	}
+}
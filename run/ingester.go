@@ -5,6 +5,7 @@ import (
 
 	"github.com/reservoird/icd"
 	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/cfg"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,8 +14,8 @@ import (
 type IngesterItem struct {
 	QueueItem      *QueueItem
 	Ingester       icd.Ingester
-	DigesterItems  []*DigesterItem
 	MonitorControl *icd.MonitorControl
+	Supervisor     *Supervisor
 	stats          interface{}
 }
 
@@ -24,14 +25,9 @@ func NewIngesterItem(
 	config string,
 	queueLoc string,
 	queueConfig string,
-	digesters []*DigesterItem,
 	plugin proxy.Plugin,
 ) (*IngesterItem, error) {
-	plug, err := plugin.Open(loc)
-	if err != nil {
-		return nil, err
-	}
-	symbol, err := plug.Lookup("New")
+	symbol, err := lookupNew(loc, cfg.KindIngester, plugin)
 	if err != nil {
 		return nil, err
 	}
@@ -39,7 +35,11 @@ func NewIngesterItem(
 	if ok == false {
 		return nil, fmt.Errorf("error new ingester function not found, expecting: New(string) (icd.Ingester, error)")
 	}
-	ingester, err := function(config)
+	var ingester icd.Ingester
+	err = callNew(loc, config, func(path string) error {
+		ingester, err = function(path)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -49,12 +49,12 @@ func NewIngesterItem(
 		plugin,
 	)
 	if err != nil {
+		releaseComponent(ingester)
 		return nil, err
 	}
 	o := new(IngesterItem)
 	o.Ingester = ingester
 	o.QueueItem = queueItem
-	o.DigesterItems = digesters
 	o.MonitorControl = &icd.MonitorControl{
 		StatsChan:      make(chan interface{}, 1),
 		FinalStatsChan: make(chan interface{}, 1),
@@ -62,6 +62,7 @@ func NewIngesterItem(
 		DoneChan:       make(chan struct{}, 1),
 		WaitGroup:      nil,
 	}
+	o.Supervisor = NewSupervisor(o.Ingester.Name(), o.MonitorControl)
 	o.stats = nil
 	return o, nil
 }
@@ -0,0 +1,111 @@
+package run
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/env"
+	"github.com/reservoird/reservoird/sta"
+)
+
+// instrumentedQueue counts what passes through a queue regardless of the
+// plugin behind it
+type instrumentedQueue struct {
+	icd.Queue
+	puts          uint64
+	putFailures   uint64
+	gets          uint64
+	getFailures   uint64
+	bytesPut      uint64
+	bytesGot      uint64
+	putBlocked    int64
+	maxPutBlocked int64
+	getWait       int64
+	maxGetWait    int64
+	lastActivity  int64
+}
+
+// newInstrumentedQueue wraps a queue to count its use
+func newInstrumentedQueue(queue icd.Queue) *instrumentedQueue {
+	o := new(instrumentedQueue)
+	o.Queue = queue
+	return o
+}
+
+// size returns the bytes of a message, only byte slices are counted, as is
+// or as the payload of an envelope
+func size(item interface{}) uint64 {
+	b, ok := env.Payload(item).([]byte)
+	if ok == false {
+		return 0
+	}
+	return uint64(len(b))
+}
+
+// storeMax raises max to value
+func storeMax(max *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(max)
+		if value <= current || atomic.CompareAndSwapInt64(max, current, value) == true {
+			return
+		}
+	}
+}
+
+// Put puts into the wrapped queue counting the call and how long it blocked
+func (o *instrumentedQueue) Put(item interface{}) error {
+	start := time.Now()
+	err := o.Queue.Put(item)
+	end := time.Now()
+	blocked := int64(end.Sub(start))
+	atomic.AddInt64(&o.putBlocked, blocked)
+	storeMax(&o.maxPutBlocked, blocked)
+	if err != nil {
+		atomic.AddUint64(&o.putFailures, 1)
+		return err
+	}
+	atomic.AddUint64(&o.puts, 1)
+	atomic.AddUint64(&o.bytesPut, size(item))
+	atomic.StoreInt64(&o.lastActivity, end.UnixNano())
+	return nil
+}
+
+// Get gets from the wrapped queue counting the call and how long it waited
+func (o *instrumentedQueue) Get() (interface{}, error) {
+	start := time.Now()
+	item, err := o.Queue.Get()
+	end := time.Now()
+	wait := int64(end.Sub(start))
+	atomic.AddInt64(&o.getWait, wait)
+	storeMax(&o.maxGetWait, wait)
+	if err != nil {
+		atomic.AddUint64(&o.getFailures, 1)
+		return item, err
+	}
+	atomic.AddUint64(&o.gets, 1)
+	atomic.AddUint64(&o.bytesGot, size(item))
+	atomic.StoreInt64(&o.lastActivity, end.UnixNano())
+	return item, nil
+}
+
+// counters returns what has been counted so far
+func (o *instrumentedQueue) counters() sta.QueueCounters {
+	counters := sta.QueueCounters{
+		Puts:          atomic.LoadUint64(&o.puts),
+		PutFailures:   atomic.LoadUint64(&o.putFailures),
+		Gets:          atomic.LoadUint64(&o.gets),
+		GetFailures:   atomic.LoadUint64(&o.getFailures),
+		BytesPut:      atomic.LoadUint64(&o.bytesPut),
+		BytesGot:      atomic.LoadUint64(&o.bytesGot),
+		PutBlocked:    time.Duration(atomic.LoadInt64(&o.putBlocked)),
+		MaxPutBlocked: time.Duration(atomic.LoadInt64(&o.maxPutBlocked)),
+		GetWait:       time.Duration(atomic.LoadInt64(&o.getWait)),
+		MaxGetWait:    time.Duration(atomic.LoadInt64(&o.maxGetWait)),
+	}
+	last := atomic.LoadInt64(&o.lastActivity)
+	if last != 0 {
+		counters.LastActivity = time.Unix(0, last)
+	}
+	return counters
+}
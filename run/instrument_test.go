@@ -0,0 +1,61 @@
+package run
+
+import (
+	"testing"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+func TestInstrumentedQueue(t *testing.T) {
+	queue := newInstrumentedQueue(newFakeQueue("counted"))
+	queue.Put([]byte("hello"))
+	queue.Put("not bytes")
+	queue.Get()
+	queue.Get()
+	queue.Get()
+	queue.Close()
+	queue.Put([]byte("closed"))
+
+	c := queue.counters()
+	if c.Puts != 2 || c.PutFailures != 1 || c.Gets != 2 || c.GetFailures != 1 {
+		t.Errorf("expecting 2 puts 1 failure 2 gets 1 failure, got %+v", c)
+	}
+	if c.BytesPut != 5 || c.BytesGot != 5 {
+		t.Errorf("expecting 5 bytes each way, got %d put %d got", c.BytesPut, c.BytesGot)
+	}
+	if c.PutBlocked < c.MaxPutBlocked || c.GetWait < c.MaxGetWait || c.LastActivity.IsZero() == true {
+		t.Errorf("expecting totals above maximums and last activity, got %+v", c)
+	}
+}
+
+func TestReservoirCounters(t *testing.T) {
+	config := cfg.ReservoirCfg{
+		Name:          "counted",
+		IngesterItems: []cfg.IngesterItemCfg{fakeChain("", 0)},
+		ExpellerItems: []cfg.ExpellerItemCfg{{}},
+	}
+	reservoir, _, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	err = reservoir.Nodes[0].QueueItem().Inject([]byte("abc"))
+	if err != nil {
+		t.Fatalf("error injecting: %v", err)
+	}
+	counters := reservoir.GetCounters()
+	if len(counters) != 2 || counters[0].ID != "ingester0.queue" {
+		t.Fatalf("expecting counters for both queues, got %+v", counters)
+	}
+	if counters[0].Puts != 1 || counters[0].BytesPut != 3 {
+		t.Errorf("expecting the injected message counted, got %+v", counters[0])
+	}
+	queues := reservoir.GetQueues()
+	if queues[0].Counters.Puts != 1 {
+		t.Errorf("expecting queue stats to carry counters, got %+v", queues[0])
+	}
+	for _, m := range reservoir.monitored() {
+		if m.id == "ingester0.queue" && m.normalized(*m.stats).BytesReceived != 3 {
+			t.Errorf("expecting normalized stats to fall back on counters, got %+v", m.normalized(*m.stats))
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package run
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/env"
+	"github.com/reservoird/reservoird/sta"
+)
+
+// latency buckets split every power of two nanoseconds in four, keeping
+// quantiles within 25% of the measured value
+const (
+	latencySubBits    = 2
+	latencySubBuckets = 1 << latencySubBits
+	latencyBuckets    = (64 - latencySubBits + 1) * latencySubBuckets
+)
+
+// latencyBucket returns the bucket of a duration
+func latencyBucket(d time.Duration) int {
+	if d < latencySubBuckets {
+		if d < 0 {
+			return 0
+		}
+		return int(d)
+	}
+	n := uint64(d)
+	shift := uint(bits.Len64(n) - 1 - latencySubBits)
+	return int(shift+1)*latencySubBuckets + int((n>>shift)&(latencySubBuckets-1))
+}
+
+// latencyUpper returns the largest duration falling in a bucket
+func latencyUpper(bucket int) time.Duration {
+	if bucket < latencySubBuckets {
+		return time.Duration(bucket)
+	}
+	shift := uint(bucket/latencySubBuckets - 1)
+	sub := uint64(bucket%latencySubBuckets + latencySubBuckets)
+	return time.Duration((sub+1)<<shift - 1)
+}
+
+// latencyHistogram counts durations in logarithmic buckets
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+	lock   sync.Mutex
+}
+
+// observe adds a duration
+func (o *latencyHistogram) observe(d time.Duration) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.counts[latencyBucket(d)]++
+	o.count++
+	o.sum = o.sum + d
+	if d > o.max {
+		o.max = d
+	}
+}
+
+// quantile returns the upper bound of the bucket holding the quantile,
+// capped at the maximum, the lock must be held
+func (o *latencyHistogram) quantile(q float64) time.Duration {
+	rank := uint64(q*float64(o.count) + 0.5)
+	if rank == 0 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for b := range o.counts {
+		seen = seen + o.counts[b]
+		if seen >= rank {
+			upper := latencyUpper(b)
+			if upper > o.max {
+				return o.max
+			}
+			return upper
+		}
+	}
+	return o.max
+}
+
+// latency summarizes the histogram
+func (o *latencyHistogram) latency() sta.Latency {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.count == 0 {
+		return sta.Latency{}
+	}
+	return sta.Latency{
+		Count: o.count,
+		Sum:   o.sum,
+		P50:   o.quantile(0.50),
+		P90:   o.quantile(0.90),
+		P99:   o.quantile(0.99),
+		Max:   o.max,
+	}
+}
+
+// carrier carries the ingest time of the last message a stage got to what
+// it puts next, which holds for stages emitting one message per message.
+// Envelopes do not need carrying.
+type carrier struct {
+	ingested int64
+}
+
+// store keeps the ingest time of a message got
+func (o *carrier) store(ingested time.Time) {
+	atomic.StoreInt64(&o.ingested, ingested.UnixNano())
+}
+
+// load returns the ingest time of the last message got, now when none
+func (o *carrier) load(now time.Time) time.Time {
+	ingested := atomic.LoadInt64(&o.ingested)
+	if ingested == 0 {
+		return now
+	}
+	return time.Unix(0, ingested)
+}
+
+// stamp is when a message was ingested and put into a queue
+type stamp struct {
+	ingested time.Time
+	put      time.Time
+}
+
+// latencyQueue keeps a side first in first out list of stamps alongside a
+// queue. Messages are stamped as ingested when put by an ingester, later
+// queues take the ingest time from the stage putting into them. Measures
+// are approximate for queues not delivering in order.
+type latencyQueue struct {
+	icd.Queue
+	producer *carrier
+	consumer *carrier
+	endToEnd *latencyHistogram
+	hop      *latencyHistogram
+	age      *latencyHistogram
+	stamps   []stamp
+	lock     sync.Mutex
+}
+
+// newLatencyQueue wraps a queue to measure latency
+func newLatencyQueue(queue icd.Queue) *latencyQueue {
+	o := new(latencyQueue)
+	o.Queue = queue
+	o.hop = new(latencyHistogram)
+	o.age = new(latencyHistogram)
+	o.stamps = make([]stamp, 0)
+	return o
+}
+
+// Put puts into the wrapped queue stamping the message. Envelopes put by
+// ingesters are stamped and carry their own ingest time.
+func (o *latencyQueue) Put(item interface{}) error {
+	ingested := time.Time{}
+	e, ok := env.From(item)
+	if ok == true {
+		if o.producer == nil {
+			e.Stamp(time.Now())
+		}
+		ingested = e.Ingested
+	}
+	err := o.Queue.Put(item)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s := stamp{ingested: now, put: now}
+	if ingested.IsZero() == false {
+		s.ingested = ingested
+	} else if o.producer != nil {
+		s.ingested = o.producer.load(now)
+	}
+	o.lock.Lock()
+	o.stamps = append(o.stamps, s)
+	o.lock.Unlock()
+	return nil
+}
+
+// Get gets from the wrapped queue measuring the time spent in the queue and
+// since ingest
+func (o *latencyQueue) Get() (interface{}, error) {
+	item, err := o.Queue.Get()
+	if err != nil {
+		return item, err
+	}
+	now := time.Now()
+	o.lock.Lock()
+	if len(o.stamps) == 0 {
+		o.lock.Unlock()
+		return item, nil
+	}
+	s := o.stamps[0]
+	o.stamps = o.stamps[1:]
+	// resynchronize with queues that dropped or reordered messages
+	for len(o.stamps) > o.Queue.Len() {
+		o.stamps = o.stamps[1:]
+	}
+	o.lock.Unlock()
+
+	o.hop.observe(now.Sub(s.put))
+	o.age.observe(now.Sub(s.ingested))
+	if o.consumer != nil {
+		o.consumer.store(s.ingested)
+	}
+	if o.endToEnd != nil {
+		o.endToEnd.observe(now.Sub(s.ingested))
+	}
+	return item, nil
+}
+
+// Clear clears the wrapped queue and its stamps
+func (o *latencyQueue) Clear() {
+	o.Queue.Clear()
+	o.lock.Lock()
+	o.stamps = o.stamps[:0]
+	o.lock.Unlock()
+}
+
+// latency summarizes the latency measured at the queue
+func (o *latencyQueue) latency() sta.QueueLatency {
+	return sta.QueueLatency{
+		Hop: o.hop.latency(),
+		Age: o.age.latency(),
+	}
+}
+
+// track wraps the queues between components to measure latency. Each stage
+// carries the ingest time from the queues it gets from to the queues it puts
+// into, expellers measure the end-to-end latency.
+func (o *Reservoir) track() {
+	o.endToEnd = new(latencyHistogram)
+	for _, node := range o.Nodes {
+		var produced *carrier
+		if node.Kind != cfg.KindIngester {
+			consumed := new(carrier)
+			produced = consumed
+			rcvs := node.RcvQueueItems
+			if node.MergeItem != nil {
+				merge := new(carrier)
+				for _, rcv := range rcvs {
+					rcv.track().consumer = merge
+				}
+				snd := node.MergeItem.SndQueueItem.track()
+				snd.producer = merge
+				rcvs = []*QueueItem{node.MergeItem.SndQueueItem}
+			}
+			for _, rcv := range rcvs {
+				queue := rcv.track()
+				queue.consumer = consumed
+				if node.Kind == cfg.KindExpeller {
+					queue.endToEnd = o.endToEnd
+				}
+			}
+		}
+		if node.QueueItem() == nil {
+			continue
+		}
+		node.QueueItem().track().producer = produced
+		if node.FanOutItem != nil {
+			fanOut := new(carrier)
+			node.QueueItem().track().consumer = fanOut
+			for _, snd := range node.FanOutItem.SndQueueItems {
+				snd.track().producer = fanOut
+			}
+		}
+	}
+}
+
+// GetLatency returns the end-to-end latency and the latency at every queue
+// between components in flow order
+func (o *Reservoir) GetLatency() sta.ReservoirLatency {
+	latency := sta.ReservoirLatency{
+		Name:   o.Name,
+		Queues: make([]sta.QueueLatency, 0),
+	}
+	if o.endToEnd != nil {
+		latency.EndToEnd = o.endToEnd.latency()
+	}
+	for _, m := range o.queues() {
+		if m.queueItem.latency == nil {
+			continue
+		}
+		q := m.queueItem.latency.latency()
+		q.ID = m.id
+		latency.Queues = append(latency.Queues, q)
+	}
+	return latency
+}
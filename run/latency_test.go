@@ -0,0 +1,110 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/env"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	durations := []time.Duration{0, 3, 4, 7, 63, 64, time.Millisecond, time.Hour}
+	for _, d := range durations {
+		b := latencyBucket(d)
+		if latencyUpper(b) < d || (b > 0 && latencyUpper(b-1) >= d) {
+			t.Errorf("%v: expecting bucket %d to be the first holding it", d, b)
+		}
+	}
+	if latencyBucket(time.Duration(1<<63-1)) >= latencyBuckets {
+		t.Errorf("expecting the largest duration within the buckets")
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	histogram := new(latencyHistogram)
+	if histogram.latency().Count != 0 {
+		t.Errorf("expecting empty latency")
+	}
+	for i := 1; i <= 100; i++ {
+		histogram.observe(time.Duration(i) * time.Millisecond)
+	}
+	l := histogram.latency()
+	if l.Count != 100 || l.Sum != 5050*time.Millisecond || l.Max != 100*time.Millisecond {
+		t.Errorf("expecting 100 measures summing 5.05s up to 100ms, got %+v", l)
+	}
+	within := func(got time.Duration, want time.Duration) bool {
+		return got >= want && got <= want*5/4
+	}
+	if within(l.P50, 50*time.Millisecond) == false ||
+		within(l.P90, 90*time.Millisecond) == false ||
+		within(l.P99, 99*time.Millisecond) == false {
+		t.Errorf("expecting quantiles within 25%%, got %+v", l)
+	}
+}
+
+func TestReservoirLatency(t *testing.T) {
+	config := cfg.ReservoirCfg{
+		Name:          "latency",
+		IngesterItems: []cfg.IngesterItemCfg{fakeChain("", 20)},
+		ExpellerItems: []cfg.ExpellerItemCfg{{}},
+	}
+	reservoir, expellers, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	reservoirMap, _ := NewReservoirMap(cfg.Cfg{}, nil)
+	reservoirMap.Map[reservoir.Name] = reservoir
+	reservoirMap.Disposed[reservoir.Name] = false
+	reservoirMap.Stopped[reservoir.Name] = true
+
+	err = reservoirMap.Start("latency")
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	for i := 0; i < 100 && expellers["expeller0"].Len() < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	reservoir.Drain(5 * time.Second)
+	reservoir.UpdateFinal()
+	reservoir.Wait()
+
+	latency, err := reservoirMap.GetLatency("latency")
+	if err != nil {
+		t.Fatalf("error getting latency: %v", err)
+	}
+	if latency.EndToEnd.Count != 20 {
+		t.Errorf("expecting 20 messages measured end to end, got %+v", latency.EndToEnd)
+	}
+	if len(latency.Queues) != 2 || latency.Queues[1].ID != "ingester0.digester0.queue" {
+		t.Fatalf("expecting latency at both queues, got %+v", latency.Queues)
+	}
+	last := latency.Queues[1]
+	if last.Hop.Count != 20 || last.Age.Max < last.Hop.Max || last.Age.Max != latency.EndToEnd.Max {
+		t.Errorf("expecting age since ingest at the last queue to be end to end, got %+v", last)
+	}
+
+	_, err = reservoirMap.GetLatency("missing")
+	if err == nil {
+		t.Errorf("expecting an error for a missing reservoir")
+	}
+}
+
+func TestLatencyQueueEnvelope(t *testing.T) {
+	ingester := newLatencyQueue(newFakeQueue("ingested"))
+	e := &env.Envelope{Payload: 1}
+	ingester.Put(e)
+	if e.ID == "" || e.Ingested.IsZero() == true {
+		t.Errorf("expecting envelopes stamped when put by ingesters, got %+v", e)
+	}
+
+	digested := newLatencyQueue(newFakeQueue("digested"))
+	digested.producer = new(carrier)
+	old := &env.Envelope{Payload: 2, Ingested: time.Now().Add(-time.Hour)}
+	digested.Put(old)
+	digested.Get()
+	l := digested.latency()
+	if old.ID != "" || l.Age.Max < time.Hour || l.Hop.Max >= time.Hour {
+		t.Errorf("expecting the age from the envelope ingest time, got %+v", l)
+	}
+}
@@ -0,0 +1,110 @@
+package run
+
+import (
+	"time"
+
+	"github.com/reservoird/icd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MergeName is the name reported for merge stages
+const MergeName = "com.github.reservoird.reservoird.merge"
+
+const mergeInterval = time.Millisecond
+
+// MergeItem moves messages from several queues into one queue so a
+// digester can receive from more than one upstream node
+type MergeItem struct {
+	RcvQueueItems  []*QueueItem
+	SndQueueItem   *QueueItem
+	MonitorControl *icd.MonitorControl
+	Supervisor     *Supervisor
+	stats          interface{}
+}
+
+// NewMergeItem creates a new merge stage
+func NewMergeItem(
+	rcvs []*QueueItem,
+	snd *QueueItem,
+) *MergeItem {
+	o := new(MergeItem)
+	o.RcvQueueItems = rcvs
+	o.SndQueueItem = snd
+	o.MonitorControl = &icd.MonitorControl{
+		StatsChan:      make(chan interface{}, 1),
+		FinalStatsChan: make(chan interface{}, 1),
+		ClearChan:      make(chan struct{}, 1),
+		DoneChan:       make(chan struct{}, 1),
+		WaitGroup:      nil,
+	}
+	o.Supervisor = NewSupervisor(o.Name(), o.MonitorControl)
+	o.stats = nil
+	return o
+}
+
+// Name returns the name of the merge stage
+func (o *MergeItem) Name() string {
+	return MergeName
+}
+
+// Merge moves messages until told to stop, taking turns between queues
+func (o *MergeItem) Merge() {
+	log.WithFields(log.Fields{
+		"name": o.Name(),
+		"func": "MergeItem.Merge(...)",
+	}).Debug("=== into ===")
+	defer o.MonitorControl.WaitGroup.Done()
+
+	stats := StageStats{
+		Name:    o.Name(),
+		Running: true,
+	}
+	run := true
+	for run == true {
+		idle := true
+		for r := range o.RcvQueueItems {
+			// only get when items are waiting so a blocking queue cannot
+			// starve the others
+			if o.RcvQueueItems[r].Queue.Len() == 0 {
+				continue
+			}
+			item, err := o.RcvQueueItems[r].Queue.Get()
+			if err == nil {
+				idle = false
+				stats.MessagesReceived = stats.MessagesReceived + 1
+				err = o.SndQueueItem.Queue.Put(item)
+				if err == nil {
+					stats.MessagesSent = stats.MessagesSent + 1
+				}
+			}
+		}
+
+		select {
+		case <-o.MonitorControl.ClearChan:
+			stats = StageStats{
+				Name:    o.Name(),
+				Running: true,
+			}
+		default:
+		}
+
+		select {
+		case <-o.MonitorControl.DoneChan:
+			run = false
+		case o.MonitorControl.StatsChan <- stats:
+		default:
+		}
+
+		if idle == true && run == true {
+			time.Sleep(mergeInterval)
+		}
+	}
+
+	stats.Running = false
+	o.MonitorControl.FinalStatsChan <- stats
+	log.WithFields(log.Fields{
+		"name": o.Name(),
+		"func": "MergeItem.Merge(...)",
+	}).Debug("=== outof ===")
+}
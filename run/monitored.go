@@ -0,0 +1,110 @@
+package run
+
+import (
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/sta"
+)
+
+// monitored is anything within a reservoir that reports stats. Ids are the
+// node id for plugins with suffixes for the queues and stages around them.
+type monitored struct {
+	id         string
+	kind       string
+	name       string
+	mc         *icd.MonitorControl
+	stats      *interface{}
+	running    func() bool
+	supervisor *Supervisor
+	queueItem  *QueueItem
+	delivery   *DeliveryItem
+}
+
+// normalized returns the latest stats in the standard shape, queues
+// fall back on the host counters for what they do not report
+func (o monitored) normalized(latest interface{}) sta.Stats {
+	stats := sta.Normalize(o.name, o.kind, o.running(), latest)
+	if o.queueItem == nil {
+		return stats
+	}
+	counters := o.queueItem.Counters()
+	if stats.MessagesReceived == 0 {
+		stats.MessagesReceived = counters.Puts
+	}
+	if stats.MessagesSent == 0 {
+		stats.MessagesSent = counters.Gets
+	}
+	if stats.BytesReceived == 0 {
+		stats.BytesReceived = counters.BytesPut
+	}
+	if stats.BytesSent == 0 {
+		stats.BytesSent = counters.BytesGot
+	}
+	if stats.LastActivity.IsZero() == true {
+		stats.LastActivity = counters.LastActivity
+	}
+	return stats
+}
+
+// monitoredQueue returns a queue as something that reports stats
+func monitoredQueue(id string, queueItem *QueueItem) monitored {
+	return monitored{
+		id:    id,
+		kind:  KindQueue,
+		name:  queueItem.Queue.Name(),
+		mc:    queueItem.MonitorControl,
+		stats: &queueItem.stats,
+		running: func() bool {
+			return queueItem.Queue.Closed() == false
+		},
+		supervisor: queueItem.Supervisor,
+		queueItem:  queueItem,
+	}
+}
+
+// monitored returns what the node reports stats for in flow order
+func (o *Node) monitored() []monitored {
+	m := make([]monitored, 0)
+	if o.MergeItem != nil {
+		m = append(m, monitored{
+			id:         o.ID + ".merge",
+			kind:       KindMerge,
+			name:       o.MergeItem.Name(),
+			mc:         o.MergeItem.MonitorControl,
+			stats:      &o.MergeItem.stats,
+			running:    o.MergeItem.Supervisor.Running,
+			supervisor: o.MergeItem.Supervisor,
+		})
+		m = append(m, monitoredQueue(o.ID+".merge.queue", o.MergeItem.SndQueueItem))
+	}
+	m = append(m, monitored{
+		id:         o.ID,
+		kind:       o.Kind,
+		name:       o.Name(),
+		mc:         o.MonitorControl(),
+		stats:      o.stats(),
+		running:    o.running,
+		supervisor: o.supervisor(),
+		delivery:   o.DeliveryItem,
+	})
+	if o.QueueItem() != nil {
+		m = append(m, monitoredQueue(o.ID+".queue", o.QueueItem()))
+	}
+	if o.DeadLetterItem != nil {
+		m = append(m, monitoredQueue(o.ID+".deadletter", o.DeadLetterItem.QueueItem))
+	}
+	if o.FanOutItem != nil {
+		m = append(m, monitored{
+			id:         o.ID + ".fanout",
+			kind:       KindFanOut,
+			name:       o.FanOutItem.Name(),
+			mc:         o.FanOutItem.MonitorControl,
+			stats:      &o.FanOutItem.stats,
+			running:    o.FanOutItem.Supervisor.Running,
+			supervisor: o.FanOutItem.Supervisor,
+		})
+		for s := range o.FanOutItem.SndQueueItems {
+			m = append(m, monitoredQueue(o.ID+".fanout."+o.Downstream[s], o.FanOutItem.SndQueueItems[s]))
+		}
+	}
+	return m
+}
@@ -0,0 +1,269 @@
+package run
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/cfg"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of host stages and queues, plugins use the kinds in cfg
+const (
+	KindQueue  = "queue"
+	KindFanOut = "fanout"
+	KindMerge  = "merge"
+)
+
+// Node is one component of a reservoir graph. Exactly one of the ingester,
+// digester or expeller items is set depending on the kind. A node with more
+// than one downstream node has a fan-out stage, a digester with more than
+// one upstream node has a merge stage. Digesters and expellers may have a
+// dead-letter queue.
+type Node struct {
+	ID             string
+	Kind           string
+	IngesterItem   *IngesterItem
+	DigesterItem   *DigesterItem
+	ExpellerItem   *ExpellerItem
+	RcvQueueItems  []*QueueItem
+	MergeItem      *MergeItem
+	FanOutItem     *FanOutItem
+	DeadLetterItem *DeadLetterItem
+	DeliveryItem   *DeliveryItem
+	Upstream       []string
+	Downstream     []string
+}
+
+// NewNode creates the plugin items of a node, leaving it unconnected
+func NewNode(
+	config cfg.NodeCfg,
+	plugin proxy.Plugin,
+) (*Node, error) {
+	var err error
+	o := new(Node)
+	o.ID = config.ID
+	o.Kind = config.Kind
+	o.RcvQueueItems = make([]*QueueItem, 0)
+	switch config.Kind {
+	case cfg.KindIngester:
+		o.IngesterItem, err = NewIngesterItem(
+			config.Location,
+			string(config.Config),
+			config.QueueItem.Location,
+			string(config.QueueItem.Config),
+			plugin,
+		)
+	case cfg.KindDigester:
+		o.DigesterItem, err = NewDigesterItem(
+			config.Location,
+			string(config.Config),
+			config.QueueItem.Location,
+			string(config.QueueItem.Config),
+			plugin,
+		)
+	case cfg.KindExpeller:
+		o.ExpellerItem, err = NewExpellerItem(
+			config.Location,
+			string(config.Config),
+			plugin,
+		)
+	default:
+		err = fmt.Errorf("%s: unknown kind %s", config.ID, config.Kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy, err := NewRestartPolicy(config.Restart)
+	if err != nil {
+		o.release()
+		if o.QueueItem() != nil {
+			o.QueueItem().release()
+		}
+		return nil, fmt.Errorf("%s: %v", config.ID, err)
+	}
+	o.supervisor().Policy = policy
+	o.Upstream = make([]string, 0)
+	o.Downstream = make([]string, 0)
+	return o, nil
+}
+
+// Name returns the plugin name of the node
+func (o *Node) Name() string {
+	switch o.Kind {
+	case cfg.KindIngester:
+		return o.IngesterItem.Ingester.Name()
+	case cfg.KindDigester:
+		return o.DigesterItem.Digester.Name()
+	}
+	return o.ExpellerItem.Expeller.Name()
+}
+
+// release releases what the node plugin holds, such as the process of a
+// plugin executable
+func (o *Node) release() {
+	var component interface{}
+	switch o.Kind {
+	case cfg.KindIngester:
+		component = o.IngesterItem.Ingester
+	case cfg.KindDigester:
+		component = o.DigesterItem.Digester
+	default:
+		component = o.ExpellerItem.Expeller
+	}
+	err := releaseComponent(component)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"node": o.ID,
+			"err":  err,
+		}).Warn("releasing node")
+	}
+}
+
+// releaseComponent releases what a component holds, such as a plugin
+// process, when it holds anything
+func releaseComponent(component interface{}) error {
+	r, ok := component.(releaser)
+	if ok == false {
+		return nil
+	}
+	return r.Release()
+}
+
+// MonitorControl returns the monitor and control of the node plugin
+func (o *Node) MonitorControl() *icd.MonitorControl {
+	switch o.Kind {
+	case cfg.KindIngester:
+		return o.IngesterItem.MonitorControl
+	case cfg.KindDigester:
+		return o.DigesterItem.MonitorControl
+	}
+	return o.ExpellerItem.MonitorControl
+}
+
+// QueueItem returns the output queue of the node, nil for expellers
+func (o *Node) QueueItem() *QueueItem {
+	switch o.Kind {
+	case cfg.KindIngester:
+		return o.IngesterItem.QueueItem
+	case cfg.KindDigester:
+		return o.DigesterItem.QueueItem
+	}
+	return nil
+}
+
+// stats returns where the stats of the node plugin are kept
+func (o *Node) stats() *interface{} {
+	switch o.Kind {
+	case cfg.KindIngester:
+		return &o.IngesterItem.stats
+	case cfg.KindDigester:
+		return &o.DigesterItem.stats
+	}
+	return &o.ExpellerItem.stats
+}
+
+// running returns whether the node plugin reports itself running
+func (o *Node) running() bool {
+	switch o.Kind {
+	case cfg.KindIngester:
+		return o.IngesterItem.Ingester.Running()
+	case cfg.KindDigester:
+		return o.DigesterItem.Digester.Running()
+	}
+	return o.ExpellerItem.Expeller.Running()
+}
+
+// supervisor returns the supervisor of the node plugin
+func (o *Node) supervisor() *Supervisor {
+	switch o.Kind {
+	case cfg.KindIngester:
+		return o.IngesterItem.Supervisor
+	case cfg.KindDigester:
+		return o.DigesterItem.Supervisor
+	}
+	return o.ExpellerItem.Supervisor
+}
+
+// rcvQueueItem returns the queue a digester receives from, for an expeller
+// the first of its queues
+func (o *Node) rcvQueueItem() *QueueItem {
+	if o.MergeItem != nil {
+		return o.MergeItem.SndQueueItem
+	}
+	return o.RcvQueueItems[0]
+}
+
+// start launches the node plugin along with its merge and fan-out stages,
+// downstream first
+func (o *Node) start(wg *sync.WaitGroup) {
+	if o.FanOutItem != nil {
+		for s := range o.FanOutItem.SndQueueItems {
+			startQueue(o.FanOutItem.SndQueueItems[s], wg)
+		}
+		o.FanOutItem.Supervisor.Start(wg, o.FanOutItem.FanOut)
+	}
+	if o.QueueItem() != nil {
+		startQueue(o.QueueItem(), wg)
+	}
+	if o.DeadLetterItem != nil {
+		startQueue(o.DeadLetterItem.QueueItem, wg)
+	}
+
+	switch o.Kind {
+	case cfg.KindIngester:
+		o.IngesterItem.Supervisor.Start(wg, o.IngesterItem.Ingest)
+	case cfg.KindDigester:
+		rcv := o.rcvQueueItem().Queue
+		o.DigesterItem.Supervisor.Start(wg, func() {
+			o.DigesterItem.Digest(rcv)
+		})
+	case cfg.KindExpeller:
+		queues := make([]icd.Queue, 0)
+		for r := range o.RcvQueueItems {
+			queues = append(queues, o.RcvQueueItems[r].Queue)
+		}
+		o.ExpellerItem.Supervisor.Start(wg, func() {
+			o.ExpellerItem.Expel(queues)
+		})
+	}
+
+	if o.MergeItem != nil {
+		startQueue(o.MergeItem.SndQueueItem, wg)
+		o.MergeItem.Supervisor.Start(wg, o.MergeItem.Merge)
+	}
+}
+
+// initStop signals the node plugin and its stages to stop and closes the
+// queues it owns
+func (o *Node) initStop() {
+	o.supervisor().Stop()
+	if o.FanOutItem != nil {
+		for s := range o.FanOutItem.SndQueueItems {
+			o.FanOutItem.SndQueueItems[s].Close()
+			o.FanOutItem.SndQueueItems[s].Supervisor.Stop()
+		}
+		o.FanOutItem.Supervisor.Stop()
+	}
+	if o.QueueItem() != nil {
+		o.QueueItem().Close()
+		o.QueueItem().Supervisor.Stop()
+	}
+	if o.DeadLetterItem != nil {
+		o.DeadLetterItem.QueueItem.Supervisor.Stop()
+	}
+	if o.MergeItem != nil {
+		o.MergeItem.SndQueueItem.Close()
+		o.MergeItem.SndQueueItem.Supervisor.Stop()
+		o.MergeItem.Supervisor.Stop()
+	}
+}
+
+// startQueue starts monitoring a queue
+func startQueue(queueItem *QueueItem, wg *sync.WaitGroup) {
+	queueItem.Reset()
+	queueItem.Supervisor.Start(wg, queueItem.Monitor)
+}
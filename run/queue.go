@@ -2,18 +2,101 @@ package run
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/reservoird/icd"
 	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/sta"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// QueueItem is what is needed for a queue
+// QueueItem is what is needed for a queue. Queues are instrumented once
+// part of a reservoir, queues between components are also wrapped to
+// measure latency and so they can be tapped. Injected comes first to be
+// 64-bit aligned for atomic use on 32-bit platforms.
 type QueueItem struct {
+	injected       uint64
 	Queue          icd.Queue
 	MonitorControl *icd.MonitorControl
+	Supervisor     *Supervisor
 	stats          interface{}
+	instrumented   *instrumentedQueue
+	latency        *latencyQueue
+	tap            *tapQueue
+}
+
+// Inject puts a message from outside the flow, counting it
+func (o *QueueItem) Inject(item interface{}) error {
+	err := o.Queue.Put(item)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&o.injected, 1)
+	return nil
+}
+
+// Injected returns the number of messages injected
+func (o *QueueItem) Injected() uint64 {
+	return atomic.LoadUint64(&o.injected)
+}
+
+// instrument wraps the queue to count its use
+func (o *QueueItem) instrument() {
+	if o.instrumented == nil {
+		o.instrumented = newInstrumentedQueue(o.Queue)
+		o.Queue = o.instrumented
+	}
+}
+
+// releaser is implemented by queues holding more than Close gives back,
+// such as the files of a disk queue
+type releaser interface {
+	Release() error
+}
+
+// release releases what the queue holds, it cannot be used afterwards
+func (o *QueueItem) release() {
+	queue := o.Queue
+	if o.instrumented != nil {
+		queue = o.instrumented.Queue
+	}
+	r, ok := queue.(releaser)
+	if ok == false {
+		return
+	}
+	err := r.Release()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name": queue.Name(),
+			"err":  err,
+		}).Warn("releasing queue")
+	}
+}
+
+// track wraps the queue to measure latency
+func (o *QueueItem) track() *latencyQueue {
+	if o.latency == nil {
+		o.latency = newLatencyQueue(o.Queue)
+		o.Queue = o.latency
+	}
+	return o.latency
+}
+
+// wrap wraps the queue so it can be tapped
+func (o *QueueItem) wrap() {
+	if o.tap == nil {
+		o.tap = newTapQueue(o.Queue)
+		o.Queue = o.tap
+	}
+}
+
+// Counters returns what the host counted for the queue
+func (o *QueueItem) Counters() sta.QueueCounters {
+	if o.instrumented == nil {
+		return sta.QueueCounters{}
+	}
+	return o.instrumented.counters()
 }
 
 // NewQueueItem creates a new queue
@@ -22,11 +105,7 @@ func NewQueueItem(
 	config string,
 	plugin proxy.Plugin,
 ) (*QueueItem, error) {
-	plug, err := plugin.Open(loc)
-	if err != nil {
-		return nil, err
-	}
-	symbol, err := plug.Lookup("New")
+	symbol, err := lookupNew(loc, KindQueue, plugin)
 	if err != nil {
 		return nil, err
 	}
@@ -34,7 +113,11 @@ func NewQueueItem(
 	if ok == false {
 		return nil, fmt.Errorf("error new queue function not found, expecting: New(string) (icd.Queue, error)")
 	}
-	queue, err := function(config)
+	var queue icd.Queue
+	err = callNew(loc, config, func(path string) error {
+		queue, err = function(path)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -47,6 +130,7 @@ func NewQueueItem(
 		DoneChan:       make(chan struct{}, 1),
 		WaitGroup:      nil,
 	}
+	o.Supervisor = NewSupervisor(o.Queue.Name(), o.MonitorControl)
 	o.stats = nil
 	return o, nil
 }
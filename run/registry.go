@@ -0,0 +1,134 @@
+package run
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/dsk"
+	"github.com/reservoird/reservoird/ipc"
+)
+
+// BuiltinScheme prefixes the location of a component compiled into the
+// binary, for example builtin:com.github.reservoird.fifo
+const BuiltinScheme = "builtin:"
+
+// ExecScheme prefixes the path of a plugin executable run out of process,
+// for example exec:/usr/libexec/reservoird/stdin
+const ExecScheme = "exec:"
+
+var (
+	registry     = make(map[string]interface{})
+	registryLock = sync.Mutex{}
+)
+
+func init() {
+	RegisterQueue(dsk.Name, dsk.New)
+}
+
+// register adds a New function to the registry, panicking on duplicates
+// as registration happens at init time
+func register(name string, function interface{}) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if name == "" {
+		panic("run: register component with empty name")
+	}
+	_, ok := registry[name]
+	if ok == true {
+		panic(fmt.Sprintf("run: register component %s twice", name))
+	}
+	registry[name] = function
+}
+
+// RegisterQueue registers the New function of a builtin queue
+func RegisterQueue(name string, function func(string) (icd.Queue, error)) {
+	register(name, function)
+}
+
+// RegisterIngester registers the New function of a builtin ingester
+func RegisterIngester(name string, function func(string) (icd.Ingester, error)) {
+	register(name, function)
+}
+
+// RegisterDigester registers the New function of a builtin digester
+func RegisterDigester(name string, function func(string) (icd.Digester, error)) {
+	register(name, function)
+}
+
+// RegisterExpeller registers the New function of a builtin expeller
+func RegisterExpeller(name string, function func(string) (icd.Expeller, error)) {
+	register(name, function)
+}
+
+// Registered returns the locations of the builtin components
+func Registered() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	locs := make([]string, 0, len(registry))
+	for name := range registry {
+		locs = append(locs, BuiltinScheme+name)
+	}
+	sort.Strings(locs)
+	return locs
+}
+
+// callNew calls fn with the config to pass to New. Inline json is written
+// to a temporary file for plugins expecting a path, plugin executables get
+// it as is since they may be started again.
+func callNew(loc string, config string, fn func(string) error) error {
+	if strings.HasPrefix(loc, ExecScheme) == true {
+		return fn(config)
+	}
+	return cfg.Config(config).WithPath(fn)
+}
+
+// lookupNew returns the New function of a builtin component, plugin
+// executable or plugin of the given kind
+func lookupNew(loc string, kind string, plugin proxy.Plugin) (interface{}, error) {
+	if strings.HasPrefix(loc, ExecScheme) == true {
+		path := strings.TrimPrefix(loc, ExecScheme)
+		switch kind {
+		case cfg.KindIngester:
+			return func(config string) (icd.Ingester, error) {
+				return ipc.NewIngester(path, config)
+			}, nil
+		case cfg.KindDigester:
+			return func(config string) (icd.Digester, error) {
+				return ipc.NewDigester(path, config)
+			}, nil
+		case cfg.KindExpeller:
+			return func(config string) (icd.Expeller, error) {
+				return ipc.NewExpeller(path, config)
+			}, nil
+		case KindQueue:
+			return func(config string) (icd.Queue, error) {
+				return ipc.NewQueue(path, config)
+			}, nil
+		}
+		return nil, fmt.Errorf("%s: unknown kind %s", loc, kind)
+	}
+	if strings.HasPrefix(loc, BuiltinScheme) == true {
+		name := strings.TrimPrefix(loc, BuiltinScheme)
+		registryLock.Lock()
+		function, ok := registry[name]
+		registryLock.Unlock()
+		if ok == false {
+			return nil, fmt.Errorf("%s: builtin component not registered", name)
+		}
+		return function, nil
+	}
+	plug, err := plugin.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := plug.Lookup("New")
+	if err != nil {
+		return nil, err
+	}
+	return symbol, nil
+}
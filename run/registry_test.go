@@ -0,0 +1,124 @@
+package run
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/dsk"
+)
+
+func init() {
+	RegisterIngester("test.ingester", func(config string) (icd.Ingester, error) {
+		return &fakeIngester{count: 100}, nil
+	})
+	RegisterDigester("test.digester", func(config string) (icd.Digester, error) {
+		return &fakeDigester{}, nil
+	})
+	RegisterExpeller("test.expeller", func(config string) (icd.Expeller, error) {
+		return &fakeExpeller{}, nil
+	})
+	RegisterQueue("test.queue", func(config string) (icd.Queue, error) {
+		return newFakeQueue(config), nil
+	})
+	RegisterQueue("test.filequeue", func(config string) (icd.Queue, error) {
+		data, err := ioutil.ReadFile(config)
+		if err != nil {
+			return nil, err
+		}
+		return newFakeQueue(string(data)), nil
+	})
+}
+
+func TestRegistryRegistered(t *testing.T) {
+	found := false
+	for _, loc := range Registered() {
+		if loc == dsk.Location {
+			found = true
+		}
+	}
+	if found == false {
+		t.Errorf("expecting %s registered", dsk.Location)
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expecting panic on duplicate registration")
+		}
+	}()
+	RegisterIngester("test.ingester", nil)
+}
+
+func TestRegistryLookup(t *testing.T) {
+	_, err := NewQueueItem("builtin:test.missing", "", nil)
+	if err == nil || strings.Contains(err.Error(), "not registered") == false {
+		t.Errorf("expecting not registered error, got %v", err)
+	}
+	_, err = NewQueueItem("builtin:test.ingester", "", nil)
+	if err == nil {
+		t.Errorf("expecting error for ingester used as queue")
+	}
+}
+
+func TestRegistryReservoir(t *testing.T) {
+	queue := cfg.QueueItemCfg{Location: "builtin:test.queue", Config: "queue"}
+	config := cfg.ReservoirCfg{
+		Name: "builtin",
+		ExpellerItem: cfg.ExpellerItemCfg{
+			Location: "builtin:test.expeller",
+			IngesterItems: []cfg.IngesterItemCfg{
+				{
+					Location:  "builtin:test.ingester",
+					QueueItem: queue,
+					Digesters: []cfg.DigesterItemCfg{
+						{Location: "builtin:test.digester", QueueItem: queue},
+					},
+				},
+			},
+		},
+	}
+	reservoir, err := NewReservoir(config, nil)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	err = reservoir.Start()
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	err = reservoir.Drain(5 * time.Second)
+	if err != nil {
+		t.Fatalf("error draining: %v", err)
+	}
+	reservoir.UpdateFinal()
+	reservoir.Wait()
+	expeller := reservoir.Nodes[len(reservoir.Nodes)-1].ExpellerItem.Expeller.(*fakeExpeller)
+	if expeller.Len() != 100 {
+		t.Errorf("expecting 100 items expelled, got %d", expeller.Len())
+	}
+}
+
+func TestRegistryExec(t *testing.T) {
+	_, err := NewIngesterItem("exec:/nonexistent/plugin", "", "builtin:test.queue", "queue", nil)
+	if err == nil {
+		t.Errorf("expecting error for missing plugin executable")
+	}
+	_, err = lookupNew("exec:/nonexistent/plugin", "unknown", nil)
+	if err == nil || strings.Contains(err.Error(), "unknown kind") == false {
+		t.Errorf("expecting unknown kind error, got %v", err)
+	}
+}
+
+func TestRegistryInlineConfig(t *testing.T) {
+	queueItem, err := NewQueueItem("builtin:test.filequeue", `{"name":"inline"}`, nil)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	if queueItem.Queue.Name() != `{"name":"inline"}` {
+		t.Errorf("expecting inline config read from file, got %s", queueItem.Queue.Name())
+	}
+}
@@ -0,0 +1,254 @@
+package run
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReloadReport lists what a reload did to each reservoir, errors are by
+// reservoir name
+type ReloadReport struct {
+	Added     []string          `json:"added"`
+	Changed   []string          `json:"changed"`
+	Removed   []string          `json:"removed"`
+	Unchanged []string          `json:"unchanged"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// Reload applies a new config. Only reservoirs whose config changed are
+// drained, closed, rebuilt and started again, new reservoirs are created
+// and started and reservoirs loaded from a config but no longer in it are
+// drained and disposed, reservoirs created at runtime are left alone. New
+// configs are validated before anything is stopped so a reservoir whose new
+// config is invalid keeps running with the old one, one whose new config
+// fails to build is rebuilt from the old one. A rebuilt reservoir that was
+// stopped stays stopped. Reservoirs are drained outside the map lock.
+func (o *ReservoirMap) Reload(config cfg.Cfg) (ReloadReport, error) {
+	report := ReloadReport{
+		Added:     make([]string, 0),
+		Changed:   make([]string, 0),
+		Removed:   make([]string, 0),
+		Unchanged: make([]string, 0),
+		Errors:    make(map[string]string),
+	}
+	configs := make(map[string]cfg.ReservoirCfg)
+	for r := range config.Reservoirs {
+		name := config.Reservoirs[r].Name
+		if name == "" {
+			return report, fmt.Errorf("reservoirs[%d]: reservoir name is required", r)
+		}
+		_, ok := configs[name]
+		if ok == true {
+			return report, fmt.Errorf("%s: duplicate reservoir name", name)
+		}
+		configs[name] = config.Reservoirs[r]
+	}
+
+	o.reloadLock.Lock()
+	defer o.reloadLock.Unlock()
+
+	problems := make(map[string]string)
+	for name, c := range configs {
+		p := Validate(cfg.Cfg{Reservoirs: []cfg.ReservoirCfg{c}}, o.plugin)
+		if len(p) > 0 {
+			messages := make([]string, 0)
+			for _, problem := range p {
+				messages = append(messages, problem.String())
+			}
+			problems[name] = strings.Join(messages, "; ")
+		}
+	}
+
+	// find what changed, marking what is replaced or removed as stopping
+	replaced := make(map[string]*Reservoir)
+	removed := make(map[string]*Reservoir)
+	added := make(map[string]cfg.ReservoirCfg)
+	running := make(map[string]bool)
+	o.lock.Lock()
+	for name, c := range configs {
+		current, ok := o.Map[name]
+		exists := ok == true && o.Disposed[name] == false
+		if exists == true && reflect.DeepEqual(current.config, c) == true {
+			report.Unchanged = append(report.Unchanged, name)
+			continue
+		}
+		if exists == true && o.stopping[name] == true {
+			report.Errors[name] = fmt.Sprintf("%s: stopping", name)
+			continue
+		}
+		problem, ok := problems[name]
+		if ok == true {
+			report.Errors[name] = problem
+			continue
+		}
+		if exists == false {
+			added[name] = c
+			continue
+		}
+		replaced[name] = current
+	}
+	for name, reservoir := range o.Map {
+		_, keep := configs[name]
+		if keep == true || o.loaded[name] == false || o.Disposed[name] == true || o.stopping[name] == true {
+			continue
+		}
+		removed[name] = reservoir
+	}
+	for _, reservoirs := range []map[string]*Reservoir{replaced, removed} {
+		for name := range reservoirs {
+			running[name] = o.Stopped[name] == false
+			o.Stopped[name] = true
+			o.stopping[name] = true
+		}
+	}
+	o.lock.Unlock()
+
+	// drain and close the old reservoirs before building their replacements
+	// as these may use the same disk queue directories
+	wg := &sync.WaitGroup{}
+	for _, reservoirs := range []map[string]*Reservoir{replaced, removed} {
+		for name, reservoir := range reservoirs {
+			wg.Add(1)
+			go func(reservoir *Reservoir, running bool) {
+				defer wg.Done()
+				if running == true {
+					reservoir.Drain(o.DrainTimeout)
+					if reservoir.finish(o.DrainTimeout) == false {
+						// components still use the queues, close once they return
+						go func() {
+							reservoir.Wait()
+							reservoir.Close()
+						}()
+						return
+					}
+				}
+				reservoir.Close()
+			}(reservoir, running[name])
+		}
+	}
+	wg.Wait()
+
+	built := make(map[string]*Reservoir)
+	for name, c := range added {
+		reservoir, err := NewReservoir(c, o.plugin)
+		if err != nil {
+			report.Errors[name] = err.Error()
+			continue
+		}
+		built[name] = reservoir
+	}
+	restored := make(map[string]*Reservoir)
+	for name, old := range replaced {
+		reservoir, err := NewReservoir(configs[name], o.plugin)
+		if err == nil {
+			built[name] = reservoir
+			continue
+		}
+		report.Errors[name] = err.Error()
+		reservoir, err = NewReservoir(old.config, o.plugin)
+		if err != nil {
+			report.Errors[name] = fmt.Sprintf("%s; restoring: %v", report.Errors[name], err)
+			continue
+		}
+		restored[name] = reservoir
+	}
+
+	o.lock.Lock()
+	for name := range removed {
+		o.Disposed[name] = true
+		delete(o.stopping, name)
+		delete(o.loaded, name)
+		report.Removed = append(report.Removed, name)
+	}
+	for name := range replaced {
+		delete(o.stopping, name)
+		reservoir, ok := built[name]
+		if ok == true {
+			report.Changed = append(report.Changed, name)
+			o.loaded[name] = true
+		} else {
+			reservoir, ok = restored[name]
+		}
+		if ok == false {
+			o.Disposed[name] = true
+			continue
+		}
+		o.Map[name] = reservoir
+		if running[name] == true {
+			o.start(name, reservoir, report.Errors)
+		}
+	}
+	for name := range added {
+		reservoir, ok := built[name]
+		if ok == false {
+			continue
+		}
+		_, exists := o.Map[name]
+		if exists == true && o.Disposed[name] == false {
+			reservoir.Close()
+			report.Errors[name] = fmt.Sprintf("%s: %v", name, ErrExists)
+			continue
+		}
+		report.Added = append(report.Added, name)
+		o.Map[name] = reservoir
+		o.Disposed[name] = false
+		o.Stopped[name] = true
+		o.loaded[name] = true
+		o.start(name, reservoir, report.Errors)
+	}
+	o.lock.Unlock()
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Changed)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Unchanged)
+	log.WithFields(log.Fields{
+		"added":     report.Added,
+		"changed":   report.Changed,
+		"removed":   report.Removed,
+		"unchanged": report.Unchanged,
+		"errors":    report.Errors,
+	}).Info("reloaded config")
+	return report, nil
+}
+
+// start starts a reservoir put in place by a reload, the lock must be held
+func (o *ReservoirMap) start(name string, reservoir *Reservoir, errs map[string]string) {
+	err := reservoir.Start()
+	if err != nil {
+		errs[name] = err.Error()
+		return
+	}
+	o.Stopped[name] = false
+}
+
+// finish collects the final stats of a stopping reservoir and waits for it
+// to return, giving up after the timeout since a component that never
+// returns would block forever. A reservoir that did not return must not be
+// closed yet.
+func (o *Reservoir) finish(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		o.UpdateFinal()
+		o.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	log.WithFields(log.Fields{
+		"reservoir": o.Name,
+		"timeout":   timeout,
+	}).Warn("reservoir did not return after stopping")
+	return false
+}
@@ -0,0 +1,124 @@
+package run
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+// builtinReservoir returns a reservoir of the registered test components,
+// config is inline json so the reservoir validates
+func builtinReservoir(name string, config string) cfg.ReservoirCfg {
+	return cfg.ReservoirCfg{
+		Name: name,
+		ExpellerItem: cfg.ExpellerItemCfg{
+			Location: "builtin:test.expeller",
+			Config:   cfg.Config(config),
+			IngesterItems: []cfg.IngesterItemCfg{
+				{
+					Location:  "builtin:test.ingester",
+					QueueItem: cfg.QueueItemCfg{Location: "builtin:test.queue"},
+				},
+			},
+		},
+	}
+}
+
+func TestReservoirMapReload(t *testing.T) {
+	config := cfg.Cfg{
+		Reservoirs: []cfg.ReservoirCfg{
+			builtinReservoir("same", ""),
+			builtinReservoir("changed", `{"version":"before"}`),
+			builtinReservoir("removed", ""),
+			builtinReservoir("stopped", `{"version":"before"}`),
+		},
+	}
+	reservoirMap, err := NewReservoirMap(config, nil)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	reservoirMap.StartAll()
+	err = reservoirMap.InitStop("stopped", StopDrain)
+	if err != nil {
+		t.Fatalf("error stopping: %v", err)
+	}
+	reservoirMap.UpdateFinalAndWait("stopped")
+	same := reservoirMap.Map["same"]
+	changed := reservoirMap.Map["changed"]
+	err = reservoirMap.Create(builtinReservoir("created", ""))
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+
+	config = cfg.Cfg{
+		Reservoirs: []cfg.ReservoirCfg{
+			builtinReservoir("same", ""),
+			builtinReservoir("changed", `{"version":"after"}`),
+			builtinReservoir("stopped", `{"version":"after"}`),
+			builtinReservoir("added", ""),
+			{Name: "broken"},
+		},
+	}
+	report, err := reservoirMap.Reload(config)
+	if err != nil {
+		t.Fatalf("error reloading: %v", err)
+	}
+	expected := ReloadReport{
+		Added:     []string{"added"},
+		Changed:   []string{"changed", "stopped"},
+		Removed:   []string{"removed"},
+		Unchanged: []string{"same"},
+	}
+	if reflect.DeepEqual(report.Added, expected.Added) == false ||
+		reflect.DeepEqual(report.Changed, expected.Changed) == false ||
+		reflect.DeepEqual(report.Removed, expected.Removed) == false ||
+		reflect.DeepEqual(report.Unchanged, expected.Unchanged) == false {
+		t.Errorf("expecting %+v but got %+v", expected, report)
+	}
+	if _, ok := report.Errors["broken"]; ok == false || len(report.Errors) != 1 {
+		t.Errorf("expecting an error for broken, got %v", report.Errors)
+	}
+	if reservoirMap.Map["same"] != same {
+		t.Errorf("expecting unchanged reservoir kept")
+	}
+	if changed.closed == false {
+		t.Errorf("expecting replaced reservoir closed")
+	}
+	states := map[string][2]bool{
+		"same":    {false, false},
+		"changed": {false, false},
+		"stopped": {true, false},
+		"added":   {false, false},
+		"removed": {true, true},
+		"created": {true, false},
+	}
+	for name, state := range states {
+		if reservoirMap.Stopped[name] != state[0] || reservoirMap.Disposed[name] != state[1] {
+			t.Errorf("%s: expecting stopped %v disposed %v but got %v %v", name,
+				state[0], state[1], reservoirMap.Stopped[name], reservoirMap.Disposed[name])
+		}
+	}
+
+	_, err = reservoirMap.Reload(cfg.Cfg{Reservoirs: []cfg.ReservoirCfg{{Name: "a"}, {Name: "a"}}})
+	if err == nil {
+		t.Errorf("expecting error for duplicate names")
+	}
+
+	reservoirMap.InitStopAll()
+	reservoirMap.WaitAll()
+}
+
+func TestReservoirFinish(t *testing.T) {
+	reservoir := &Reservoir{Name: "stuck", wg: &sync.WaitGroup{}}
+	reservoir.wg.Add(1)
+	if reservoir.finish(10*time.Millisecond) == true {
+		t.Errorf("expecting a reservoir that did not return unfinished")
+	}
+	reservoir.wg.Done()
+	if reservoir.finish(time.Second) == false {
+		t.Errorf("expecting a reservoir that returned finished")
+	}
+}
@@ -1,85 +1,328 @@
 package run
 
 import (
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/reservoird/icd"
 	"github.com/reservoird/proxy"
 	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/dsk"
+	"github.com/reservoird/reservoird/sta"
+	"github.com/reservoird/reservoird/viz"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StopMode determines how a reservoir is stopped
+type StopMode int
+
+// Stop modes
+const (
+	// StopDrain stops ingesters first and lets queued data flow out
+	StopDrain StopMode = iota
+	// StopImmediate stops the expeller first, dropping queued data
+	StopImmediate
+)
+
+const (
+	// DefaultDrainTimeout is how long a drain waits before giving up
+	DefaultDrainTimeout = 30 * time.Second
+	drainInterval       = 10 * time.Millisecond
 )
 
-// Reservoir is the structure for one reservoir flow
+// ParseStopMode converts a name into a stop mode, empty means immediate.
+// Draining is asked for explicitly, only a shutdown drains by default.
+func ParseStopMode(mode string) (StopMode, error) {
+	switch mode {
+	case "drain":
+		return StopDrain, nil
+	case "", "immediate":
+		return StopImmediate, nil
+	}
+	return StopImmediate, fmt.Errorf("%s: unknown stop mode, expecting drain or immediate", mode)
+}
+
+// Reservoir is the structure for one reservoir flow, lock guards the stats
+// of its components which are updated while draining outside the map lock
 type Reservoir struct {
-	Name         string
-	ExpellerItem *ExpellerItem
-	config       cfg.ReservoirCfg
-	run          bool
-	wg           *sync.WaitGroup
+	Name     string
+	Nodes    []*Node
+	config   cfg.ReservoirCfg
+	updated  map[string]time.Time
+	run      bool
+	closed   bool
+	wg       *sync.WaitGroup
+	endToEnd *latencyHistogram
+	lock     sync.Mutex
 }
 
-// NewReservoir setups the flow for one reservoir flow
+// NewReservoir setups the flow for one reservoir flow. Nodes are kept in
+// topological order, upstream before downstream.
 func NewReservoir(
 	config cfg.ReservoirCfg,
 	plugin proxy.Plugin,
 ) (*Reservoir, error) {
-	ings := make([]*IngesterItem, 0)
-	for i := range config.ExpellerItem.IngesterItems {
-		digs := make([]*DigesterItem, 0)
-		for d := range config.ExpellerItem.IngesterItems[i].Digesters {
-			digesterItem, err := NewDigesterItem(
-				config.ExpellerItem.IngesterItems[i].Digesters[d].Location,
-				config.ExpellerItem.IngesterItems[i].Digesters[d].Config,
-				config.ExpellerItem.IngesterItems[i].Digesters[d].QueueItem.Location,
-				config.ExpellerItem.IngesterItems[i].Digesters[d].QueueItem.Config,
-				plugin,
-			)
-			if err != nil {
-				return nil, err
+	return newReservoir(
+		config,
+		func(nodeCfg cfg.NodeCfg) (*Node, error) {
+			return NewNode(nodeCfg, plugin)
+		},
+		func(queueCfg cfg.QueueItemCfg) (*QueueItem, error) {
+			return NewQueueItem(queueCfg.Location, string(queueCfg.Config), plugin)
+		},
+	)
+}
+
+// queueCopy returns the config of a copy of a queue made by a fan-out or a
+// merge, disk queue copies get a directory of their own named by id
+func queueCopy(config cfg.QueueItemCfg, id string) (cfg.QueueItemCfg, error) {
+	if config.Location != dsk.Location {
+		return config, nil
+	}
+	sub, err := dsk.Sub(string(config.Config), id)
+	if err != nil {
+		return config, fmt.Errorf("%s: %v", id, err)
+	}
+	config.Config = cfg.Config(sub)
+	return config, nil
+}
+
+// newReservoir builds and connects the nodes of a reservoir, releasing
+// what was built when it fails
+func newReservoir(
+	config cfg.ReservoirCfg,
+	newNode func(cfg.NodeCfg) (*Node, error),
+	newQueueItem func(cfg.QueueItemCfg) (*QueueItem, error),
+) (reservoir *Reservoir, err error) {
+	built := make([]*QueueItem, 0)
+	nodes := make([]*Node, 0)
+	defer func() {
+		if err != nil {
+			// close releases the copies already given to a fan-out or merge,
+			// release the others once
+			failed := &Reservoir{Nodes: nodes}
+			owned := make(map[*QueueItem]bool)
+			for _, queueItem := range failed.queueItems() {
+				owned[queueItem] = true
 			}
-			digs = append(digs, digesterItem)
-		}
-		ingesterItem, err := NewIngesterItem(
-			config.ExpellerItem.IngesterItems[i].Location,
-			config.ExpellerItem.IngesterItems[i].Config,
-			config.ExpellerItem.IngesterItems[i].QueueItem.Location,
-			config.ExpellerItem.IngesterItems[i].QueueItem.Config,
-			digs,
-			plugin,
-		)
+			failed.Close()
+			for _, queueItem := range built {
+				if owned[queueItem] == false {
+					queueItem.release()
+				}
+			}
+		}
+	}()
+	copyQueueItem := func(queueCfg cfg.QueueItemCfg, id string) (*QueueItem, error) {
+		queueCfg, err := queueCopy(queueCfg, id)
+		if err != nil {
+			return nil, err
+		}
+		queueItem, err := newQueueItem(queueCfg)
 		if err != nil {
 			return nil, err
 		}
-		ings = append(ings, ingesterItem)
+		built = append(built, queueItem)
+		return queueItem, nil
 	}
-	expellerItem, err := NewExpellerItem(
-		config.ExpellerItem.Location,
-		config.ExpellerItem.Config,
-		ings,
-		plugin,
-	)
+
+	graph, err := config.ToGraph()
 	if err != nil {
 		return nil, err
 	}
-	reservoir := new(Reservoir)
+	order, err := graph.TopologicalOrder()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", config.Name, err)
+	}
+
+	nodeMap := make(map[string]*Node)
+	for _, id := range order {
+		nodeCfg, _ := graph.Node(id)
+		node, err := newNode(nodeCfg)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if nodeCfg.DeadLetter != nil {
+			queueItem, err := newQueueItem(*nodeCfg.DeadLetter)
+			if err != nil {
+				return nil, err
+			}
+			node.DeadLetterItem = NewDeadLetterItem(id, queueItem, node.MonitorControl())
+		}
+		if nodeCfg.Delivery != nil {
+			policy, err := NewDeliveryPolicy(*nodeCfg.Delivery)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", config.Name, id, err)
+			}
+			node.DeliveryItem = NewDeliveryItem(id, policy, node.MonitorControl())
+		}
+		node.Upstream = graph.Upstream(id)
+		node.Downstream = graph.Downstream(id)
+		nodeMap[id] = node
+	}
+
+	// connect each output queue to its downstream nodes, fanning out with a
+	// copy of the queue per downstream node when there are several
+	for _, node := range nodes {
+		if node.QueueItem() == nil {
+			continue
+		}
+		if len(node.Downstream) == 1 {
+			down := nodeMap[node.Downstream[0]]
+			down.RcvQueueItems = append(down.RcvQueueItems, node.QueueItem())
+			continue
+		}
+		nodeCfg, _ := graph.Node(node.ID)
+		snds := make([]*QueueItem, 0)
+		for _, id := range node.Downstream {
+			queueItem, err := copyQueueItem(nodeCfg.QueueItem, node.ID+".fanout."+id)
+			if err != nil {
+				return nil, err
+			}
+			snds = append(snds, queueItem)
+			nodeMap[id].RcvQueueItems = append(nodeMap[id].RcvQueueItems, queueItem)
+		}
+		node.FanOutItem = NewFanOutItem(node.QueueItem(), snds, node.Downstream)
+	}
+
+	// merge the upstream queues of digesters receiving from several nodes
+	// into a copy of the digester output queue
+	for _, node := range nodes {
+		if node.Kind != cfg.KindDigester || len(node.RcvQueueItems) == 1 {
+			continue
+		}
+		nodeCfg, _ := graph.Node(node.ID)
+		queueItem, err := copyQueueItem(nodeCfg.QueueItem, node.ID+".merge")
+		if err != nil {
+			return nil, err
+		}
+		node.MergeItem = NewMergeItem(node.RcvQueueItems, queueItem)
+	}
+
+	reservoir = new(Reservoir)
+	reservoir.Nodes = nodes
+
+	// instrument every queue, wrap the queues between components to measure
+	// latency and so they can be tapped, not the dead-letter queues, and the
+	// queues of ingesters with delivery to track acknowledgements
+	for _, queueItem := range reservoir.queueItems() {
+		queueItem.instrument()
+	}
+	reservoir.track()
+	for _, node := range nodes {
+		if node.DeliveryItem != nil {
+			node.DeliveryItem.wrap(node.QueueItem())
+		}
+	}
+	for _, node := range nodes {
+		if node.MergeItem != nil {
+			node.MergeItem.SndQueueItem.wrap()
+		}
+		if node.QueueItem() != nil {
+			node.QueueItem().wrap()
+		}
+		if node.FanOutItem != nil {
+			for s := range node.FanOutItem.SndQueueItems {
+				node.FanOutItem.SndQueueItems[s].wrap()
+			}
+		}
+	}
+
 	reservoir.Name = config.Name
-	reservoir.ExpellerItem = expellerItem
 	reservoir.config = config
+	reservoir.updated = make(map[string]time.Time)
 	reservoir.run = false
 	reservoir.wg = &sync.WaitGroup{}
 	return reservoir, nil
 }
 
+// monitored returns everything that reports stats in flow order
+func (o *Reservoir) monitored() []monitored {
+	m := make([]monitored, 0)
+	for n := range o.Nodes {
+		m = append(m, o.Nodes[n].monitored()...)
+	}
+	return m
+}
+
+// queueItems returns every queue owned by the reservoir in flow order
+func (o *Reservoir) queueItems() []*QueueItem {
+	queueItems := make([]*QueueItem, 0)
+	for _, node := range o.Nodes {
+		if node.MergeItem != nil {
+			queueItems = append(queueItems, node.MergeItem.SndQueueItem)
+		}
+		if node.QueueItem() != nil {
+			queueItems = append(queueItems, node.QueueItem())
+		}
+		if node.FanOutItem != nil {
+			queueItems = append(queueItems, node.FanOutItem.SndQueueItems...)
+		}
+		if node.DeadLetterItem != nil {
+			queueItems = append(queueItems, node.DeadLetterItem.QueueItem)
+		}
+	}
+	return queueItems
+}
+
+// queues returns the queues between components in flow order
+func (o *Reservoir) queues() []monitored {
+	queues := make([]monitored, 0)
+	for _, m := range o.monitored() {
+		if m.queueItem != nil && m.queueItem.tap != nil {
+			queues = append(queues, m)
+		}
+	}
+	return queues
+}
+
+// queue returns a queue between components by its position in flow order
+// or by id
+func (o *Reservoir) queue(index string) (monitored, error) {
+	queues := o.queues()
+	i, err := strconv.Atoi(index)
+	if err == nil {
+		if i >= 0 && i < len(queues) {
+			return queues[i], nil
+		}
+	} else {
+		for q := range queues {
+			if queues[q].id == index {
+				return queues[q], nil
+			}
+		}
+	}
+	return monitored{}, fmt.Errorf("%s: queue %s %w", o.Name, index, ErrNotFound)
+}
+
+// GetQueues returns the queues between components in flow order
+func (o *Reservoir) GetQueues() []sta.QueueStats {
+	queues := make([]sta.QueueStats, 0)
+	for q, m := range o.queues() {
+		queues = append(queues, sta.QueueStats{
+			Index:    q,
+			ID:       m.id,
+			Name:     m.name,
+			Len:      m.queueItem.Queue.Len(),
+			Cap:      m.queueItem.Queue.Cap(),
+			Taps:     m.queueItem.tap.tapped(),
+			Injected: m.queueItem.Injected(),
+			Counters: m.queueItem.Counters(),
+		})
+	}
+	return queues
+}
+
 // GetReservoir return the reservoir
 func (o *Reservoir) GetReservoir() ([]interface{}, error) {
 	reservoir := make([]interface{}, 0)
-	for i := range o.ExpellerItem.IngesterItems {
-		reservoir = append(reservoir, o.ExpellerItem.IngesterItems[i].stats)
-		reservoir = append(reservoir, o.ExpellerItem.IngesterItems[i].QueueItem.stats)
-		for d := range o.ExpellerItem.IngesterItems[i].DigesterItems {
-			reservoir = append(reservoir, o.ExpellerItem.IngesterItems[i].DigesterItems[d].stats)
-			reservoir = append(reservoir, o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.stats)
-		}
-		reservoir = append(reservoir, o.ExpellerItem.stats)
+	for _, m := range o.monitored() {
+		stats, _ := o.stats(m)
+		reservoir = append(reservoir, stats)
 	}
 	return reservoir, nil
 }
@@ -87,65 +330,196 @@ func (o *Reservoir) GetReservoir() ([]interface{}, error) {
 // GetFlow returns the flow
 func (o *Reservoir) GetFlow() ([]string, error) {
 	flow := make([]string, 0)
-	for i := range o.ExpellerItem.IngesterItems {
-		flow = append(flow, o.ExpellerItem.IngesterItems[i].Ingester.Name())
-		flow = append(flow, o.ExpellerItem.IngesterItems[i].QueueItem.Queue.Name())
-		for d := range o.ExpellerItem.IngesterItems[i].DigesterItems {
-			flow = append(flow, o.ExpellerItem.IngesterItems[i].DigesterItems[d].Digester.Name())
-			flow = append(flow, o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.Queue.Name())
-		}
+	for _, m := range o.monitored() {
+		flow = append(flow, m.name)
 	}
-	flow = append(flow, o.ExpellerItem.Expeller.Name())
 	return flow, nil
 }
 
-// Start starts system
+// GetGraph returns the topology of the reservoir, with running states and
+// queue depths when running
+func (o *Reservoir) GetGraph(running bool) viz.Graph {
+	graph, _ := o.config.ToGraph()
+	g := viz.Graph{
+		Name:  o.Name,
+		Nodes: make([]viz.Node, 0),
+		Edges: make([]viz.Edge, 0),
+	}
+	for _, node := range o.Nodes {
+		nodeCfg, _ := graph.Node(node.ID)
+		n := viz.Node{
+			ID:       node.ID,
+			Kind:     node.Kind,
+			Name:     node.Name(),
+			Location: nodeCfg.Location,
+			Merge:    node.MergeItem != nil,
+		}
+		if running == true {
+			r := node.running()
+			n.Running = &r
+		}
+		g.Nodes = append(g.Nodes, n)
+		for d, down := range node.Downstream {
+			queueItem := node.QueueItem()
+			edge := viz.Edge{
+				From:    node.ID,
+				To:      down,
+				QueueID: node.ID + ".queue",
+			}
+			if node.FanOutItem != nil {
+				queueItem = node.FanOutItem.SndQueueItems[d]
+				edge.FanOut = true
+				edge.QueueID = node.ID + ".fanout." + down
+			}
+			edge.Queue = queueItem.Queue.Name()
+			if running == true {
+				l := queueItem.Queue.Len()
+				c := queueItem.Queue.Cap()
+				edge.Len = &l
+				edge.Cap = &c
+			}
+			g.Edges = append(g.Edges, edge)
+		}
+	}
+	return g
+}
+
+// Start starts system, downstream nodes first
 func (o *Reservoir) Start() error {
-	var prevQueue icd.Queue
-	expellerQueues := make([]icd.Queue, 0)
-	for i := range o.ExpellerItem.IngesterItems {
-		o.wg.Add(1)
-		o.ExpellerItem.IngesterItems[i].QueueItem.MonitorControl.WaitGroup = o.wg
-		o.ExpellerItem.IngesterItems[i].QueueItem.Reset()
-		go o.ExpellerItem.IngesterItems[i].QueueItem.Monitor()
-		o.wg.Add(1)
-		o.ExpellerItem.IngesterItems[i].MonitorControl.WaitGroup = o.wg
-		go o.ExpellerItem.IngesterItems[i].Ingest()
-		prevQueue = o.ExpellerItem.IngesterItems[i].QueueItem.Queue
-		for d := range o.ExpellerItem.IngesterItems[i].DigesterItems {
-			o.wg.Add(1)
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.MonitorControl.WaitGroup = o.wg
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.Reset()
-			go o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.Monitor()
-			o.wg.Add(1)
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].MonitorControl.WaitGroup = o.wg
-			go o.ExpellerItem.IngesterItems[i].DigesterItems[d].Digest(prevQueue)
-			prevQueue = o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.Queue
-		}
-		expellerQueues = append(expellerQueues, prevQueue)
-	}
-	o.wg.Add(1)
-	o.ExpellerItem.MonitorControl.WaitGroup = o.wg
-	go o.ExpellerItem.Expel(expellerQueues)
+	for n := len(o.Nodes) - 1; n >= 0; n-- {
+		o.Nodes[n].start(o.wg)
+	}
 	return nil
 }
 
-// InitStop initiates a stop
+// Close releases what a stopped reservoir holds, such as the files of disk
+// queues and plugin processes, it cannot be started again
+func (o *Reservoir) Close() {
+	o.lock.Lock()
+	closed := o.closed
+	o.closed = true
+	o.lock.Unlock()
+	if closed == true {
+		return
+	}
+	for _, node := range o.Nodes {
+		node.release()
+		if node.DeadLetterItem != nil {
+			node.DeadLetterItem.Close()
+		}
+		if node.DeliveryItem != nil {
+			node.DeliveryItem.Close()
+		}
+	}
+	for _, queueItem := range o.queueItems() {
+		queueItem.release()
+	}
+}
+
+// InitStop initiates a stop, downstream nodes first
 func (o *Reservoir) InitStop() error {
-	o.ExpellerItem.MonitorControl.DoneChan <- struct{}{}
-	for i := range o.ExpellerItem.IngesterItems {
-		for d := range o.ExpellerItem.IngesterItems[i].DigesterItems {
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.Close()
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.MonitorControl.DoneChan <- struct{}{}
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].MonitorControl.DoneChan <- struct{}{}
+	for n := len(o.Nodes) - 1; n >= 0; n-- {
+		o.Nodes[n].initStop()
+	}
+	return nil
+}
+
+// InitStopMode initiates a stop using the given mode
+func (o *Reservoir) InitStopMode(mode StopMode, timeout time.Duration) error {
+	if mode == StopDrain {
+		return o.Drain(timeout)
+	}
+	return o.InitStop()
+}
+
+// Drain stops ingesters first and lets queued data flow out before stopping
+// the remaining nodes in topological order, each once the queues it
+// receives from are empty. Once the timeout passes the remaining nodes are
+// stopped without waiting.
+func (o *Reservoir) Drain(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for _, node := range o.Nodes {
+		if node.Kind == cfg.KindIngester {
+			node.supervisor().Stop()
 		}
-		o.ExpellerItem.IngesterItems[i].QueueItem.Close()
-		o.ExpellerItem.IngesterItems[i].QueueItem.MonitorControl.DoneChan <- struct{}{}
-		o.ExpellerItem.IngesterItems[i].MonitorControl.DoneChan <- struct{}{}
+	}
+	for _, node := range o.Nodes {
+		if node.MergeItem != nil {
+			o.drainQueues(node.MergeItem.RcvQueueItems, deadline)
+			node.MergeItem.Supervisor.Stop()
+			o.waitExited(node.MergeItem.Supervisor, deadline)
+			o.drainQueues([]*QueueItem{node.MergeItem.SndQueueItem}, deadline)
+		} else {
+			o.drainQueues(node.RcvQueueItems, deadline)
+		}
+		if node.Kind != cfg.KindIngester {
+			node.supervisor().Stop()
+		}
+		o.waitExited(node.supervisor(), deadline)
+		if node.FanOutItem != nil {
+			o.drainQueues([]*QueueItem{node.QueueItem()}, deadline)
+			node.FanOutItem.Supervisor.Stop()
+			o.waitExited(node.FanOutItem.Supervisor, deadline)
+		}
+	}
+
+	queueItems := o.queueItems()
+	for q := range queueItems {
+		queueItems[q].Supervisor.Stop()
 	}
 	return nil
 }
 
+// drainQueues waits for each queue to empty and closes it so whatever
+// receives from it can stop
+func (o *Reservoir) drainQueues(queueItems []*QueueItem, deadline time.Time) {
+	for q := range queueItems {
+		o.waitEmpty(queueItems[q], deadline)
+		queueItems[q].Close()
+	}
+}
+
+// waitEmpty waits for a queue to empty or the deadline to pass
+func (o *Reservoir) waitEmpty(queueItem *QueueItem, deadline time.Time) {
+	ok := o.waitUntil(func() bool {
+		return queueItem.Queue.Len() == 0
+	}, deadline)
+	if ok == false {
+		log.WithFields(log.Fields{
+			"reservoir": o.Name,
+			"name":      queueItem.Queue.Name(),
+			"len":       queueItem.Queue.Len(),
+		}).Warn("drain deadline passed before queue emptied")
+	}
+}
+
+// waitExited waits for a component to exit or the deadline to pass
+func (o *Reservoir) waitExited(supervisor *Supervisor, deadline time.Time) {
+	ok := o.waitUntil(func() bool {
+		return supervisor.Running() == false
+	}, deadline)
+	if ok == false {
+		log.WithFields(log.Fields{
+			"reservoir": o.Name,
+			"name":      supervisor.Name,
+		}).Warn("drain deadline passed before component stopped")
+	}
+}
+
+// waitUntil polls until cond holds or the deadline passes. Stats are
+// collected while waiting so components never block sending them.
+func (o *Reservoir) waitUntil(cond func() bool, deadline time.Time) bool {
+	for cond() == false {
+		if time.Now().After(deadline) == true {
+			return false
+		}
+		o.Update()
+		time.Sleep(drainInterval)
+	}
+	return true
+}
+
 // Stop stops and waits
 func (o *Reservoir) Stop() error {
 	err := o.InitStop()
@@ -161,50 +535,109 @@ func (o *Reservoir) Wait() {
 	o.wg.Wait()
 }
 
+// update stores the latest stats without blocking, returns whether there
+// were new stats
+func update(mc *icd.MonitorControl, stats *interface{}) bool {
+	select {
+	case s := <-mc.StatsChan:
+		*stats = s
+		return true
+	default:
+	}
+	return false
+}
+
 // Update updates stats
 func (o *Reservoir) Update() error {
-	for i := range o.ExpellerItem.IngesterItems {
-		select {
-		case stats := <-o.ExpellerItem.IngesterItems[i].MonitorControl.StatsChan:
-			o.ExpellerItem.IngesterItems[i].stats = stats
-		default:
-		}
-		select {
-		case stats := <-o.ExpellerItem.IngesterItems[i].QueueItem.MonitorControl.StatsChan:
-			o.ExpellerItem.IngesterItems[i].QueueItem.stats = stats
-		default:
-		}
-		for d := range o.ExpellerItem.IngesterItems[i].DigesterItems {
-			select {
-			case stats := <-o.ExpellerItem.IngesterItems[i].DigesterItems[d].MonitorControl.StatsChan:
-				o.ExpellerItem.IngesterItems[i].DigesterItems[d].stats = stats
-			default:
-			}
-			select {
-			case stats := <-o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.MonitorControl.StatsChan:
-				o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.stats = stats
-			default:
-			}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, m := range o.monitored() {
+		if update(m.mc, m.stats) == true {
+			o.updated[m.id] = time.Now()
 		}
 	}
-	select {
-	case stats := <-o.ExpellerItem.MonitorControl.StatsChan:
-		o.ExpellerItem.stats = stats
-	default:
-	}
 	return nil
 }
 
-// UpdateFinal updates stat
+// UpdateFinal updates stat, waiting for final stats without the lock
 func (o *Reservoir) UpdateFinal() error {
-	for i := range o.ExpellerItem.IngesterItems {
-		o.ExpellerItem.IngesterItems[i].stats = <-o.ExpellerItem.IngesterItems[i].MonitorControl.FinalStatsChan
-		o.ExpellerItem.IngesterItems[i].QueueItem.stats = <-o.ExpellerItem.IngesterItems[i].QueueItem.MonitorControl.FinalStatsChan
-		for d := range o.ExpellerItem.IngesterItems[i].DigesterItems {
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].stats = <-o.ExpellerItem.IngesterItems[i].DigesterItems[d].MonitorControl.FinalStatsChan
-			o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.stats = <-o.ExpellerItem.IngesterItems[i].DigesterItems[d].QueueItem.MonitorControl.FinalStatsChan
+	for _, m := range o.monitored() {
+		stats := <-m.mc.FinalStatsChan
+		if stats != nil {
+			o.lock.Lock()
+			*m.stats = stats
+			o.updated[m.id] = time.Now()
+			o.lock.Unlock()
 		}
 	}
-	o.ExpellerItem.stats = <-o.ExpellerItem.MonitorControl.FinalStatsChan
 	return nil
 }
+
+// stats returns the latest stats of a component and when they were updated
+func (o *Reservoir) stats(m monitored) (interface{}, time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return *m.stats, o.updated[m.id]
+}
+
+// GetSupervisors returns the restart counts and last error of every
+// component in flow order
+func (o *Reservoir) GetSupervisors() []sta.SupervisorStats {
+	supervisors := make([]sta.SupervisorStats, 0)
+	for _, m := range o.monitored() {
+		stats := m.supervisor.Stats()
+		stats.ID = m.id
+		supervisors = append(supervisors, stats)
+	}
+	return supervisors
+}
+
+// GetCounters returns what the host counted for every queue in flow order
+func (o *Reservoir) GetCounters() []sta.QueueCounters {
+	counters := make([]sta.QueueCounters, 0)
+	for _, m := range o.monitored() {
+		if m.queueItem == nil {
+			continue
+		}
+		c := m.queueItem.Counters()
+		c.ID = m.id
+		counters = append(counters, c)
+	}
+	return counters
+}
+
+// GetMetrics returns the metrics of every component in flow order
+func (o *Reservoir) GetMetrics() []sta.ComponentMetrics {
+	metrics := make([]sta.ComponentMetrics, 0)
+	for _, m := range o.monitored() {
+		stats, updated := o.stats(m)
+		c := sta.ComponentMetrics{
+			ID:         m.id,
+			Kind:       m.kind,
+			Name:       m.name,
+			Running:    m.running(),
+			Updated:    updated,
+			Stats:      stats,
+			Normalized: m.normalized(stats),
+		}
+		c.Supervisor = m.supervisor.Stats()
+		c.Supervisor.ID = m.id
+		if m.delivery != nil {
+			delivery := m.delivery.Stats()
+			c.Delivery = &delivery
+		}
+		if m.queueItem != nil {
+			c.Len = m.queueItem.Queue.Len()
+			c.Cap = m.queueItem.Queue.Cap()
+			c.Injected = m.queueItem.Injected()
+			counters := m.queueItem.Counters()
+			c.Counters = &counters
+			if m.queueItem.latency != nil {
+				latency := m.queueItem.latency.latency()
+				c.Latency = &latency
+			}
+		}
+		metrics = append(metrics, c)
+	}
+	return metrics
+}
@@ -0,0 +1,300 @@
+package run
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/dsk"
+)
+
+// runFakeReservoir starts, drains and waits for a fake reservoir
+func runFakeReservoir(t *testing.T, config cfg.ReservoirCfg) (*Reservoir, map[string]*fakeExpeller) {
+	reservoir, expellers, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	err = reservoir.Start()
+	if err != nil {
+		t.Fatalf("error starting: %v", err)
+	}
+	err = reservoir.Drain(5 * time.Second)
+	if err != nil {
+		t.Fatalf("error draining: %v", err)
+	}
+	reservoir.UpdateFinal()
+	reservoir.Wait()
+	return reservoir, expellers
+}
+
+func TestReservoirParseStopMode(t *testing.T) {
+	mode, err := ParseStopMode("")
+	if err != nil || mode != StopImmediate {
+		t.Errorf("expecting immediate by default, got %v (%v)", mode, err)
+	}
+	mode, err = ParseStopMode("drain")
+	if err != nil || mode != StopDrain {
+		t.Errorf("expecting drain, got %v (%v)", mode, err)
+	}
+	mode, err = ParseStopMode("immediate")
+	if err != nil || mode != StopImmediate {
+		t.Errorf("expecting immediate, got %v (%v)", mode, err)
+	}
+	_, err = ParseStopMode("later")
+	if err == nil {
+		t.Errorf("expecting error for unknown mode")
+	}
+}
+
+func TestReservoirDrain(t *testing.T) {
+	config := cfg.ReservoirCfg{
+		Name: "drain",
+		ExpellerItem: cfg.ExpellerItemCfg{
+			Location:      "expeller",
+			IngesterItems: []cfg.IngesterItemCfg{fakeChain("", 1000)},
+		},
+	}
+	_, expellers := runFakeReservoir(t, config)
+	if expellers["expeller0"].Len() != 1000 {
+		t.Errorf("expecting 1000 items expelled, got %d", expellers["expeller0"].Len())
+	}
+}
+
+func TestReservoirFanOut(t *testing.T) {
+	config := cfg.ReservoirCfg{
+		Name: "fanout",
+		IngesterItems: []cfg.IngesterItemCfg{
+			fakeChain("one", 1000),
+			fakeChain("two", 10),
+		},
+		ExpellerItems: []cfg.ExpellerItemCfg{
+			{Location: "all"},
+			{Location: "two", Routes: []string{"two"}},
+		},
+	}
+	reservoir, expellers := runFakeReservoir(t, config)
+	if expellers["expeller0"].Len() != 1010 {
+		t.Errorf("expecting 1010 items expelled to all, got %d", expellers["expeller0"].Len())
+	}
+	if expellers["expeller1"].Len() != 10 {
+		t.Errorf("expecting 10 items expelled to two, got %d", expellers["expeller1"].Len())
+	}
+	flow, _ := reservoir.GetFlow()
+	expected := []string{
+		"fakeingester", "ingestqueue", "fakedigester", "digestqueue",
+		"fakeingester", "ingestqueue", "fakedigester", "digestqueue",
+		FanOutName, "digestqueue", "digestqueue",
+		"fakeexpeller", "fakeexpeller",
+	}
+	if reflect.DeepEqual(flow, expected) == false {
+		t.Errorf("expecting flow %v, got %v", expected, flow)
+	}
+}
+
+func TestReservoirQueueCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := cfg.QueueItemCfg{
+		Location: dsk.Location,
+		Config:   cfg.Config(`{"dir":"` + dir + `"}`),
+	}
+	queueItems := make([]*QueueItem, 0)
+	for _, id := range []string{"", "ingester0.fanout.a", "ingester0.fanout.b"} {
+		c := config
+		if id != "" {
+			c, err = queueCopy(config, id)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		queueItem, err := NewQueueItem(c.Location, string(c.Config), nil)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", id, err)
+		}
+		queueItems = append(queueItems, queueItem)
+	}
+	_, err = os.Stat(filepath.Join(dir, "ingester0.fanout.b"))
+	if err != nil {
+		t.Errorf("expecting a directory per copy: %v", err)
+	}
+	_, err = NewQueueItem(config.Location, string(config.Config), nil)
+	if err == nil {
+		t.Errorf("expecting error sharing a disk queue dir")
+	}
+	for _, queueItem := range queueItems {
+		queueItem.release()
+	}
+	queueItem, err := NewQueueItem(config.Location, string(config.Config), nil)
+	if err != nil {
+		t.Fatalf("error reopening released queue: %v", err)
+	}
+	queueItem.release()
+
+	fifo := cfg.QueueItemCfg{Location: "builtin:fifo", Config: "fifo.json"}
+	c, err := queueCopy(fifo, "ingester0.merge")
+	if err != nil || c != fifo {
+		t.Errorf("expecting other queues unchanged, got %v (%v)", c, err)
+	}
+}
+
+func TestReservoirGraph(t *testing.T) {
+	queue := cfg.QueueItemCfg{Config: "queue"}
+	config := cfg.ReservoirCfg{
+		Name: "graph",
+		Graph: &cfg.GraphCfg{
+			Nodes: []cfg.NodeCfg{
+				{ID: "a", Kind: cfg.KindIngester, Config: cfg.Config(strconv.Itoa(100)), QueueItem: queue},
+				{ID: "b", Kind: cfg.KindIngester, Config: cfg.Config(strconv.Itoa(200)), QueueItem: queue},
+				{ID: "join", Kind: cfg.KindDigester, QueueItem: queue},
+				{ID: "split", Kind: cfg.KindDigester, QueueItem: queue},
+				{ID: "x", Kind: cfg.KindExpeller},
+				{ID: "y", Kind: cfg.KindExpeller},
+			},
+			Edges: []cfg.EdgeCfg{
+				{From: "split", To: "x"},
+				{From: "split", To: "y"},
+				{From: "a", To: "join"},
+				{From: "b", To: "join"},
+				{From: "join", To: "split"},
+				{From: "b", To: "y"},
+			},
+		},
+	}
+	reservoir, expellers := runFakeReservoir(t, config)
+	if expellers["x"].Len() != 300 {
+		t.Errorf("expecting 300 items expelled to x, got %d", expellers["x"].Len())
+	}
+	if expellers["y"].Len() != 500 {
+		t.Errorf("expecting 500 items expelled to y, got %d", expellers["y"].Len())
+	}
+	ids := make([]string, 0)
+	for n := range reservoir.Nodes {
+		ids = append(ids, reservoir.Nodes[n].ID)
+	}
+	expected := []string{"a", "b", "join", "split", "x", "y"}
+	if reflect.DeepEqual(ids, expected) == false {
+		t.Errorf("expecting order %v, got %v", expected, ids)
+	}
+	if reservoir.Nodes[2].MergeItem == nil {
+		t.Errorf("expecting join to merge")
+	}
+	if reservoir.Nodes[1].FanOutItem == nil || reservoir.Nodes[3].FanOutItem == nil {
+		t.Errorf("expecting b and split to fan out")
+	}
+
+	graph := reservoir.GetGraph(true)
+	if len(graph.Nodes) != 6 || graph.Nodes[2].Merge == false || graph.Nodes[2].Running == nil {
+		t.Errorf("expecting join to merge with running state, got %v", graph.Nodes[2])
+	}
+	if len(graph.Edges) != 6 || graph.Edges[2].QueueID != "b.fanout.y" || graph.Edges[2].Len == nil || *graph.Edges[2].Len != 0 {
+		t.Errorf("expecting empty fan-out queue from b to y, got %v", graph.Edges[2])
+	}
+	graph = reservoir.GetGraph(false)
+	if graph.Nodes[0].Running != nil || graph.Edges[0].Len != nil {
+		t.Errorf("expecting no running state or depths when stopped")
+	}
+}
+
+func TestReservoirMetricsDuringDrain(t *testing.T) {
+	config := cfg.ReservoirCfg{
+		Name: "scraped",
+		ExpellerItem: cfg.ExpellerItemCfg{
+			Location:      "expeller",
+			IngesterItems: []cfg.IngesterItemCfg{fakeChain("", 0)},
+		},
+	}
+	reservoir, _, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	// nothing runs so the drain polls the queue until the timeout
+	reservoir.Nodes[0].QueueItem().Queue.Put(0)
+	done := make(chan struct{})
+	scraped := make(chan struct{})
+	go func() {
+		defer close(scraped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, m := range reservoir.monitored() {
+				select {
+				case m.mc.StatsChan <- map[string]interface{}{"received": 1}:
+				default:
+				}
+			}
+			reservoir.GetMetrics()
+			reservoir.GetReservoir()
+			reservoir.Describe()
+		}
+	}()
+	reservoir.Drain(50 * time.Millisecond)
+	close(done)
+	<-scraped
+}
+
+// releasedQueue counts how many times it is released
+type releasedQueue struct {
+	*fakeQueue
+	released int
+}
+
+func (o *releasedQueue) Release() error {
+	o.released++
+	return nil
+}
+
+func TestReservoirReleaseOnce(t *testing.T) {
+	queue := cfg.QueueItemCfg{Config: "queue"}
+	config := cfg.ReservoirCfg{
+		Name: "failing",
+		Graph: &cfg.GraphCfg{
+			Nodes: []cfg.NodeCfg{
+				{ID: "a", Kind: cfg.KindIngester, Config: "0", QueueItem: queue},
+				{ID: "b", Kind: cfg.KindIngester, Config: "0", QueueItem: queue},
+				{ID: "join", Kind: cfg.KindDigester, QueueItem: queue},
+				{ID: "x", Kind: cfg.KindExpeller},
+				{ID: "y", Kind: cfg.KindExpeller},
+			},
+			Edges: []cfg.EdgeCfg{
+				{From: "a", To: "join"},
+				{From: "b", To: "join"},
+				{From: "b", To: "y"},
+				{From: "join", To: "x"},
+			},
+		},
+	}
+	builder := &fakeBuilder{expellers: make(map[string]*fakeExpeller)}
+	// the fan-out copies of b are built, the merge copy of join fails
+	copies := make([]*releasedQueue, 0)
+	newQueueItem := func(config cfg.QueueItemCfg) (*QueueItem, error) {
+		if len(copies) == 2 {
+			return nil, errors.New("no more queues")
+		}
+		q := &releasedQueue{fakeQueue: newFakeQueue(string(config.Config))}
+		copies = append(copies, q)
+		queueItem := newFakeQueueItem(q.name)
+		queueItem.Queue = q
+		return queueItem, nil
+	}
+	_, err := newReservoir(config, builder.newNode, newQueueItem)
+	if err == nil {
+		t.Fatalf("expecting error building the merge copy")
+	}
+	for c := range copies {
+		if copies[c].released != 1 {
+			t.Errorf("expecting copy %d released once, got %d", c, copies[c].released)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package run
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/reservoird/proxy"
 	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/sta"
+	"github.com/reservoird/reservoird/viz"
 )
 
 // Constants used for map index
@@ -16,12 +21,24 @@ const (
 	Expellers = 3
 )
 
+// ErrExists is returned when creating a reservoir whose name is in use
+var ErrExists = errors.New("already exists")
+
+// ErrNotFound is returned when a reservoir or one of its parts does not exist
+var ErrNotFound = errors.New("not found")
+
 // ReservoirMap contains all reservoirs
 type ReservoirMap struct {
 	Map      map[string]*Reservoir
 	Disposed map[string]bool
 	Stopped  map[string]bool
-	lock     *sync.Mutex
+	// DrainTimeout bounds how long a drain stop waits for queues to empty
+	DrainTimeout time.Duration
+	plugin       proxy.Plugin
+	stopping     map[string]bool
+	loaded       map[string]bool
+	lock         *sync.Mutex
+	reloadLock   *sync.Mutex
 }
 
 // NewReservoirMap setups the flow
@@ -33,19 +50,39 @@ func NewReservoirMap(
 	o.Map = make(map[string]*Reservoir)
 	o.Disposed = make(map[string]bool)
 	o.Stopped = make(map[string]bool)
+	o.DrainTimeout = DefaultDrainTimeout
+	o.plugin = plugin
+	o.stopping = make(map[string]bool)
+	o.loaded = make(map[string]bool)
 	o.lock = &sync.Mutex{}
+	o.reloadLock = &sync.Mutex{}
 	for r := range rsv.Reservoirs {
 		reservoir, err := NewReservoir(rsv.Reservoirs[r], plugin)
 		if err != nil {
+			o.close()
 			return nil, err
 		}
+		_, ok := o.Map[reservoir.Name]
+		if ok == true {
+			reservoir.Close()
+			o.close()
+			return nil, fmt.Errorf("%s: %w", reservoir.Name, ErrExists)
+		}
 		o.Map[reservoir.Name] = reservoir
 		o.Disposed[reservoir.Name] = false
 		o.Stopped[reservoir.Name] = true
+		o.loaded[reservoir.Name] = true
 	}
 	return o, nil
 }
 
+// close releases every reservoir of a map that failed to be set up
+func (o *ReservoirMap) close() {
+	for _, reservoir := range o.Map {
+		reservoir.Close()
+	}
+}
+
 // StartAll start system
 func (o *ReservoirMap) StartAll() {
 	o.lock.Lock()
@@ -81,17 +118,30 @@ func (o *ReservoirMap) UpdateFinalAll() {
 	}
 }
 
-// InitStopAll stops system
+// InitStopAll stops system, draining each reservoir. Reservoirs are marked
+// stopped under the lock and drained outside it.
 func (o *ReservoirMap) InitStopAll() {
 	o.lock.Lock()
-	defer o.lock.Unlock()
-
+	reservoirs := make([]*Reservoir, 0)
 	for name := range o.Map {
 		if o.Disposed[name] == false && o.Stopped[name] == false {
-			o.Map[name].InitStop()
+			reservoirs = append(reservoirs, o.Map[name])
 			o.Stopped[name] = true
+			o.stopping[name] = true
 		}
 	}
+	o.lock.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, reservoir := range reservoirs {
+		wg.Add(1)
+		go func(reservoir *Reservoir) {
+			defer wg.Done()
+			reservoir.Drain(o.DrainTimeout)
+			o.stopped(reservoir.Name)
+		}(reservoir)
+	}
+	wg.Wait()
 }
 
 // WaitAll waits
@@ -142,11 +192,14 @@ func (o *ReservoirMap) Start(name string) error {
 
 	reservoir, ok := o.Map[name]
 	if ok == false {
-		return fmt.Errorf("%s: no reservoir found", name)
+		return fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
 	}
 	if o.Disposed[name] == true {
 		return fmt.Errorf("%s: disposed", name)
 	}
+	if o.stopping[name] == true {
+		return fmt.Errorf("%s: stopping", name)
+	}
 	if o.Stopped[name] == false {
 		return fmt.Errorf("%s: already running", name)
 	}
@@ -165,33 +218,43 @@ func (o *ReservoirMap) UpdateFinal(name string) error {
 
 	reservoir, ok := o.Map[name]
 	if ok == false {
-		return fmt.Errorf("%s: no reservoir found", name)
+		return fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
 	}
 	reservoir.UpdateFinal()
 	return nil
 }
 
-// InitStop stop system
-func (o *ReservoirMap) InitStop(name string) error {
+// InitStop stop system. The reservoir is marked stopped under the lock and
+// stopped outside it, a drain may take up to the drain timeout.
+func (o *ReservoirMap) InitStop(name string, mode StopMode) error {
 	o.lock.Lock()
-	defer o.lock.Unlock()
-
 	reservoir, ok := o.Map[name]
 	if ok == false {
-		return fmt.Errorf("%s: no reservoir found", name)
+		o.lock.Unlock()
+		return fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
 	}
 	if o.Disposed[name] == true {
+		o.lock.Unlock()
 		return fmt.Errorf("%s: disposed", name)
 	}
 	if o.Stopped[name] == true {
+		o.lock.Unlock()
 		return fmt.Errorf("%s: already stopped", name)
 	}
-	err := reservoir.InitStop()
-	if err != nil {
-		return err
-	}
 	o.Stopped[name] = true
-	return nil
+	o.stopping[name] = true
+	o.lock.Unlock()
+
+	defer o.stopped(name)
+	return reservoir.InitStopMode(mode, o.DrainTimeout)
+}
+
+// stopped clears the stopping mark once a reservoir is stopped
+func (o *ReservoirMap) stopped(name string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(o.stopping, name)
 }
 
 // Wait waits
@@ -201,7 +264,7 @@ func (o *ReservoirMap) Wait(name string) error {
 
 	reservoir, ok := o.Map[name]
 	if ok == false {
-		return fmt.Errorf("%s: no reservoir found", name)
+		return fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
 	}
 	reservoir.Wait()
 	return nil
@@ -227,7 +290,7 @@ func (o *ReservoirMap) Stop(name string) error {
 
 	reservoir, ok := o.Map[name]
 	if ok == false {
-		return fmt.Errorf("%s: no reservoir found", name)
+		return fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
 	}
 	err := reservoir.InitStop()
 	if err != nil {
@@ -237,16 +300,76 @@ func (o *ReservoirMap) Stop(name string) error {
 	return nil
 }
 
-// Retrieve stop system
+// Retrieve brings back a disposed reservoir, stopped, rebuilt from its
+// config as disposing released it
 func (o *ReservoirMap) Retrieve(name string) error {
+	o.lock.Lock()
+	old, ok := o.Map[name]
+	disposed := o.Disposed[name]
+	o.lock.Unlock()
+	if ok == false {
+		return fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	if disposed == false {
+		return nil
+	}
+	reservoir, err := NewReservoir(old.config, o.plugin)
+	if err != nil {
+		return err
+	}
+
 	o.lock.Lock()
 	defer o.lock.Unlock()
 
-	_, ok := o.Map[name]
-	if ok == false {
-		return fmt.Errorf("%s: no reservoir found", name)
+	if o.Map[name] != old || o.Disposed[name] == false {
+		reservoir.Close()
+		return fmt.Errorf("%s: %w", name, ErrExists)
 	}
+	o.Map[name] = reservoir
 	o.Disposed[name] = false
+	o.Stopped[name] = true
+	return nil
+}
+
+// Create creates a new reservoir in the stopped state. A disposed reservoir
+// with the same name is replaced.
+func (o *ReservoirMap) Create(config cfg.ReservoirCfg) error {
+	if config.Name == "" {
+		return fmt.Errorf("reservoir name is required")
+	}
+	err := o.available(config.Name)
+	if err != nil {
+		return err
+	}
+	reservoir, err := NewReservoir(config, o.plugin)
+	if err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_, ok := o.Map[reservoir.Name]
+	if ok == true && o.Disposed[reservoir.Name] == false {
+		reservoir.Close()
+		return fmt.Errorf("%s: %w", reservoir.Name, ErrExists)
+	}
+	o.Map[reservoir.Name] = reservoir
+	o.Disposed[reservoir.Name] = false
+	o.Stopped[reservoir.Name] = true
+	delete(o.loaded, reservoir.Name)
+	return nil
+}
+
+// available checks whether a name can be used for a new reservoir
+func (o *ReservoirMap) available(name string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_, ok := o.Map[name]
+	if ok == true && o.Disposed[name] == false {
+		return fmt.Errorf("%s: %w", name, ErrExists)
+	}
 	return nil
 }
 
@@ -255,16 +378,17 @@ func (o *ReservoirMap) Dispose(name string) error {
 	o.lock.Lock()
 	defer o.lock.Unlock()
 
-	_, ok := o.Map[name]
+	reservoir, ok := o.Map[name]
 	if ok == false {
-		return fmt.Errorf("%s: no reservoir found", name)
+		return fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
 	}
 	if o.Disposed[name] == true {
 		return fmt.Errorf("%s: already disposed", name)
 	}
-	if o.Stopped[name] == false {
+	if o.Stopped[name] == false || o.stopping[name] == true {
 		return fmt.Errorf("%s: running", name)
 	}
+	reservoir.Close()
 	o.Disposed[name] = true
 	return nil
 }
@@ -302,6 +426,42 @@ func (o *ReservoirMap) GetReservoir(name string) ([]interface{}, bool, bool) {
 	return r, o.Stopped[name], o.Disposed[name]
 }
 
+// GetSupervisors gets the restart counts and last errors of a reservoir
+func (o *ReservoirMap) GetSupervisors(name string) []sta.SupervisorStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	reservoir, ok := o.Map[name]
+	if ok == false {
+		return nil
+	}
+	return reservoir.GetSupervisors()
+}
+
+// GetLatency gets the latency of a reservoir
+func (o *ReservoirMap) GetLatency(name string) (sta.ReservoirLatency, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	reservoir, ok := o.Map[name]
+	if ok == false || o.Disposed[name] == true {
+		return sta.ReservoirLatency{}, fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	return reservoir.GetLatency(), nil
+}
+
+// GetCounters gets what the host counted for the queues of a reservoir
+func (o *ReservoirMap) GetCounters(name string) []sta.QueueCounters {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	reservoir, ok := o.Map[name]
+	if ok == false {
+		return nil
+	}
+	return reservoir.GetCounters()
+}
+
 // GetFlows gets flows
 func (o *ReservoirMap) GetFlows() map[string][]string {
 	o.lock.Lock()
@@ -337,3 +497,199 @@ func (o *ReservoirMap) GetFlow(name string) []string {
 	}
 	return flow
 }
+
+// GetMetrics gets the metrics of every reservoir not disposed, sorted by name
+func (o *ReservoirMap) GetMetrics() []sta.ReservoirMetrics {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	names := make([]string, 0)
+	for name := range o.Map {
+		if o.Disposed[name] == false {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	metrics := make([]sta.ReservoirMetrics, 0)
+	for _, name := range names {
+		metrics = append(metrics, sta.ReservoirMetrics{
+			Name:       name,
+			Stopped:    o.Stopped[name],
+			EndToEnd:   o.Map[name].GetLatency().EndToEnd,
+			Components: o.Map[name].GetMetrics(),
+		})
+	}
+	return metrics
+}
+
+// deadLetterItem returns the dead-letter queue of a node
+func (o *ReservoirMap) deadLetterItem(name string, node string) (*Reservoir, *Node, error) {
+	reservoir, ok := o.Map[name]
+	if ok == false || o.Disposed[name] == true {
+		return nil, nil, fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	for _, n := range reservoir.Nodes {
+		if n.ID == node && n.DeadLetterItem != nil {
+			return reservoir, n, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%s: dead-letter queue of %s %w", name, node, ErrNotFound)
+}
+
+// GetDeadLetters gets up to count dead letters of a node leaving them queued,
+// all when count is negative
+func (o *ReservoirMap) GetDeadLetters(name string, node string, count int) ([]DeadLetter, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_, n, err := o.deadLetterItem(name, node)
+	if err != nil {
+		return nil, err
+	}
+	return n.DeadLetterItem.Peek(count)
+}
+
+// ReplayDeadLetters puts up to count dead letters of a node back onto the
+// queue the node receives from, all when count is negative. The reservoir
+// must be running, letters are put outside the lock as the queue may block.
+func (o *ReservoirMap) ReplayDeadLetters(name string, node string, count int) (int, error) {
+	o.lock.Lock()
+	_, n, err := o.deadLetterItem(name, node)
+	if err != nil {
+		o.lock.Unlock()
+		return 0, err
+	}
+	if o.Stopped[name] == true {
+		o.lock.Unlock()
+		return 0, fmt.Errorf("%s: stopped", name)
+	}
+	o.lock.Unlock()
+
+	return n.DeadLetterItem.Replay(n.rcvQueueItem().Queue, count)
+}
+
+// ClearDeadLetters removes every dead letter of a node
+func (o *ReservoirMap) ClearDeadLetters(name string, node string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_, n, err := o.deadLetterItem(name, node)
+	if err != nil {
+		return err
+	}
+	n.DeadLetterItem.Clear()
+	return nil
+}
+
+// GetQueues gets the queues between components of a reservoir in flow order
+func (o *ReservoirMap) GetQueues(name string) ([]sta.QueueStats, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	reservoir, ok := o.Map[name]
+	if ok == false || o.Disposed[name] == true {
+		return nil, fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	return reservoir.GetQueues(), nil
+}
+
+// Tap mirrors up to count messages put into a queue of a reservoir, one in
+// every so many. The queue is given by its position in flow order or by id.
+// The tap must be closed once done with.
+func (o *ReservoirMap) Tap(name string, index string, count int, every int) (*Tap, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	reservoir, ok := o.Map[name]
+	if ok == false || o.Disposed[name] == true {
+		return nil, fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	m, err := reservoir.queue(index)
+	if err != nil {
+		return nil, err
+	}
+	return m.queueItem.tap.tap(count, every), nil
+}
+
+// Inject puts messages into a queue of a running reservoir from outside the
+// flow, returning how many were put. The queue is given by its position in
+// flow order or by id. Blocking queues block until there is room.
+func (o *ReservoirMap) Inject(name string, index string, items []interface{}) (int, error) {
+	o.lock.Lock()
+	reservoir, ok := o.Map[name]
+	if ok == false || o.Disposed[name] == true {
+		o.lock.Unlock()
+		return 0, fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	if o.Stopped[name] == true {
+		o.lock.Unlock()
+		return 0, fmt.Errorf("%s: stopped", name)
+	}
+	m, err := reservoir.queue(index)
+	o.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range items {
+		err := m.queueItem.Inject(items[i])
+		if err != nil {
+			return i, fmt.Errorf("%s: %s: %v", name, m.id, err)
+		}
+	}
+	return len(items), nil
+}
+
+// GetGraph gets the topology of a reservoir, with running states and queue
+// depths when running
+func (o *ReservoirMap) GetGraph(name string) (viz.Graph, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	reservoir, ok := o.Map[name]
+	if ok == false || o.Disposed[name] == true {
+		return viz.Graph{}, fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	return reservoir.GetGraph(o.Stopped[name] == false), nil
+}
+
+// Describe describes a reservoir with its components
+func (o *ReservoirMap) Describe(name string) (sta.Reservoir, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	reservoir, ok := o.Map[name]
+	if ok == false || o.Disposed[name] == true {
+		return sta.Reservoir{}, fmt.Errorf("%s: reservoir %w", name, ErrNotFound)
+	}
+	return sta.Reservoir{
+		Name:       name,
+		Stopped:    o.Stopped[name],
+		Disposed:   o.Disposed[name],
+		EndToEnd:   reservoir.GetLatency().EndToEnd,
+		Components: reservoir.Describe(),
+	}, nil
+}
+
+// DescribeAll describes every reservoir not disposed, sorted by name
+func (o *ReservoirMap) DescribeAll() []sta.Reservoir {
+	o.lock.Lock()
+	names := make([]string, 0)
+	for name := range o.Map {
+		if o.Disposed[name] == false {
+			names = append(names, name)
+		}
+	}
+	o.lock.Unlock()
+	sort.Strings(names)
+
+	reservoirs := make([]sta.Reservoir, 0)
+	for _, name := range names {
+		reservoir, err := o.Describe(name)
+		if err == nil {
+			reservoirs = append(reservoirs, reservoir)
+		}
+	}
+	return reservoirs
+}
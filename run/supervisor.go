@@ -0,0 +1,288 @@
+package run
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/sta"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Restart policies
+const (
+	// RestartNever leaves a component stopped once it returns or panics
+	RestartNever = "never"
+	// RestartOnFailure restarts a component after it panics
+	RestartOnFailure = "on-failure"
+	// RestartAlways restarts a component whenever it returns without being
+	// asked to stop
+	RestartAlways = "always"
+)
+
+// Restart defaults
+const (
+	DefaultBackoff    = time.Second
+	DefaultMaxBackoff = time.Minute
+)
+
+// RestartPolicy determines when a supervised component is restarted. The
+// backoff doubles after each restart up to the maximum backoff, a maximum
+// of zero restarts means no limit.
+type RestartPolicy struct {
+	Policy      string
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	MaxRestarts int
+}
+
+// NewRestartPolicy creates a restart policy from config
+func NewRestartPolicy(config cfg.RestartCfg) (RestartPolicy, error) {
+	o := RestartPolicy{
+		Policy:      config.Policy,
+		Backoff:     DefaultBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		MaxRestarts: config.MaxRestarts,
+	}
+	switch o.Policy {
+	case "":
+		o.Policy = RestartNever
+	case RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return o, fmt.Errorf("%s: unknown restart policy, expecting never, on-failure or always", config.Policy)
+	}
+	var err error
+	if config.Backoff != "" {
+		o.Backoff, err = time.ParseDuration(config.Backoff)
+		if err != nil {
+			return o, err
+		}
+	}
+	if config.MaxBackoff != "" {
+		o.MaxBackoff, err = time.ParseDuration(config.MaxBackoff)
+		if err != nil {
+			return o, err
+		}
+	}
+	if o.MaxBackoff < o.Backoff {
+		o.MaxBackoff = o.Backoff
+	}
+	if o.MaxRestarts < 0 {
+		return o, fmt.Errorf("%d: max restarts cannot be negative", o.MaxRestarts)
+	}
+	return o, nil
+}
+
+// Supervisor runs a component, recovering panics and restarting the
+// component according to its restart policy
+type Supervisor struct {
+	Name      string
+	Policy    RestartPolicy
+	mc        *icd.MonitorControl
+	stopping  bool
+	stopChan  chan struct{}
+	exited    chan struct{}
+	restarts  int
+	panics    int
+	lastErr   error
+	lastStack string
+	lastTime  time.Time
+	lock      *sync.Mutex
+}
+
+// NewSupervisor creates a supervisor which never restarts
+func NewSupervisor(name string, mc *icd.MonitorControl) *Supervisor {
+	o := new(Supervisor)
+	o.Name = name
+	o.Policy = RestartPolicy{
+		Policy:     RestartNever,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+	o.mc = mc
+	o.stopping = false
+	o.stopChan = nil
+	o.exited = nil
+	o.lock = &sync.Mutex{}
+	return o
+}
+
+// Start runs fn in a goroutine, wg is done once fn is no longer restarted
+func (o *Supervisor) Start(wg *sync.WaitGroup, fn func()) {
+	o.lock.Lock()
+	o.stopping = false
+	o.stopChan = make(chan struct{})
+	o.exited = make(chan struct{})
+	o.lock.Unlock()
+
+	// discard a done or final stats left over from a previous run
+	select {
+	case <-o.mc.DoneChan:
+	default:
+	}
+	select {
+	case <-o.mc.FinalStatsChan:
+	default:
+	}
+
+	wg.Add(1)
+	go o.supervise(wg, fn)
+}
+
+// Stop marks the component as stopping and signals it to stop
+func (o *Supervisor) Stop() {
+	o.lock.Lock()
+	if o.stopping == false && o.stopChan != nil {
+		o.stopping = true
+		close(o.stopChan)
+	}
+	o.lock.Unlock()
+
+	select {
+	case o.mc.DoneChan <- struct{}{}:
+	default:
+	}
+}
+
+// Exited returns a channel closed once the component is no longer running
+// or restarting, nil when never started
+func (o *Supervisor) Exited() chan struct{} {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.exited
+}
+
+// Running returns whether the component is started and not exited
+func (o *Supervisor) Running() bool {
+	exited := o.Exited()
+	if exited == nil {
+		return false
+	}
+	select {
+	case <-exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// Stats returns the restart counts and last error
+func (o *Supervisor) Stats() sta.SupervisorStats {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	stats := sta.SupervisorStats{
+		Name:          o.Name,
+		Policy:        o.Policy.Policy,
+		Restarts:      o.restarts,
+		Panics:        o.panics,
+		LastStack:     o.lastStack,
+		LastErrorTime: o.lastTime,
+	}
+	if o.lastErr != nil {
+		stats.LastError = o.lastErr.Error()
+	}
+	return stats
+}
+
+// supervise runs fn until it is stopped or no longer restarted
+func (o *Supervisor) supervise(wg *sync.WaitGroup, fn func()) {
+	defer wg.Done()
+	defer func() {
+		// make sure a final stats is waiting for whoever collects it
+		select {
+		case o.mc.FinalStatsChan <- nil:
+		default:
+		}
+		close(o.exited)
+	}()
+
+	backoff := o.Policy.Backoff
+	for {
+		// each run gets its own wait group since every run calls done
+		attempt := &sync.WaitGroup{}
+		attempt.Add(1)
+		o.mc.WaitGroup = attempt
+
+		panicked := o.call(fn)
+
+		o.lock.Lock()
+		stopping := o.stopping
+		if stopping == false && panicked == false {
+			o.lastErr = fmt.Errorf("returned without being stopped")
+			o.lastStack = ""
+			o.lastTime = time.Now()
+		}
+		restart := stopping == false &&
+			(o.Policy.Policy == RestartAlways || (o.Policy.Policy == RestartOnFailure && panicked == true))
+		if restart == true && o.Policy.MaxRestarts > 0 && o.restarts >= o.Policy.MaxRestarts {
+			restart = false
+			log.WithFields(log.Fields{
+				"name":     o.Name,
+				"restarts": o.restarts,
+			}).Error("maximum restarts reached")
+		}
+		stopChan := o.stopChan
+		o.lock.Unlock()
+
+		if restart == false {
+			if stopping == false {
+				log.WithFields(log.Fields{
+					"name": o.Name,
+				}).Warn("component exited and will not be restarted")
+			}
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"name":    o.Name,
+			"backoff": backoff,
+		}).Warn("restarting component")
+		select {
+		case <-time.After(backoff):
+		case <-stopChan:
+			return
+		}
+		backoff = backoff * 2
+		if backoff > o.Policy.MaxBackoff {
+			backoff = o.Policy.MaxBackoff
+		}
+
+		// final stats from the previous run would block the next run
+		select {
+		case <-o.mc.FinalStatsChan:
+		default:
+		}
+		o.lock.Lock()
+		o.restarts = o.restarts + 1
+		o.lock.Unlock()
+	}
+}
+
+// call runs fn, recovering and recording a panic
+func (o *Supervisor) call(fn func()) (panicked bool) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			panicked = true
+			stack := string(debug.Stack())
+			o.lock.Lock()
+			o.panics = o.panics + 1
+			o.lastErr = fmt.Errorf("panic: %v", r)
+			o.lastStack = stack
+			o.lastTime = time.Now()
+			o.lock.Unlock()
+			log.WithFields(log.Fields{
+				"name":  o.Name,
+				"err":   r,
+				"stack": stack,
+			}).Error("recovered panic")
+		}
+	}()
+	fn()
+	return false
+}
@@ -0,0 +1,118 @@
+package run
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+func TestSupervisorNewRestartPolicy(t *testing.T) {
+	policy, err := NewRestartPolicy(cfg.RestartCfg{})
+	if err != nil || policy.Policy != RestartNever || policy.Backoff != DefaultBackoff {
+		t.Errorf("expecting never with default backoff, got %v (%v)", policy, err)
+	}
+	policy, err = NewRestartPolicy(cfg.RestartCfg{Policy: RestartAlways, Backoff: "2s", MaxBackoff: "1s"})
+	if err != nil || policy.Backoff != 2*time.Second || policy.MaxBackoff != 2*time.Second {
+		t.Errorf("expecting 2s backoffs, got %v (%v)", policy, err)
+	}
+	_, err = NewRestartPolicy(cfg.RestartCfg{Policy: "sometimes"})
+	if err == nil {
+		t.Errorf("expecting error for unknown policy")
+	}
+	_, err = NewRestartPolicy(cfg.RestartCfg{Backoff: "soon"})
+	if err == nil {
+		t.Errorf("expecting error for bad backoff")
+	}
+}
+
+func TestSupervisorNever(t *testing.T) {
+	mc := newFakeMonitorControl()
+	supervisor := NewSupervisor("never", mc)
+	wg := &sync.WaitGroup{}
+	supervisor.Start(wg, func() {
+		defer mc.WaitGroup.Done()
+		panic("boom")
+	})
+	wg.Wait()
+	stats := supervisor.Stats()
+	if stats.Panics != 1 || stats.Restarts != 0 || strings.Contains(stats.LastError, "boom") == false {
+		t.Errorf("expecting one recorded panic, got %v", stats)
+	}
+	if stats.LastStack == "" {
+		t.Errorf("expecting stack to be recorded")
+	}
+	if supervisor.Running() == true {
+		t.Errorf("expecting supervisor to have exited")
+	}
+	select {
+	case final := <-mc.FinalStatsChan:
+		if final != nil {
+			t.Errorf("expecting nil final stats, got %v", final)
+		}
+	default:
+		t.Errorf("expecting final stats after panic")
+	}
+}
+
+func TestSupervisorOnFailure(t *testing.T) {
+	mc := newFakeMonitorControl()
+	supervisor := NewSupervisor("onfailure", mc)
+	supervisor.Policy = RestartPolicy{
+		Policy:      RestartOnFailure,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		MaxRestarts: 3,
+	}
+	runs := int32(0)
+	wg := &sync.WaitGroup{}
+	supervisor.Start(wg, func() {
+		defer mc.WaitGroup.Done()
+		atomic.AddInt32(&runs, 1)
+		panic("boom")
+	})
+	wg.Wait()
+	if atomic.LoadInt32(&runs) != 4 {
+		t.Errorf("expecting 4 runs, got %d", runs)
+	}
+	stats := supervisor.Stats()
+	if stats.Restarts != 3 || stats.Panics != 4 {
+		t.Errorf("expecting 3 restarts and 4 panics, got %v", stats)
+	}
+}
+
+func TestSupervisorAlwaysStop(t *testing.T) {
+	mc := newFakeMonitorControl()
+	supervisor := NewSupervisor("always", mc)
+	supervisor.Policy = RestartPolicy{
+		Policy:     RestartAlways,
+		Backoff:    time.Millisecond,
+		MaxBackoff: time.Millisecond,
+	}
+	runs := int32(0)
+	wg := &sync.WaitGroup{}
+	supervisor.Start(wg, func() {
+		defer mc.WaitGroup.Done()
+		if atomic.AddInt32(&runs, 1) < 3 {
+			return
+		}
+		<-mc.DoneChan
+		mc.FinalStatsChan <- "final"
+	})
+	for atomic.LoadInt32(&runs) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	supervisor.Stop()
+	wg.Wait()
+	stats := supervisor.Stats()
+	if stats.Restarts != 2 || stats.Panics != 0 {
+		t.Errorf("expecting 2 restarts without panics, got %v", stats)
+	}
+	final := <-mc.FinalStatsChan
+	if final != "final" {
+		t.Errorf("expecting final stats from last run, got %v", final)
+	}
+}
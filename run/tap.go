@@ -0,0 +1,149 @@
+package run
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/reservoird/env"
+)
+
+// DefaultTapBuffer is the number of mirrored messages a tap holds before
+// further ones are skipped
+const DefaultTapBuffer = 1024
+
+// Tap receives copies of the messages put into a queue. Count is how many
+// messages are left to mirror, negative for no limit, every mirrors one
+// message in every so many. Items is closed once count messages have been
+// mirrored or the tap is removed. A tap never blocks the queue, messages
+// arriving while Items is full are skipped and counted, skipped comes first
+// to be 64-bit aligned for atomic use on 32-bit platforms.
+type Tap struct {
+	skipped uint64
+	Items   chan interface{}
+	queue   *tapQueue
+	count   int
+	every   int
+	seen    int
+}
+
+// Skipped returns how many sampled messages were skipped because the
+// reader fell behind
+func (o *Tap) Skipped() uint64 {
+	return atomic.LoadUint64(&o.skipped)
+}
+
+// Close removes the tap from its queue
+func (o *Tap) Close() {
+	o.queue.untap(o)
+}
+
+// tapQueue mirrors successful puts of a queue to its taps
+type tapQueue struct {
+	icd.Queue
+	taps map[*Tap]bool
+	lock sync.Mutex
+}
+
+// newTapQueue wraps a queue so it can be tapped
+func newTapQueue(queue icd.Queue) *tapQueue {
+	o := new(tapQueue)
+	o.Queue = queue
+	o.taps = make(map[*Tap]bool)
+	return o
+}
+
+// mirrored returns a copy of an item for taps, taken before the item is put
+// as whatever gets it may modify it while taps marshal it. Envelopes and
+// byte slices are copied, other items are shared.
+func mirrored(item interface{}) interface{} {
+	switch v := item.(type) {
+	case *env.Envelope:
+		if v != nil {
+			return v.Clone()
+		}
+	case []byte:
+		return append([]byte(nil), v...)
+	}
+	return item
+}
+
+// Put puts into the wrapped queue and mirrors a copy of the item on success
+func (o *tapQueue) Put(item interface{}) error {
+	o.lock.Lock()
+	tapped := len(o.taps) > 0
+	o.lock.Unlock()
+	mirror := item
+	if tapped == true {
+		mirror = mirrored(item)
+	}
+	err := o.Queue.Put(item)
+	if err != nil {
+		return err
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for tap := range o.taps {
+		tap.seen++
+		if tap.seen%tap.every != 0 {
+			continue
+		}
+		select {
+		case tap.Items <- mirror:
+		default:
+			atomic.AddUint64(&tap.skipped, 1)
+			continue
+		}
+		if tap.count > 0 {
+			tap.count--
+			if tap.count == 0 {
+				delete(o.taps, tap)
+				close(tap.Items)
+			}
+		}
+	}
+	return nil
+}
+
+// tap adds a tap mirroring count messages, one in every
+func (o *tapQueue) tap(count int, every int) *Tap {
+	if every < 1 {
+		every = 1
+	}
+	size := DefaultTapBuffer
+	if count > 0 && count < size {
+		size = count
+	}
+	tap := &Tap{
+		Items: make(chan interface{}, size),
+		queue: o,
+		count: count,
+		every: every,
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if count == 0 {
+		close(tap.Items)
+		return tap
+	}
+	o.taps[tap] = true
+	return tap
+}
+
+// untap removes a tap, closing its items
+func (o *tapQueue) untap(tap *Tap) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	_, ok := o.taps[tap]
+	if ok == true {
+		delete(o.taps, tap)
+		close(tap.Items)
+	}
+}
+
+// tapped returns the number of taps
+func (o *tapQueue) tapped() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.taps)
+}
@@ -0,0 +1,121 @@
+package run
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/env"
+)
+
+func TestTapQueue(t *testing.T) {
+	queue := newTapQueue(newFakeQueue("tapped"))
+	sampled := queue.tap(2, 3)
+	all := queue.tap(-1, 1)
+	for i := 0; i < 9; i++ {
+		queue.Put(i)
+	}
+	items := make([]interface{}, 0)
+	for item := range sampled.Items {
+		items = append(items, item)
+	}
+	if reflect.DeepEqual(items, []interface{}{2, 5}) == false {
+		t.Errorf("expecting every third item twice, got %v", items)
+	}
+	if queue.tapped() != 1 || len(all.Items) != 9 || queue.Len() != 9 {
+		t.Errorf("expecting 1 tap with 9 mirrored items, got %d taps %d items", queue.tapped(), len(all.Items))
+	}
+	all.Close()
+	if queue.tapped() != 0 {
+		t.Errorf("expecting no taps after close")
+	}
+
+	full := queue.tap(-1, 1)
+	for i := 0; i < DefaultTapBuffer+5; i++ {
+		queue.Put(i)
+	}
+	if full.Skipped() != 5 {
+		t.Errorf("expecting 5 skipped, got %d", full.Skipped())
+	}
+}
+
+func TestTapQueueMirrorsCopies(t *testing.T) {
+	queue := newTapQueue(newFakeQueue("tapped"))
+	tap := queue.tap(2, 1)
+	e := env.New("payload")
+	e.Set("key", "before")
+	b := []byte("before")
+	queue.Put(e)
+	queue.Put(b)
+	e.Set("key", "after")
+	copy(b, "after!")
+	mirror, ok := (<-tap.Items).(*env.Envelope)
+	if ok == false || mirror == e || mirror.Get("key") != "before" {
+		t.Errorf("expecting a copy of the envelope, got %v", mirror)
+	}
+	if string((<-tap.Items).([]byte)) != "before" {
+		t.Errorf("expecting a copy of the bytes")
+	}
+}
+
+func TestReservoirMapTapInject(t *testing.T) {
+	config := cfg.ReservoirCfg{
+		Name:          "tap",
+		IngesterItems: []cfg.IngesterItemCfg{fakeChain("", 100)},
+		ExpellerItems: []cfg.ExpellerItemCfg{{}},
+	}
+	reservoir, expellers, err := newFakeReservoir(config)
+	if err != nil {
+		t.Fatalf("error creating: %v", err)
+	}
+	reservoirMap, _ := NewReservoirMap(cfg.Cfg{}, nil)
+	reservoirMap.Map[reservoir.Name] = reservoir
+	reservoirMap.Disposed[reservoir.Name] = false
+	reservoirMap.Stopped[reservoir.Name] = true
+
+	queues, _ := reservoirMap.GetQueues("tap")
+	if len(queues) != 2 || queues[1].ID != "ingester0.digester0.queue" || queues[1].Name != "digestqueue" {
+		t.Fatalf("expecting ingester and digester queues, got %v", queues)
+	}
+	_, err = reservoirMap.Tap("tap", "2", 1, 1)
+	if errors.Is(err, ErrNotFound) == false {
+		t.Errorf("expecting queue not found, got %v", err)
+	}
+	tap, err := reservoirMap.Tap("tap", "ingester0.digester0.queue", 3, 1)
+	if err != nil {
+		t.Fatalf("error tapping: %v", err)
+	}
+	defer tap.Close()
+
+	reservoirMap.Start("tap")
+	items := make([]interface{}, 0)
+	for item := range tap.Items {
+		items = append(items, item)
+	}
+	if reflect.DeepEqual(items, []interface{}{0, 1, 2}) == false {
+		t.Errorf("expecting first 3 items, got %v", items)
+	}
+
+	injected, err := reservoirMap.Inject("tap", "0", []interface{}{100, 101})
+	if err != nil || injected != 2 {
+		t.Errorf("expecting 2 injected, got %d (%v)", injected, err)
+	}
+	queues, _ = reservoirMap.GetQueues("tap")
+	if queues[0].Injected != 2 || queues[1].Injected != 0 {
+		t.Errorf("expecting 2 injected into the ingester queue, got %v", queues)
+	}
+
+	reservoir.Drain(5 * time.Second)
+	reservoir.UpdateFinal()
+	reservoir.Wait()
+	if expellers["expeller0"].Len() != 102 {
+		t.Errorf("expecting 102 items expelled, got %d", expellers["expeller0"].Len())
+	}
+	reservoirMap.Stopped["tap"] = true
+	_, err = reservoirMap.Inject("tap", "0", []interface{}{102})
+	if err == nil {
+		t.Errorf("expecting error injecting into stopped reservoir")
+	}
+}
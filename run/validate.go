@@ -0,0 +1,204 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reservoird/icd"
+	"github.com/reservoird/proxy"
+	"github.com/reservoird/reservoird/cfg"
+)
+
+// Problem is one issue found validating a config
+type Problem struct {
+	Reservoir string `json:"reservoir"`
+	Node      string `json:"node,omitempty"`
+	Field     string `json:"field"`
+	Message   string `json:"message"`
+}
+
+// String returns the problem on one line
+func (o Problem) String() string {
+	where := o.Reservoir
+	if o.Node != "" {
+		where = where + "/" + o.Node
+	}
+	return fmt.Sprintf("%s %s: %s", where, o.Field, o.Message)
+}
+
+// newSignatures are the expected New functions by kind
+var newSignatures = map[string]string{
+	cfg.KindIngester: "func(string) (icd.Ingester, error)",
+	cfg.KindDigester: "func(string) (icd.Digester, error)",
+	cfg.KindExpeller: "func(string) (icd.Expeller, error)",
+	KindQueue:        "func(string) (icd.Queue, error)",
+}
+
+// Validate checks a config without running it and returns every problem
+// found. Plugins are opened to check their New function, only .so queues
+// are created to check their name follows the nb convention.
+func Validate(config cfg.Cfg, plugin proxy.Plugin) []Problem {
+	problems := make([]Problem, 0)
+	names := make(map[string]int)
+	for r := range config.Reservoirs {
+		reservoir := config.Reservoirs[r]
+		name := reservoir.Name
+		if name == "" {
+			name = fmt.Sprintf("reservoirs[%d]", r)
+			problems = append(problems, Problem{Reservoir: name, Field: "name", Message: "name is required"})
+		} else {
+			prev, ok := names[name]
+			if ok == true {
+				problems = append(problems, Problem{
+					Reservoir: name,
+					Field:     "name",
+					Message:   fmt.Sprintf("duplicate of reservoirs[%d]", prev),
+				})
+			} else {
+				names[name] = r
+			}
+		}
+		graph, err := reservoir.ToGraph()
+		if err != nil {
+			problems = append(problems, Problem{Reservoir: name, Field: "graph", Message: err.Error()})
+			continue
+		}
+		err = graph.Validate()
+		if err != nil {
+			problems = append(problems, Problem{Reservoir: name, Field: "graph", Message: err.Error()})
+		}
+		for n := range graph.Nodes {
+			problems = append(problems, validateNode(name, graph.Nodes[n], plugin)...)
+		}
+	}
+	return problems
+}
+
+// validateNode checks the plugin, queue, dead-letter queue and delivery of a
+// node
+func validateNode(name string, node cfg.NodeCfg, plugin proxy.Plugin) []Problem {
+	problems := make([]Problem, 0)
+	add := func(field string, err error) {
+		if err != nil {
+			problems = append(problems, Problem{Reservoir: name, Node: node.ID, Field: field, Message: err.Error()})
+		}
+	}
+	add("location", validateLocation(node.Location, node.Kind, plugin))
+	add("config", validateConfig(node.Config))
+	_, err := NewRestartPolicy(node.Restart)
+	add("restart", err)
+	if node.Delivery != nil {
+		_, err = NewDeliveryPolicy(*node.Delivery)
+		add("delivery", err)
+	}
+	if node.DeadLetter != nil {
+		add("deadLetter.location", validateLocation(node.DeadLetter.Location, KindQueue, plugin))
+		add("deadLetter.config", validateConfig(node.DeadLetter.Config))
+	}
+	if node.Kind == cfg.KindExpeller {
+		return problems
+	}
+	err = validateLocation(node.QueueItem.Location, KindQueue, plugin)
+	add("queue.location", err)
+	add("queue.config", validateConfig(node.QueueItem.Config))
+	if err == nil {
+		add("queue.location", validateQueueName(node.QueueItem.Location, node.QueueItem.Config, plugin))
+	}
+	return problems
+}
+
+// validateLocation checks a location exists and provides New for the kind
+func validateLocation(loc string, kind string, plugin proxy.Plugin) error {
+	if loc == "" {
+		return fmt.Errorf("location is required")
+	}
+	if strings.HasPrefix(loc, ExecScheme) == true {
+		path := strings.TrimPrefix(loc, ExecScheme)
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() == true || info.Mode()&0111 == 0 {
+			return fmt.Errorf("%s: not an executable file", path)
+		}
+		return nil
+	}
+	if strings.HasPrefix(loc, BuiltinScheme) == false {
+		f, err := os.Open(loc)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	symbol, err := lookupNew(loc, kind, plugin)
+	if err != nil {
+		return err
+	}
+	ok := false
+	switch kind {
+	case cfg.KindIngester:
+		_, ok = symbol.(func(string) (icd.Ingester, error))
+	case cfg.KindDigester:
+		_, ok = symbol.(func(string) (icd.Digester, error))
+	case cfg.KindExpeller:
+		_, ok = symbol.(func(string) (icd.Expeller, error))
+	case KindQueue:
+		_, ok = symbol.(func(string) (icd.Queue, error))
+	}
+	if ok == false {
+		return fmt.Errorf("New is %T, expecting %s", symbol, newSignatures[kind])
+	}
+	return nil
+}
+
+// validateConfig checks a config file is readable or inline json is valid,
+// no config is allowed
+func validateConfig(config cfg.Config) error {
+	if config == "" {
+		return nil
+	}
+	if config.Inline() == true {
+		if json.Valid([]byte(config)) == false {
+			return fmt.Errorf("inline config is not valid json")
+		}
+		return nil
+	}
+	f, err := os.Open(string(config))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// validateQueueName checks a .so queue and its location agree on ending
+// with nb for non-blocking queues
+func validateQueueName(loc string, config cfg.Config, plugin proxy.Plugin) error {
+	if strings.HasPrefix(loc, BuiltinScheme) == true || strings.HasPrefix(loc, ExecScheme) == true {
+		return nil
+	}
+	symbol, err := lookupNew(loc, KindQueue, plugin)
+	if err != nil {
+		return err
+	}
+	var queue icd.Queue
+	err = config.WithPath(func(path string) error {
+		queue, err = symbol.(func(string) (icd.Queue, error))(path)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("New: %v", err)
+	}
+	base := strings.TrimSuffix(filepath.Base(loc), filepath.Ext(loc))
+	if nbMismatch(base, queue.Name()) == true {
+		return fmt.Errorf("queue %s and location %s disagree on the nb suffix of non-blocking queues", queue.Name(), base)
+	}
+	return nil
+}
+
+// nbMismatch returns whether only one of the names ends with nb
+func nbMismatch(loc string, name string) bool {
+	return strings.HasSuffix(loc, "nb") != strings.HasSuffix(name, "nb")
+}
@@ -0,0 +1,96 @@
+package run
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(config, []byte("{}"), 0644)
+
+	queue := cfg.QueueItemCfg{Location: "builtin:test.queue"}
+	good := cfg.ReservoirCfg{
+		Name: "good",
+		ExpellerItem: cfg.ExpellerItemCfg{
+			Location: "builtin:test.expeller",
+			Config:   cfg.Config(config),
+			IngesterItems: []cfg.IngesterItemCfg{
+				{Location: "builtin:test.ingester", QueueItem: queue},
+			},
+		},
+	}
+	problems := Validate(cfg.Cfg{Reservoirs: []cfg.ReservoirCfg{good}}, nil)
+	if len(problems) != 0 {
+		t.Fatalf("expecting no problems, got %v", problems)
+	}
+
+	bad := cfg.ReservoirCfg{
+		Name: "bad",
+		ExpellerItem: cfg.ExpellerItemCfg{
+			Location: "exec:/nonexistent/expeller",
+			IngesterItems: []cfg.IngesterItemCfg{
+				{
+					Location:  "builtin:test.queue",
+					Config:    "/nonexistent/config.json",
+					QueueItem: cfg.QueueItemCfg{Location: "/nonexistent/fifo.so"},
+					Restart:   cfg.RestartCfg{Policy: "sometimes"},
+				},
+			},
+		},
+	}
+	problems = Validate(cfg.Cfg{Reservoirs: []cfg.ReservoirCfg{good, good, bad, {Name: "empty"}}}, nil)
+	expected := []string{
+		"good name: duplicate of reservoirs[0]",
+		"bad/ingester0 location: New is func(string) (icd.Queue, error), expecting func(string) (icd.Ingester, error)",
+		"bad/ingester0 config: open /nonexistent/config.json",
+		"bad/ingester0 restart: sometimes",
+		"bad/ingester0 queue.location: open /nonexistent/fifo.so",
+		"bad/expeller0 location: stat /nonexistent/expeller",
+		"empty graph: empty: no expeller found",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expecting %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for p := range expected {
+		if strings.HasPrefix(problems[p].String(), expected[p]) == false {
+			t.Errorf("expecting %q, got %q", expected[p], problems[p].String())
+		}
+	}
+}
+
+func TestValidateNBMismatch(t *testing.T) {
+	if nbMismatch("fifonb", "com.github.reservoird.fifonb") == true {
+		t.Errorf("expecting matching nb names")
+	}
+	if nbMismatch("fifo", "com.github.reservoird.fifonb") == false {
+		t.Errorf("expecting mismatched nb names")
+	}
+}
+
+func TestReservoirMapDuplicate(t *testing.T) {
+	queue := cfg.QueueItemCfg{Location: "builtin:test.queue", Config: "queue"}
+	reservoir := cfg.ReservoirCfg{
+		Name: "dup",
+		ExpellerItem: cfg.ExpellerItemCfg{
+			Location: "builtin:test.expeller",
+			IngesterItems: []cfg.IngesterItemCfg{
+				{Location: "builtin:test.ingester", QueueItem: queue},
+			},
+		},
+	}
+	_, err := NewReservoirMap(cfg.Cfg{Reservoirs: []cfg.ReservoirCfg{reservoir, reservoir}}, nil)
+	if err == nil {
+		t.Errorf("expecting error for duplicate reservoir names")
+	}
+}
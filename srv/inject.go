@@ -0,0 +1,165 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/reservoird/reservoird/env"
+	"github.com/reservoird/reservoird/ipc"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxInjectSize is the largest request body accepted for injecting
+const MaxInjectSize = 16 << 20
+
+// Message types accepted for injecting, value is the encoding used by taps
+// and envelope a json envelope
+const (
+	InjectBytes    = "bytes"
+	InjectString   = "string"
+	InjectJSON     = "json"
+	InjectValue    = "value"
+	InjectEnvelope = "envelope"
+)
+
+// authorized checks the bearer token of a request against the inject token,
+// injecting is refused when no token is set. The Bearer scheme is required,
+// case insensitively.
+func (o *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if o.InjectToken == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "injecting is disabled without an inject token\n")
+		return false
+	}
+	scheme, token := "", ""
+	fields := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(fields) == 2 {
+		scheme, token = fields[0], fields[1]
+	}
+	if strings.EqualFold(scheme, "Bearer") == false ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(o.InjectToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "invalid inject token\n")
+		return false
+	}
+	return true
+}
+
+// decodeMessage decodes one message of the given type
+func decodeMessage(data []byte, kind string) (interface{}, error) {
+	switch kind {
+	case InjectBytes:
+		return data, nil
+	case InjectString:
+		return string(data), nil
+	case InjectJSON:
+		var item interface{}
+		err := json.Unmarshal(data, &item)
+		return item, err
+	case InjectValue:
+		value := ipc.Value{}
+		err := json.Unmarshal(data, &value)
+		if err != nil {
+			return nil, err
+		}
+		return value.Decode()
+	case InjectEnvelope:
+		e := new(env.Envelope)
+		err := json.Unmarshal(data, e)
+		if err != nil {
+			return nil, err
+		}
+		e.Stamp(time.Now())
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown type %s, expecting bytes, string, json, value or envelope", kind)
+}
+
+// decodeMessages decodes the body as one message or, for ndjson, one
+// message per non-empty line
+func decodeMessages(body []byte, ndjson bool, kind string) ([]interface{}, error) {
+	if ndjson == false {
+		item, err := decodeMessage(body, kind)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{item}, nil
+	}
+	items := make([]interface{}, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), MaxInjectSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		item, err := decodeMessage(append([]byte(nil), data...), kind)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// InjectMessages puts the request body into a queue of a running reservoir,
+// as one message or one per line for ndjson
+func (o *Server) InjectMessages(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	if o.authorized(w, r) == false {
+		return
+	}
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = InjectBytes
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ndjson := mediaType == "application/x-ndjson" || mediaType == "application/ndjson"
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxInjectSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	items, err := decodeMessages(body, ndjson, kind)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+
+	rname := p.ByName("rname")
+	injected, err := o.reservoirMap.Inject(rname, p.ByName("index"), items)
+	log.WithFields(log.Fields{
+		"addr":      r.RemoteAddr,
+		"reservoir": rname,
+		"queue":     p.ByName("index"),
+		"injected":  injected,
+	}).Info("injected messages")
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprintf(w, "%v (injected %d)\n", err, injected)
+	} else {
+		fmt.Fprintf(w, "%s: injected %d messages\n", rname, injected)
+	}
+}
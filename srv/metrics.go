@@ -0,0 +1,472 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/reservoird/reservoird/run"
+	"github.com/reservoird/reservoird/sta"
+)
+
+// Prometheus metric types
+const (
+	gauge   = "gauge"
+	counter = "counter"
+	untyped = "untyped"
+	summary = "summary"
+)
+
+// metricFamily contains the samples sharing a metric name
+type metricFamily struct {
+	help    string
+	typ     string
+	samples []string
+}
+
+// metricSet collects samples for the prometheus text exposition format
+type metricSet struct {
+	families map[string]*metricFamily
+}
+
+// newMetricSet creates an empty set of metrics
+func newMetricSet() *metricSet {
+	o := new(metricSet)
+	o.families = make(map[string]*metricFamily)
+	return o
+}
+
+// add adds a sample, labels are given as name value pairs
+func (o *metricSet) add(name string, typ string, help string, value float64, labels ...string) {
+	o.addTo(name, name, typ, help, value, labels...)
+}
+
+// addTo adds a sample to the family of another name, such as the _sum and
+// _count samples of a summary
+func (o *metricSet) addTo(family string, name string, typ string, help string, value float64, labels ...string) {
+	o.sample(o.family(family, typ, help), name, value, labels)
+}
+
+// family returns a family, creating it when missing
+func (o *metricSet) family(name string, typ string, help string) *metricFamily {
+	family, ok := o.families[name]
+	if ok == false {
+		family = &metricFamily{
+			help:    help,
+			typ:     typ,
+			samples: make([]string, 0),
+		}
+		o.families[name] = family
+	}
+	return family
+}
+
+// sample adds a sample to a family
+func (o *metricSet) sample(family *metricFamily, name string, value float64, labels []string) {
+	b := strings.Builder{}
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for l := 0; l+1 < len(labels); l = l + 2 {
+			if l > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(labels[l])
+			b.WriteString("=\"")
+			b.WriteString(escapeLabel(labels[l+1]))
+			b.WriteString("\"")
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(" ")
+	b.WriteString(formatValue(value))
+	family.samples = append(family.samples, b.String())
+}
+
+// write writes every family sorted by name
+func (o *metricSet) write(w io.Writer) error {
+	names := make([]string, 0)
+	for name := range o.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := o.families[name]
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.typ)
+		if err != nil {
+			return err
+		}
+		for s := range family.samples {
+			_, err = fmt.Fprintf(w, "%s\n", family.samples[s])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// escapeLabel escapes a label value
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+// formatValue formats a sample value
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// boolValue converts a bool into a sample value
+func boolValue(value bool) float64 {
+	if value == true {
+		return 1
+	}
+	return 0
+}
+
+// metricName converts a field name such as messagesReceived or
+// MessagesReceived into messages_received
+func metricName(name string) string {
+	b := strings.Builder{}
+	runes := []rune(name)
+	for r := range runes {
+		c := runes[r]
+		switch {
+		case unicode.IsUpper(c):
+			lower := r+1 < len(runes) && unicode.IsLower(runes[r+1])
+			if r > 0 && (unicode.IsUpper(runes[r-1]) == false || lower == true) && runes[r-1] != '_' {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(c))
+		case c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)):
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// joinName joins a metric name prefix and suffix
+func joinName(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// flatten walks a value calling fn for every numeric or boolean field with
+// the snake case path of the field. Json field names are used when given,
+// times and durations are converted to seconds and slices are skipped.
+func flatten(prefix string, v reflect.Value, fn func(string, float64)) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() == false {
+			flatten(prefix, v.Elem(), fn)
+		}
+	case reflect.Struct:
+		if v.Type() == timeType {
+			t := v.Interface().(time.Time)
+			if t.IsZero() == false {
+				fn(joinName(prefix, "timestamp_seconds"), float64(t.UnixNano())/1e9)
+			}
+			return
+		}
+		for f := 0; f < v.NumField(); f++ {
+			field := v.Type().Field(f)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			flatten(joinName(prefix, metricName(name)), v.Field(f), fn)
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return
+		}
+		keys := make([]string, 0)
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flatten(joinName(prefix, metricName(key)), v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())), fn)
+		}
+	case reflect.Bool:
+		fn(prefix, boolValue(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == durationType {
+			fn(joinName(prefix, "seconds"), time.Duration(v.Int()).Seconds())
+			return
+		}
+		fn(prefix, float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fn(prefix, float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		fn(prefix, v.Float())
+	}
+}
+
+// addReservoirMetrics adds the metrics of each reservoir and its components
+func addReservoirMetrics(set *metricSet, reservoirs []sta.ReservoirMetrics) {
+	for _, reservoir := range reservoirs {
+		set.add("reservoird_reservoir_running", gauge,
+			"Whether the reservoir is running.",
+			boolValue(reservoir.Stopped == false),
+			"reservoir", reservoir.Name,
+		)
+		addLatency(set, "reservoird_reservoir_latency",
+			"Time from ingest to expel.",
+			reservoir.EndToEnd, []string{"reservoir", reservoir.Name},
+		)
+		for _, c := range reservoir.Components {
+			labels := []string{
+				"reservoir", reservoir.Name,
+				"id", c.ID,
+				"kind", c.Kind,
+				"component", c.Name,
+			}
+			set.add("reservoird_component_running", gauge,
+				"Whether the component is running.",
+				boolValue(c.Running), labels...,
+			)
+			if c.Updated.IsZero() == false {
+				set.add("reservoird_component_stats_timestamp_seconds", gauge,
+					"When the component last reported stats.",
+					float64(c.Updated.UnixNano())/1e9, labels...,
+				)
+			}
+			set.add("reservoird_component_restarts_total", counter,
+				"Number of times the component was restarted.",
+				float64(c.Supervisor.Restarts), labels...,
+			)
+			set.add("reservoird_component_panics_total", counter,
+				"Number of panics recovered from the component.",
+				float64(c.Supervisor.Panics), labels...,
+			)
+			if c.Supervisor.LastErrorTime.IsZero() == false {
+				set.add("reservoird_component_last_error_timestamp_seconds", gauge,
+					"When the component last panicked or exited unexpectedly.",
+					float64(c.Supervisor.LastErrorTime.UnixNano())/1e9, labels...,
+				)
+			}
+			if c.Delivery != nil {
+				addDelivery(set, *c.Delivery, labels)
+			}
+			if c.Kind == run.KindQueue {
+				set.add("reservoird_queue_length", gauge,
+					"Number of messages in the queue.",
+					float64(c.Len), labels...,
+				)
+				set.add("reservoird_queue_capacity", gauge,
+					"Maximum number of messages the queue holds, -1 when unbounded.",
+					float64(c.Cap), labels...,
+				)
+				set.add("reservoird_queue_injected_total", counter,
+					"Number of messages injected through the rest interface.",
+					float64(c.Injected), labels...,
+				)
+			}
+			if c.Counters != nil {
+				addQueueCounters(set, *c.Counters, labels)
+			}
+			if c.Latency != nil {
+				addLatency(set, "reservoird_queue_hop_latency",
+					"Time messages spent in the queue.",
+					c.Latency.Hop, labels,
+				)
+				addLatency(set, "reservoird_queue_age_latency",
+					"Time since messages were ingested when got from the queue.",
+					c.Latency.Age, labels,
+				)
+			}
+			n := c.Normalized
+			set.add("reservoird_component_messages_received_total", counter,
+				"Number of messages the component reported receiving.",
+				float64(n.MessagesReceived), labels...,
+			)
+			set.add("reservoird_component_messages_sent_total", counter,
+				"Number of messages the component reported sending.",
+				float64(n.MessagesSent), labels...,
+			)
+			set.add("reservoird_component_messages_dropped_total", counter,
+				"Number of messages the component reported dropping.",
+				float64(n.MessagesDropped), labels...,
+			)
+			set.add("reservoird_component_bytes_received_total", counter,
+				"Number of bytes the component reported receiving.",
+				float64(n.BytesReceived), labels...,
+			)
+			set.add("reservoird_component_bytes_sent_total", counter,
+				"Number of bytes the component reported sending.",
+				float64(n.BytesSent), labels...,
+			)
+			set.add("reservoird_component_errors_total", counter,
+				"Number of errors the component reported.",
+				float64(n.Errors), labels...,
+			)
+			if n.LastActivity.IsZero() == false {
+				set.add("reservoird_component_last_activity_timestamp_seconds", gauge,
+					"When the component last reported handling a message.",
+					float64(n.LastActivity.UnixNano())/1e9, labels...,
+				)
+			}
+			flatten("", reflect.ValueOf(c.Stats), func(name string, value float64) {
+				if name == "" {
+					name = "value"
+				}
+				set.add("reservoird_stats_"+name, untyped,
+					"Field reported in the component stats.",
+					value, labels...,
+				)
+			})
+		}
+	}
+}
+
+// addLatency adds a latency as a summary in seconds, the maximum is set as
+// quantile 1
+func addLatency(set *metricSet, name string, help string, l sta.Latency, labels []string) {
+	family := name + "_seconds"
+	quantiles := []struct {
+		q string
+		d time.Duration
+	}{{"0.5", l.P50}, {"0.9", l.P90}, {"0.99", l.P99}, {"1", l.Max}}
+	for _, quantile := range quantiles {
+		set.add(family, summary, help,
+			quantile.d.Seconds(), append(labels[:len(labels):len(labels)], "quantile", quantile.q)...,
+		)
+	}
+	set.addTo(family, family+"_sum", summary, help, l.Sum.Seconds(), labels...)
+	set.addTo(family, family+"_count", summary, help, float64(l.Count), labels...)
+}
+
+// addDelivery adds the at-least-once delivery of an ingester
+func addDelivery(set *metricSet, d sta.DeliveryStats, labels []string) {
+	set.add("reservoird_delivery_unacked", gauge,
+		"Number of messages awaiting acknowledgement.",
+		float64(d.Unacked), labels...,
+	)
+	set.add("reservoird_delivery_in_flight_limit", gauge,
+		"Maximum number of messages awaiting acknowledgement.",
+		float64(d.InFlight), labels...,
+	)
+	set.add("reservoird_delivery_acked_total", counter,
+		"Number of messages acknowledged.",
+		float64(d.Acked), labels...,
+	)
+	set.add("reservoird_delivery_nacked_total", counter,
+		"Number of negative acknowledgements.",
+		float64(d.Nacked), labels...,
+	)
+	set.add("reservoird_delivery_expired_total", counter,
+		"Number of deliveries not acknowledged in time.",
+		float64(d.Expired), labels...,
+	)
+	set.add("reservoird_delivery_redelivered_total", counter,
+		"Number of messages delivered again.",
+		float64(d.Redelivered), labels...,
+	)
+	set.add("reservoird_delivery_failed_total", counter,
+		"Number of messages failed after the last attempt.",
+		float64(d.Failed), labels...,
+	)
+	set.add("reservoird_delivery_dropped_total", counter,
+		"Number of outcomes the ingester had not read when closed.",
+		float64(d.Dropped), labels...,
+	)
+}
+
+// addQueueCounters adds what the host counted around a queue
+func addQueueCounters(set *metricSet, c sta.QueueCounters, labels []string) {
+	set.add("reservoird_queue_puts_total", counter,
+		"Number of successful puts into the queue.",
+		float64(c.Puts), labels...,
+	)
+	set.add("reservoird_queue_put_failures_total", counter,
+		"Number of puts into the queue returning an error.",
+		float64(c.PutFailures), labels...,
+	)
+	set.add("reservoird_queue_gets_total", counter,
+		"Number of successful gets from the queue.",
+		float64(c.Gets), labels...,
+	)
+	set.add("reservoird_queue_get_failures_total", counter,
+		"Number of gets from the queue returning an error.",
+		float64(c.GetFailures), labels...,
+	)
+	set.add("reservoird_queue_bytes_put_total", counter,
+		"Number of bytes put into the queue as byte slices.",
+		float64(c.BytesPut), labels...,
+	)
+	set.add("reservoird_queue_bytes_got_total", counter,
+		"Number of bytes got from the queue as byte slices.",
+		float64(c.BytesGot), labels...,
+	)
+	set.add("reservoird_queue_put_blocked_seconds_total", counter,
+		"Time spent putting into the queue.",
+		c.PutBlocked.Seconds(), labels...,
+	)
+	set.add("reservoird_queue_put_blocked_max_seconds", gauge,
+		"Longest time a put into the queue took.",
+		c.MaxPutBlocked.Seconds(), labels...,
+	)
+	set.add("reservoird_queue_get_wait_seconds_total", counter,
+		"Time spent getting from the queue.",
+		c.GetWait.Seconds(), labels...,
+	)
+	set.add("reservoird_queue_get_wait_max_seconds", gauge,
+		"Longest time a get from the queue took.",
+		c.MaxGetWait.Seconds(), labels...,
+	)
+}
+
+// addRuntimeMetrics adds go runtime metrics
+func addRuntimeMetrics(set *metricSet, rs sta.RuntimeStats) {
+	set.add("reservoird_go_info", gauge, "Go version.", 1, "version", rs.Goversion)
+	set.add("reservoird_go_cpus", gauge, "Number of logical CPUs.", float64(rs.CPUs))
+	set.add("reservoird_go_goroutines", gauge, "Number of goroutines.", float64(rs.Goroutines))
+	if rs.MemStats != nil {
+		flatten("", reflect.ValueOf(*rs.MemStats), func(name string, value float64) {
+			set.add("reservoird_go_mem_"+name, gauge, "Go runtime memory statistic.", value)
+		})
+	}
+	if rs.GCStats != nil {
+		set.add("reservoird_go_gc_cycles_total", counter, "Number of garbage collections.", float64(rs.GCStats.NumGC))
+		set.add("reservoird_go_gc_pause_seconds_total", counter,
+			"Total garbage collection pause time.", rs.GCStats.PauseTotal.Seconds(),
+		)
+		if rs.GCStats.LastGC.IsZero() == false {
+			set.add("reservoird_go_gc_last_timestamp_seconds", gauge,
+				"When the last garbage collection ran.", float64(rs.GCStats.LastGC.UnixNano())/1e9,
+			)
+		}
+	}
+}
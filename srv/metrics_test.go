@@ -0,0 +1,105 @@
+package srv
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reservoird/reservoird/sta"
+)
+
+func TestMetricName(t *testing.T) {
+	tests := map[string]string{
+		"messagesReceived": "messages_received",
+		"MessagesReceived": "messages_received",
+		"NumGC":            "num_gc",
+		"GCCPUFraction":    "gccpu_fraction",
+		"HTTPRequests":     "http_requests",
+		"bytes-in":         "bytes_in",
+	}
+	for name, expected := range tests {
+		if metricName(name) != expected {
+			t.Errorf("%s: expecting %s, got %s", name, expected, metricName(name))
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	type inner struct {
+		Dropped int
+	}
+	stats := &struct {
+		Name     string            `json:"name"`
+		Received uint64            `json:"messagesReceived"`
+		Running  bool              `json:"running"`
+		Latency  time.Duration     `json:"latency"`
+		Inner    inner             `json:"inner"`
+		Extra    map[string]int    `json:"extra"`
+		Ignored  int               `json:"-"`
+		Labels   map[string]string `json:"labels"`
+		hidden   int
+	}{
+		Name:     "fwd",
+		Received: 5,
+		Running:  true,
+		Latency:  1500 * time.Millisecond,
+		Inner:    inner{Dropped: 2},
+		Extra:    map[string]int{"retries": 3},
+		Ignored:  7,
+		hidden:   9,
+	}
+	values := make(map[string]float64)
+	flatten("", reflect.ValueOf(stats), func(name string, value float64) {
+		values[name] = value
+	})
+	expected := map[string]float64{
+		"messages_received": 5,
+		"running":           1,
+		"latency_seconds":   1.5,
+		"inner_dropped":     2,
+		"extra_retries":     3,
+	}
+	if reflect.DeepEqual(values, expected) == false {
+		t.Errorf("expecting %v, got %v", expected, values)
+	}
+}
+
+func TestMetricSetWrite(t *testing.T) {
+	set := newMetricSet()
+	addReservoirMetrics(set, []sta.ReservoirMetrics{
+		{
+			Name: "stdio",
+			Components: []sta.ComponentMetrics{
+				{
+					ID: "ingester0.queue", Kind: "queue", Name: "com.github.reservoird.fifo", Len: 3, Cap: 10, Running: true,
+					Latency: &sta.QueueLatency{Hop: sta.Latency{Count: 4, P50: 2 * time.Second}},
+				},
+			},
+			EndToEnd: sta.Latency{Count: 4, Sum: 3 * time.Second, Max: 1500 * time.Millisecond},
+		},
+	})
+	b := &bytes.Buffer{}
+	err := set.write(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	labels := `{reservoir="stdio",id="ingester0.queue",kind="queue",component="com.github.reservoird.fifo"}`
+	for _, line := range []string{
+		"# TYPE reservoird_queue_length gauge",
+		"reservoird_queue_length" + labels + " 3",
+		"reservoird_queue_capacity" + labels + " 10",
+		"reservoird_component_running" + labels + " 1",
+		`reservoird_reservoir_running{reservoir="stdio"} 1`,
+		"# TYPE reservoird_reservoir_latency_seconds summary",
+		`reservoird_reservoir_latency_seconds{reservoir="stdio",quantile="1"} 1.5`,
+		`reservoird_reservoir_latency_seconds_sum{reservoir="stdio"} 3`,
+		`reservoird_reservoir_latency_seconds_count{reservoir="stdio"} 4`,
+		`reservoird_queue_hop_latency_seconds{reservoir="stdio",id="ingester0.queue",kind="queue",component="com.github.reservoird.fifo",quantile="0.5"} 2`,
+	} {
+		if strings.Contains(b.String(), line+"\n") == false {
+			t.Errorf("expecting line %q in:\n%s", line, b.String())
+		}
+	}
+}
@@ -1,28 +1,43 @@
 package srv
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/reservoird/reservoird/cfg"
 	"github.com/reservoird/reservoird/run"
 	"github.com/reservoird/reservoird/sta"
 	"github.com/reservoird/reservoird/ver"
+	"github.com/reservoird/reservoird/viz"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Server struct contains what is needed to serve a rest interface
+// Server struct contains what is needed to serve a rest interface. Loader
+// re-reads the config for reloads, which are refused when it is nil.
+// StreamBuffer is the number of stats snapshots buffered per stream client.
+// InjectToken is the bearer token required to inject messages, injecting is
+// disabled when it is empty.
 type Server struct {
+	Loader       func() (cfg.Cfg, error)
+	StreamBuffer int
+	InjectToken  string
+	streams      *streams
+	closing      chan struct{}
 	server       http.Server
 	reservoirMap *run.ReservoirMap
 	doneChan     chan struct{}
@@ -36,25 +51,45 @@ func NewServer(reservoirMap *run.ReservoirMap, address string) (*Server, error)
 
 	// setup rest interface
 	router := httprouter.New()
-	router.GET("/v1/stats", o.GetStats)     // go stats
-	router.GET("/v1/version", o.GetVersion) // reservoird version info
+	router.GET("/v1/stats", o.GetStats)              // go stats
+	router.GET("/v1/stats/stream", o.StreamAllStats) // streams stats of all reservoirs
+	router.GET("/v1/version", o.GetVersion)          // reservoird version info
+	router.GET("/metrics", o.GetMetrics)             // prometheus metrics
+	router.POST("/v1/reload", o.Reload)              // reloads the config
 
 	router.GET("/v1/flows", o.GetFlows)           // gets all flows
-	router.GET("/v1/flows/:rname", o.GetFlow)     // gets a flow
+	router.GET("/v1/flows/:rname", o.GetFlow)     // gets a flow (?format=dot|mermaid|json-graph)
 	router.PUT("/v1/flows/:rname", o.StartFlow)   // starts a flow
-	router.DELETE("/v1/flows/:rname", o.StopFlow) // stops a flow
+	router.DELETE("/v1/flows/:rname", o.StopFlow) // stops a flow (?mode=drain|immediate, immediate by default)
 
-	router.GET("/v1/reservoirs", o.GetReservoirs)              // gets all reservoirs
-	router.GET("/v1/reservoirs/:rname", o.GetReservoir)        // gets a reservoir
-	router.PUT("/v1/reservoirs/:rname", o.CreateReservoir)     // creates a new reservoir
-	router.DELETE("/v1/reservoirs/:rname", o.DisposeReservoir) // disposes a reservoir
+	router.GET("/v1/reservoirs", o.GetReservoirs)                                 // gets all reservoirs
+	router.GET("/v1/reservoirs/:rname", o.GetReservoir)                           // gets a reservoir
+	router.PUT("/v1/reservoirs/:rname", o.CreateReservoir)                        // creates a new reservoir
+	router.DELETE("/v1/reservoirs/:rname", o.DisposeReservoir)                    // disposes a reservoir
+	router.GET("/v1/reservoirs/:rname/stats/stream", o.StreamStats)               // streams stats of a reservoir
+	router.GET("/v1/reservoirs/:rname/queues", o.GetQueues)                       // gets the queues of a reservoir
+	router.GET("/v1/reservoirs/:rname/queues/:index/tap", o.TapQueue)             // mirrors messages put into a queue
+	router.POST("/v1/reservoirs/:rname/queues/:index/messages", o.InjectMessages) // puts messages into a queue
+	router.GET("/v1/reservoirs/:rname/latency", o.GetLatency)                     // gets the latency of a reservoir
+
+	router.GET("/v2/reservoirs", o.DescribeReservoirs)       // describes all reservoirs
+	router.GET("/v2/reservoirs/:rname", o.DescribeReservoir) // describes a reservoir
+
+	router.GET("/v1/reservoirs/:rname/deadletters/:node", o.GetDeadLetters)            // inspects dead letters (?count=N)
+	router.POST("/v1/reservoirs/:rname/deadletters/:node/replay", o.ReplayDeadLetters) // replays dead letters (?count=N)
+	router.DELETE("/v1/reservoirs/:rname/deadletters/:node", o.ClearDeadLetters)       // clears dead letters
 
 	o.server = http.Server{
 		Addr:    address,
 		Handler: router,
 	}
 
+	o.server.RegisterOnShutdown(o.closeStreams)
+
 	o.reservoirMap = reservoirMap
+	o.StreamBuffer = DefaultStreamBuffer
+	o.streams = newStreams()
+	o.closing = make(chan struct{})
 	o.doneChan = make(chan struct{}, 1)
 	o.version = ver.NewVersion()
 	o.wg = &sync.WaitGroup{}
@@ -94,6 +129,47 @@ func (o *Server) GetStats(w http.ResponseWriter, r *http.Request, p httprouter.P
 		"url":      r.URL.Path,
 	}).Debug("received request")
 
+	rs := runtimeStats()
+
+	b, err := json.Marshal(rs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// GetMetrics returns reservoir and process metrics in the prometheus text
+// exposition format
+func (o *Server) GetMetrics(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	set := newMetricSet()
+	set.add("reservoird_build_info", gauge, "Reservoird version.", 1,
+		"version", o.version.GitVersion,
+		"hash", o.version.GitHash,
+		"icd", o.version.ICDVersion,
+	)
+	addRuntimeMetrics(set, runtimeStats())
+	addReservoirMetrics(set, o.reservoirMap.GetMetrics())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := set.write(w)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("writing metrics")
+	}
+}
+
+// runtimeStats gathers go runtime stats
+func runtimeStats() sta.RuntimeStats {
 	memStats := &runtime.MemStats{}
 	runtime.ReadMemStats(memStats)
 
@@ -103,7 +179,7 @@ func (o *Server) GetStats(w http.ResponseWriter, r *http.Request, p httprouter.P
 	buildinfo := &debug.BuildInfo{}
 	buildinfo, _ = debug.ReadBuildInfo()
 
-	rs := sta.RuntimeStats{
+	return sta.RuntimeStats{
 		CPUs:       runtime.NumCPU(),
 		Goroutines: runtime.NumGoroutine(),
 		Goversion:  runtime.Version(),
@@ -111,14 +187,6 @@ func (o *Server) GetStats(w http.ResponseWriter, r *http.Request, p httprouter.P
 		GCStats:    gcStats,
 		MemStats:   memStats,
 	}
-
-	b, err := json.Marshal(rs)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%v\n", err)
-	} else {
-		fmt.Fprintf(w, "%s\n", string(b))
-	}
 }
 
 // GetFlows returns the flows
@@ -147,7 +215,8 @@ func (o *Server) GetFlows(w http.ResponseWriter, r *http.Request, p httprouter.P
 	}
 }
 
-// GetFlow returns a flow
+// GetFlow returns a flow, as its topology with format dot, mermaid or
+// json-graph
 func (o *Server) GetFlow(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	log.WithFields(log.Fields{
 		"addr":     r.RemoteAddr,
@@ -157,6 +226,11 @@ func (o *Server) GetFlow(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 	}).Debug("received request")
 
 	rname := p.ByName("rname")
+	format := r.URL.Query().Get("format")
+	if format != "" {
+		o.renderFlow(w, rname, format)
+		return
+	}
 	flow := o.reservoirMap.GetFlow(rname)
 
 	if flow == nil || len(flow) == 0 {
@@ -177,6 +251,24 @@ func (o *Server) GetFlow(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 	}
 }
 
+// renderFlow writes the topology of a flow in a format
+func (o *Server) renderFlow(w http.ResponseWriter, rname string, format string) {
+	graph, err := o.reservoirMap.GetGraph(rname)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	out, err := viz.Render([]viz.Graph{graph}, format)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", viz.ContentType(format))
+	fmt.Fprintf(w, "%s", out)
+}
+
 // StartFlow starts a flow
 func (o *Server) StartFlow(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	log.WithFields(log.Fields{
@@ -189,7 +281,7 @@ func (o *Server) StartFlow(w http.ResponseWriter, r *http.Request, p httprouter.
 	rname := p.ByName("rname")
 	err := o.reservoirMap.Start(rname)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(errorStatus(err))
 		fmt.Fprintf(w, "%v\n", err)
 	} else {
 		fmt.Fprintf(w, "%s: starting flow\n", rname)
@@ -206,9 +298,15 @@ func (o *Server) StopFlow(w http.ResponseWriter, r *http.Request, p httprouter.P
 	}).Debug("received request")
 
 	rname := p.ByName("rname")
-	err := o.reservoirMap.InitStop(rname)
+	mode, err := run.ParseStopMode(r.URL.Query().Get("mode"))
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	err = o.reservoirMap.InitStop(rname, mode)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
 		fmt.Fprintf(w, "%v\n", err)
 	} else {
 		err := o.reservoirMap.UpdateFinalAndWait(rname)
@@ -255,18 +353,12 @@ func (o *Server) GetReservoir(w http.ResponseWriter, r *http.Request, p httprout
 	}).Debug("received request")
 
 	rname := p.ByName("rname")
-	reservoir, stopped, disposed := o.reservoirMap.GetReservoir(rname)
-	if reservoir == nil || len(reservoir) == 0 {
+	reservoir, ok := o.reservoirStats(rname)
+	if ok == false {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "%s: not found\n", rname)
 	} else {
-		reservoirs := map[string][]interface{}{
-			rname:      reservoir,
-			"stopped":  []interface{}{stopped},
-			"disposed": []interface{}{disposed},
-		}
-		r := sta.ReservoirStats(reservoirs)
-		b, err := json.Marshal(r)
+		b, err := json.Marshal(reservoir)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "%v\n", err)
@@ -276,7 +368,101 @@ func (o *Server) GetReservoir(w http.ResponseWriter, r *http.Request, p httprout
 	}
 }
 
-// CreateReservoir create a reservoir
+// DescribeReservoirs describes every reservoir with its components
+func (o *Server) DescribeReservoirs(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	b, err := json.Marshal(o.reservoirMap.DescribeAll())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// DescribeReservoir describes a reservoir with its components, how they
+// connect, their state and stats
+func (o *Server) DescribeReservoir(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	reservoir, err := o.reservoirMap.Describe(p.ByName("rname"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	b, err := json.Marshal(reservoir)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// GetLatency returns the end-to-end latency of a reservoir and the latency
+// at each of its queues
+func (o *Server) GetLatency(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	latency, err := o.reservoirMap.GetLatency(p.ByName("rname"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	b, err := json.Marshal(latency)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// reservoirStats returns the stats of a reservoir with its state,
+// supervisors and queue counters
+func (o *Server) reservoirStats(rname string) (sta.ReservoirStats, bool) {
+	reservoir, stopped, disposed := o.reservoirMap.GetReservoir(rname)
+	if reservoir == nil || len(reservoir) == 0 {
+		return nil, false
+	}
+	supervisors := make([]interface{}, 0)
+	for _, supervisor := range o.reservoirMap.GetSupervisors(rname) {
+		supervisors = append(supervisors, supervisor)
+	}
+	counters := make([]interface{}, 0)
+	for _, c := range o.reservoirMap.GetCounters(rname) {
+		counters = append(counters, c)
+	}
+	reservoirs := map[string][]interface{}{
+		rname:         reservoir,
+		"stopped":     []interface{}{stopped},
+		"disposed":    []interface{}{disposed},
+		"supervisors": supervisors,
+		"counters":    counters,
+	}
+	return sta.ReservoirStats(reservoirs), true
+}
+
+// CreateReservoir creates a reservoir from the request body or retrieves a
+// disposed reservoir when no body is given
 func (o *Server) CreateReservoir(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	log.WithFields(log.Fields{
 		"addr":     r.RemoteAddr,
@@ -286,11 +472,50 @@ func (o *Server) CreateReservoir(w http.ResponseWriter, r *http.Request, p httpr
 	}).Debug("received request")
 
 	rname := p.ByName("rname")
-	err := o.reservoirMap.Retrieve(rname)
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		// create from input
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s: %v\n", rname, err)
+		return
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		err := o.reservoirMap.Retrieve(rname)
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			fmt.Fprintf(w, "%v\n", err)
+		} else {
+			fmt.Fprintf(w, "%s: retrieving reservoir\n", rname)
+		}
+		return
+	}
+
+	config := cfg.ReservoirCfg{}
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s: invalid reservoir config (%v)\n", rname, err)
+		return
+	}
+	if config.Name == "" {
+		config.Name = rname
+	}
+	if config.Name != rname {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s: name does not match config name %s\n", rname, config.Name)
+		return
+	}
+
+	err = o.reservoirMap.Create(config)
+	if errors.Is(err, run.ErrExists) == true {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%v\n", err)
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s: %v\n", rname, err)
 	} else {
-		fmt.Fprintf(w, "%s: retrieving reservoir\n", rname)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s: creating reservoir\n", rname)
 	}
 }
 
@@ -306,18 +531,166 @@ func (o *Server) DisposeReservoir(w http.ResponseWriter, r *http.Request, p http
 	rname := p.ByName("rname")
 	err := o.reservoirMap.Dispose(rname)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "%s: not found (%v)\n", rname, err)
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprintf(w, "%v\n", err)
 	} else {
 		fmt.Fprintf(w, "%s: disposing reservoir\n", rname)
 	}
 }
 
-// cleanup waits until a signal to gracefully shutdown a server
+// count parses the count query parameter, -1 meaning all when absent
+func count(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("count")
+	if value == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid count %s", value)
+	}
+	return n, nil
+}
+
+// errorStatus returns 404 for missing reservoirs and parts, 409 otherwise
+func errorStatus(err error) int {
+	if errors.Is(err, run.ErrNotFound) == true {
+		return http.StatusNotFound
+	}
+	return http.StatusConflict
+}
+
+// GetDeadLetters gets the dead letters of a node without removing them
+func (o *Server) GetDeadLetters(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	n, err := count(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	letters, err := o.reservoirMap.GetDeadLetters(p.ByName("rname"), p.ByName("node"), n)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	b, err := json.Marshal(letters)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// ReplayDeadLetters puts the dead letters of a node back onto its input
+func (o *Server) ReplayDeadLetters(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	rname := p.ByName("rname")
+	n, err := count(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	replayed, err := o.reservoirMap.ReplayDeadLetters(rname, p.ByName("node"), n)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprintf(w, "%v (replayed %d)\n", err, replayed)
+	} else {
+		fmt.Fprintf(w, "%s: replayed %d dead letters\n", rname, replayed)
+	}
+}
+
+// ClearDeadLetters removes the dead letters of a node
+func (o *Server) ClearDeadLetters(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	rname := p.ByName("rname")
+	err := o.reservoirMap.ClearDeadLetters(rname, p.ByName("node"))
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s: clearing dead letters\n", rname)
+	}
+}
+
+// Reload re-reads the config and applies it, returning what changed
+func (o *Server) Reload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	if o.Loader == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		fmt.Fprintf(w, "reload not available without a config file\n")
+		return
+	}
+	report, err := o.reload()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// reload loads the config and applies it
+func (o *Server) reload() (run.ReloadReport, error) {
+	config, err := o.Loader()
+	if err != nil {
+		return run.ReloadReport{}, err
+	}
+	return o.reservoirMap.Reload(config)
+}
+
+// cleanup reloads on SIGHUP and waits until a signal to gracefully
+// shutdown a server
 func (o *Server) cleanup() {
 	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigint, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	s := <-sigint
+	for s == syscall.SIGHUP {
+		log.WithFields(log.Fields{
+			"signal": s.String(),
+		}).Info("received signal, reloading config")
+		if o.Loader != nil {
+			_, err := o.reload()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("reloading config")
+			}
+		}
+		s = <-sigint
+	}
 
 	log.WithFields(log.Fields{
 		"signal": s.String(),
@@ -366,6 +739,7 @@ func (o *Server) Monitor() {
 	run := true
 	for run == true {
 		o.reservoirMap.UpdateAll()
+		o.publish()
 
 		select {
 		case <-o.doneChan:
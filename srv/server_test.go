@@ -0,0 +1,154 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/reservoird/reservoird/cfg"
+	"github.com/reservoird/reservoird/env"
+	"github.com/reservoird/reservoird/run"
+)
+
+// newTestServer returns a server with no reservoirs
+func newTestServer(t *testing.T) *Server {
+	reservoirMap, err := run.NewReservoirMap(cfg.Cfg{}, nil)
+	if err != nil {
+		t.Fatalf("error creating reservoir map: %v", err)
+	}
+	server, err := NewServer(reservoirMap, ":0")
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	return server
+}
+
+func TestServerReload(t *testing.T) {
+	server := newTestServer(t)
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/reload", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("expecting %d without loader, got %d", http.StatusNotImplemented, w.Code)
+	}
+
+	server.Loader = func() (cfg.Cfg, error) {
+		return cfg.Cfg{}, errors.New("bad config")
+	}
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/reload", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expecting %d for bad config, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	server.Loader = func() (cfg.Cfg, error) {
+		return cfg.Cfg{}, nil
+	}
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/v1/reload", nil))
+	report := run.ReloadReport{}
+	err := json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || err != nil || len(report.Added) != 0 {
+		t.Errorf("expecting empty report, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServerTapQueue(t *testing.T) {
+	server := newTestServer(t)
+	tests := map[string]int{
+		"/v1/reservoirs/missing/queues":                                 http.StatusNotFound,
+		"/v1/reservoirs/missing/latency":                                http.StatusNotFound,
+		"/v1/reservoirs/missing/queues/0/tap":                           http.StatusNotFound,
+		"/v1/reservoirs/missing/queues/0/tap?count=0":                   http.StatusBadRequest,
+		"/v1/reservoirs/missing/queues/0/tap?sample=x":                  http.StatusBadRequest,
+		"/v1/reservoirs/missing/queues/0/tap?format=xml":                http.StatusBadRequest,
+		"/v1/reservoirs/missing/queues/0/tap?stream=true&format=json":   http.StatusBadRequest,
+		"/v1/reservoirs/missing/queues/0/tap?stream=true&format=ndjson": http.StatusNotFound,
+	}
+	for url, expected := range tests {
+		w := httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != expected {
+			t.Errorf("%s: expecting %d, got %d %s", url, expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServerInjectMessages(t *testing.T) {
+	server := newTestServer(t)
+	url := "/v1/reservoirs/missing/queues/0/messages"
+	inject := func(authorization string, query string) int {
+		req := httptest.NewRequest("POST", url+query, strings.NewReader("hello"))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := inject("Bearer secret", ""); code != http.StatusForbidden {
+		t.Errorf("expecting %d without inject token, got %d", http.StatusForbidden, code)
+	}
+	server.InjectToken = "secret"
+	if code := inject("", ""); code != http.StatusUnauthorized {
+		t.Errorf("expecting %d without authorization, got %d", http.StatusUnauthorized, code)
+	}
+	if code := inject("Bearer wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("expecting %d with wrong token, got %d", http.StatusUnauthorized, code)
+	}
+	for _, authorization := range []string{"secret", "Basic secret", "Bearersecret"} {
+		if code := inject(authorization, ""); code != http.StatusUnauthorized {
+			t.Errorf("%s: expecting %d without the bearer scheme, got %d", authorization, http.StatusUnauthorized, code)
+		}
+	}
+	if code := inject("Bearer secret", "?type=xml"); code != http.StatusBadRequest {
+		t.Errorf("expecting %d for unknown type, got %d", http.StatusBadRequest, code)
+	}
+	if code := inject("bearer secret", ""); code != http.StatusNotFound {
+		t.Errorf("expecting %d for missing reservoir, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestDecodeMessages(t *testing.T) {
+	items, err := decodeMessages([]byte("{\"a\": 1}\n\n\"b\"\n"), true, InjectJSON)
+	if err != nil || len(items) != 2 || items[1] != "b" {
+		t.Errorf("expecting 2 json messages, got %v (%v)", items, err)
+	}
+	items, err = decodeMessages([]byte(`{"type": "string", "data": "x"}`), false, InjectValue)
+	if err != nil || len(items) != 1 || items[0] != "x" {
+		t.Errorf("expecting string value, got %v (%v)", items, err)
+	}
+	items, err = decodeMessages([]byte(`{"headers": {"tenant": "acme"}, "type": "string", "payload": "x"}`), false, InjectEnvelope)
+	if e, ok := items[0].(*env.Envelope); err != nil || ok == false || e.Payload != "x" || e.Get("tenant") != "acme" || e.ID == "" {
+		t.Errorf("expecting stamped envelope, got %v (%v)", items, err)
+	}
+	_, err = decodeMessages([]byte("1\n{"), true, InjectJSON)
+	if err == nil || strings.HasPrefix(err.Error(), "line 2") == false {
+		t.Errorf("expecting error on line 2, got %v", err)
+	}
+}
+
+func TestServerFlowFormat(t *testing.T) {
+	server := newTestServer(t)
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/flows/missing?format=dot", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expecting %d for missing reservoir, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestServerDescribeReservoir(t *testing.T) {
+	server := newTestServer(t)
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/reservoirs/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expecting %d for missing reservoir, got %d", http.StatusNotFound, w.Code)
+	}
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/reservoirs", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "[]\n" {
+		t.Errorf("expecting empty list, got %d %s", w.Code, w.Body.String())
+	}
+}
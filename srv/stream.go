@@ -0,0 +1,224 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultStreamBuffer is the number of snapshots buffered per stream client
+// before the oldest are dropped
+const DefaultStreamBuffer = 16
+
+// subscriber is one stream client, rname is empty for all reservoirs
+type subscriber struct {
+	rname   string
+	events  chan []byte
+	dropped uint64
+}
+
+// streams holds the stream clients
+type streams struct {
+	subscribers map[*subscriber]bool
+	closed      bool
+	lock        sync.Mutex
+}
+
+// newStreams creates an empty set of stream clients
+func newStreams() *streams {
+	o := new(streams)
+	o.subscribers = make(map[*subscriber]bool)
+	return o
+}
+
+// subscribe adds a client with room for size snapshots
+func (o *streams) subscribe(rname string, size int) (*subscriber, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.closed == true {
+		return nil, fmt.Errorf("shutting down")
+	}
+	if size <= 0 {
+		size = DefaultStreamBuffer
+	}
+	sub := &subscriber{
+		rname:  rname,
+		events: make(chan []byte, size),
+	}
+	o.subscribers[sub] = true
+	return sub, nil
+}
+
+// unsubscribe removes a client
+func (o *streams) unsubscribe(sub *subscriber) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	_, ok := o.subscribers[sub]
+	if ok == true {
+		delete(o.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// empty returns whether there are no clients
+func (o *streams) empty() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.subscribers) == 0
+}
+
+// publish sends each client the snapshot for its reservoir, snapshot
+// returns nothing for reservoirs that no longer exist. A client that falls
+// behind loses its oldest snapshots rather than holding up the others.
+func (o *streams) publish(snapshot func(rname string) ([]byte, bool)) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	cache := make(map[string][]byte)
+	for sub := range o.subscribers {
+		event, ok := cache[sub.rname]
+		if ok == false {
+			event, ok = snapshot(sub.rname)
+			if ok == false {
+				continue
+			}
+			cache[sub.rname] = event
+		}
+		for {
+			select {
+			case sub.events <- event:
+			default:
+				select {
+				case <-sub.events:
+					sub.dropped++
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// close ends every stream and refuses new ones, used on shutdown since
+// streams otherwise keep their connections busy forever
+func (o *streams) close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.closed = true
+	for sub := range o.subscribers {
+		delete(o.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// snapshot returns the stats event for a reservoir or all reservoirs
+func (o *Server) snapshot(rname string) ([]byte, bool) {
+	var stats interface{}
+	if rname == "" {
+		stats = o.reservoirMap.GetReservoirs()
+	} else {
+		reservoir, ok := o.reservoirStats(rname)
+		if ok == false {
+			return nil, false
+		}
+		stats = reservoir
+	}
+	b, err := json.Marshal(stats)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"reservoir": rname,
+			"err":       err,
+		}).Error("marshaling stats snapshot")
+		return nil, false
+	}
+	return b, true
+}
+
+// publish pushes fresh stats to the stream clients
+func (o *Server) publish() {
+	if o.streams.empty() == true {
+		return
+	}
+	o.streams.publish(o.snapshot)
+}
+
+// StreamStats streams the stats of a reservoir as server-sent events
+func (o *Server) StreamStats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	o.stream(w, r, p.ByName("rname"))
+}
+
+// StreamAllStats streams the stats of all reservoirs as server-sent events
+func (o *Server) StreamAllStats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	o.stream(w, r, "")
+}
+
+// stream sends the current stats then each fresh snapshot until the client
+// goes away or the server shuts down
+func (o *Server) stream(w http.ResponseWriter, r *http.Request, rname string) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	flusher, ok := w.(http.Flusher)
+	if ok == false {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "streaming not supported\n")
+		return
+	}
+	event, ok := o.snapshot(rname)
+	if ok == false {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s: not found\n", rname)
+		return
+	}
+	sub, err := o.streams.subscribe(rname, o.StreamBuffer)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	defer o.streams.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	id := 0
+	for {
+		_, err := fmt.Fprintf(w, "id: %d\nevent: stats\ndata: %s\n\n", id, event)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+		id++
+
+		select {
+		case <-r.Context().Done():
+			log.WithFields(log.Fields{
+				"addr": r.RemoteAddr,
+			}).Debug("stream client disconnected")
+			return
+		case event, ok = <-sub.events:
+			if ok == false {
+				return
+			}
+		}
+	}
+}
+
+// closeStreams ends every stats and tap stream so shutdown is not held up
+func (o *Server) closeStreams() {
+	o.streams.close()
+	close(o.closing)
+}
@@ -0,0 +1,93 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamsBuffer(t *testing.T) {
+	streams := newStreams()
+	sub, err := streams.subscribe("", 2)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	for _, event := range []string{"1", "2", "3"} {
+		streams.publish(func(string) ([]byte, bool) {
+			return []byte(event), true
+		})
+	}
+	first := string(<-sub.events)
+	second := string(<-sub.events)
+	if first != "2" || second != "3" || sub.dropped != 1 {
+		t.Errorf("expecting oldest dropped, got %s %s (%d dropped)", first, second, sub.dropped)
+	}
+
+	streams.close()
+	_, ok := <-sub.events
+	if ok == true {
+		t.Errorf("expecting events closed")
+	}
+	_, err = streams.subscribe("", 2)
+	if err == nil {
+		t.Errorf("expecting error subscribing after close")
+	}
+}
+
+func TestServerStreamStats(t *testing.T) {
+	server := newTestServer(t)
+	ts := httptest.NewServer(server.server.Handler)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v1/reservoirs/missing/stats/stream")
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expecting %d for missing reservoir, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/v1/stats/stream", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expecting event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		lines := make([]string, 0)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil || line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	event := readEvent()
+	if event != "id: 0\nevent: stats\ndata: {}\n" {
+		t.Errorf("expecting initial snapshot, got %q", event)
+	}
+	server.publish()
+	event = readEvent()
+	if strings.HasPrefix(event, "id: 1\n") == false {
+		t.Errorf("expecting published snapshot, got %q", event)
+	}
+
+	cancel()
+	for i := 0; i < 100 && server.streams.empty() == false; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.streams.empty() == false {
+		t.Errorf("expecting client removed after disconnect")
+	}
+}
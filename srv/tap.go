@@ -0,0 +1,221 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/reservoird/reservoird/ipc"
+	"github.com/reservoird/reservoird/run"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tap defaults
+const (
+	DefaultTapCount   = 10
+	DefaultTapTimeout = 10 * time.Second
+)
+
+// tapParams are the query parameters of a tap
+type tapParams struct {
+	count   int
+	sample  int
+	stream  bool
+	ndjson  bool
+	timeout time.Duration
+}
+
+// parseTapParams parses count, sample, stream, format and timeout
+func parseTapParams(r *http.Request) (tapParams, error) {
+	query := r.URL.Query()
+	params := tapParams{
+		count:   DefaultTapCount,
+		sample:  1,
+		timeout: DefaultTapTimeout,
+	}
+	var err error
+	if query.Get("stream") != "" {
+		params.stream, err = strconv.ParseBool(query.Get("stream"))
+		if err != nil {
+			return params, fmt.Errorf("invalid stream %s", query.Get("stream"))
+		}
+	}
+	if params.stream == true {
+		params.count = -1
+	}
+	if query.Get("count") != "" {
+		params.count, err = strconv.Atoi(query.Get("count"))
+		if err != nil || params.count < 1 {
+			return params, fmt.Errorf("invalid count %s", query.Get("count"))
+		}
+	}
+	if query.Get("sample") != "" {
+		params.sample, err = strconv.Atoi(query.Get("sample"))
+		if err != nil || params.sample < 1 {
+			return params, fmt.Errorf("invalid sample %s", query.Get("sample"))
+		}
+	}
+	switch query.Get("format") {
+	case "":
+		params.ndjson = params.stream
+	case "json":
+	case "ndjson":
+		params.ndjson = true
+	default:
+		return params, fmt.Errorf("unknown format %s, expecting json or ndjson", query.Get("format"))
+	}
+	if params.stream == true && params.ndjson == false {
+		return params, fmt.Errorf("streaming is only available as ndjson")
+	}
+	if query.Get("timeout") != "" {
+		params.timeout, err = time.ParseDuration(query.Get("timeout"))
+		if err != nil {
+			return params, fmt.Errorf("invalid timeout %s", query.Get("timeout"))
+		}
+	}
+	return params, nil
+}
+
+// GetQueues gets the queues between the components of a reservoir
+func (o *Server) GetQueues(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	queues, err := o.reservoirMap.GetQueues(p.ByName("rname"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	b, err := json.Marshal(queues)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// TapQueue mirrors the next messages put into a queue without taking them.
+// Messages are collected until count is reached or the timeout passes, or
+// with stream sent as they arrive until the client goes away.
+func (o *Server) TapQueue(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	log.WithFields(log.Fields{
+		"addr":     r.RemoteAddr,
+		"method":   r.Method,
+		"protocol": r.Proto,
+		"url":      r.URL.Path,
+	}).Debug("received request")
+
+	params, err := parseTapParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	var flusher http.Flusher
+	if params.stream == true {
+		var ok bool
+		flusher, ok = w.(http.Flusher)
+		if ok == false {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "streaming not supported\n")
+			return
+		}
+	}
+	tap, err := o.reservoirMap.Tap(p.ByName("rname"), p.ByName("index"), params.count, params.sample)
+	if errors.Is(err, run.ErrNotFound) == true {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	defer tap.Close()
+
+	if params.stream == true {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-o.closing:
+				return
+			case item, ok := <-tap.Items:
+				if ok == false {
+					return
+				}
+				b, err := marshalItem(item)
+				if err != nil {
+					continue
+				}
+				_, err = fmt.Fprintf(w, "%s\n", b)
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+
+	values := make([]json.RawMessage, 0)
+	timeout := time.After(params.timeout)
+	collecting := true
+	for collecting == true {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			collecting = false
+		case item, ok := <-tap.Items:
+			if ok == false {
+				collecting = false
+				break
+			}
+			b, err := marshalItem(item)
+			if err == nil {
+				values = append(values, b)
+			}
+		}
+	}
+	if params.ndjson == true {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for v := range values {
+			fmt.Fprintf(w, "%s\n", values[v])
+		}
+		return
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v\n", err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s\n", string(b))
+	}
+}
+
+// marshalItem encodes a message the way out-of-process plugins see it
+func marshalItem(item interface{}) ([]byte, error) {
+	value, err := ipc.Encode(item)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("encoding tapped message")
+		return nil, err
+	}
+	return json.Marshal(value)
+}
@@ -0,0 +1,217 @@
+package sta
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats is the standard shape of component stats. The host normalizes
+// whatever a plugin reports into it, fields it does not know go in Extra.
+type Stats struct {
+	Name             string                 `json:"name"`
+	Kind             string                 `json:"kind"`
+	Running          bool                   `json:"running"`
+	MessagesReceived uint64                 `json:"messagesReceived"`
+	MessagesSent     uint64                 `json:"messagesSent"`
+	MessagesDropped  uint64                 `json:"messagesDropped"`
+	BytesReceived    uint64                 `json:"bytesReceived"`
+	BytesSent        uint64                 `json:"bytesSent"`
+	Errors           uint64                 `json:"errors"`
+	LastActivity     time.Time              `json:"lastActivity"`
+	Extra            map[string]interface{} `json:"extra,omitempty"`
+}
+
+// Fields of Stats recognized in plugin payloads
+const (
+	fieldName             = "name"
+	fieldRunning          = "running"
+	fieldMessagesReceived = "messagesReceived"
+	fieldMessagesSent     = "messagesSent"
+	fieldMessagesDropped  = "messagesDropped"
+	fieldBytesReceived    = "bytesReceived"
+	fieldBytesSent        = "bytesSent"
+	fieldErrors           = "errors"
+	fieldLastActivity     = "lastActivity"
+)
+
+// statsAliases maps payload keys, lower cased without underscores or
+// dashes, to the fields they fill
+var statsAliases = map[string]string{
+	"name":             fieldName,
+	"running":          fieldRunning,
+	"messagesreceived": fieldMessagesReceived,
+	"msgsreceived":     fieldMessagesReceived,
+	"messagesin":       fieldMessagesReceived,
+	"received":         fieldMessagesReceived,
+	"messagessent":     fieldMessagesSent,
+	"msgssent":         fieldMessagesSent,
+	"messagesout":      fieldMessagesSent,
+	"sent":             fieldMessagesSent,
+	"messagesdropped":  fieldMessagesDropped,
+	"msgsdropped":      fieldMessagesDropped,
+	"dropped":          fieldMessagesDropped,
+	"bytesreceived":    fieldBytesReceived,
+	"bytesin":          fieldBytesReceived,
+	"bytessent":        fieldBytesSent,
+	"bytesout":         fieldBytesSent,
+	"errors":           fieldErrors,
+	"errorcount":       fieldErrors,
+	"lastactivity":     fieldLastActivity,
+	"lastmessage":      fieldLastActivity,
+}
+
+// aliasKey reduces a payload key for lookup in statsAliases
+func aliasKey(key string) string {
+	key = strings.ToLower(key)
+	key = strings.Replace(key, "_", "", -1)
+	return strings.Replace(key, "-", "", -1)
+}
+
+// Normalize converts a plugin stats payload into Stats. Name, kind and
+// running come from the host. Payloads that are already Stats are used as
+// they are, structs and maps are read through their json form and anything
+// else is kept in Extra as value. When several keys alias the same field the
+// canonical name wins, otherwise the first in sorted order, and the others
+// are kept in Extra.
+func Normalize(name string, kind string, running bool, payload interface{}) Stats {
+	stats := Stats{}
+	switch v := payload.(type) {
+	case Stats:
+		stats = v
+	case *Stats:
+		if v != nil {
+			stats = *v
+		}
+	case nil:
+	default:
+		fields, ok := payloadFields(payload)
+		if ok == false {
+			stats.Extra = map[string]interface{}{"value": payload}
+			break
+		}
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			ci := keys[i] == statsAliases[aliasKey(keys[i])]
+			cj := keys[j] == statsAliases[aliasKey(keys[j])]
+			if ci != cj {
+				return ci
+			}
+			return keys[i] < keys[j]
+		})
+		set := make(map[string]bool)
+		for _, key := range keys {
+			value := fields[key]
+			field, known := statsAliases[aliasKey(key)]
+			if known == false || set[field] == true || setField(&stats, field, value) == false {
+				if stats.Extra == nil {
+					stats.Extra = make(map[string]interface{})
+				}
+				stats.Extra[key] = value
+				continue
+			}
+			set[field] = true
+		}
+	}
+	stats.Name = name
+	stats.Kind = kind
+	stats.Running = running
+	return stats
+}
+
+// payloadFields returns the fields of a struct or map payload
+func payloadFields(payload interface{}) (map[string]interface{}, bool) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	fields := make(map[string]interface{})
+	err = decoder.Decode(&fields)
+	if err != nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+// setField sets a field from a payload value, returning false when the
+// value does not fit
+func setField(stats *Stats, field string, value interface{}) bool {
+	switch field {
+	case fieldName, fieldRunning:
+		// set by the host
+		return true
+	case fieldLastActivity:
+		t, ok := toTime(value)
+		if ok == true {
+			stats.LastActivity = t
+		}
+		return ok
+	}
+	n, ok := toUint(value)
+	if ok == false {
+		return false
+	}
+	switch field {
+	case fieldMessagesReceived:
+		stats.MessagesReceived = n
+	case fieldMessagesSent:
+		stats.MessagesSent = n
+	case fieldMessagesDropped:
+		stats.MessagesDropped = n
+	case fieldBytesReceived:
+		stats.BytesReceived = n
+	case fieldBytesSent:
+		stats.BytesSent = n
+	case fieldErrors:
+		stats.Errors = n
+	}
+	return true
+}
+
+// toUint converts a json number to a count, negative counts become 0
+func toUint(value interface{}) (uint64, bool) {
+	number, ok := value.(json.Number)
+	if ok == false {
+		return 0, false
+	}
+	i, err := number.Int64()
+	if err == nil {
+		if i < 0 {
+			return 0, true
+		}
+		return uint64(i), true
+	}
+	f, err := number.Float64()
+	if err != nil || math.IsNaN(f) == true {
+		return 0, false
+	}
+	if f < 0 {
+		return 0, true
+	}
+	return uint64(f), true
+}
+
+// toTime converts an RFC 3339 string or unix seconds to a time
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,79 @@
+package sta
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	type pluginStats struct {
+		Name             string
+		MessagesReceived uint64
+		Msgs_Sent        int
+		Dropped          float64
+		Errors           string
+		LastActivity     time.Time
+		Depth            int
+		Running          bool
+	}
+	last := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	stats := Normalize("host", "digester", true, pluginStats{
+		Name:             "plugin",
+		MessagesReceived: 10,
+		Msgs_Sent:        -1,
+		Dropped:          2.5,
+		Errors:           "many",
+		LastActivity:     last,
+		Depth:            3,
+	})
+	if stats.Name != "host" || stats.Kind != "digester" || stats.Running != true {
+		t.Errorf("expecting host name, kind and running, got %+v", stats)
+	}
+	if stats.MessagesReceived != 10 || stats.MessagesSent != 0 || stats.MessagesDropped != 2 {
+		t.Errorf("expecting 10 received, 0 sent and 2 dropped, got %+v", stats)
+	}
+	if stats.LastActivity.Equal(last) == false {
+		t.Errorf("expecting last activity %v, got %v", last, stats.LastActivity)
+	}
+	if len(stats.Extra) != 2 || stats.Extra["Depth"] == nil || stats.Extra["Errors"] != "many" {
+		t.Errorf("expecting unknown and mistyped fields in extra, got %v", stats.Extra)
+	}
+
+	stats = Normalize("m", "queue", false, map[string]interface{}{
+		"bytes_in":      100,
+		"bytes-out":     50,
+		"last_message":  1577934245,
+		"message_count": 1,
+	})
+	if stats.BytesReceived != 100 || stats.BytesSent != 50 || stats.LastActivity.Equal(last) == false {
+		t.Errorf("expecting bytes and last activity from a map, got %+v", stats)
+	}
+	if reflect.DeepEqual(stats.Extra, map[string]interface{}{"message_count": stats.Extra["message_count"]}) == false {
+		t.Errorf("expecting message_count in extra, got %v", stats.Extra)
+	}
+
+	for i := 0; i < 10; i++ {
+		stats = Normalize("a", "digester", true, map[string]interface{}{
+			"received":         1,
+			"messagesReceived": 2,
+			"msgs_received":    3,
+		})
+		if stats.MessagesReceived != 2 || len(stats.Extra) != 2 || stats.Extra["received"] == nil || stats.Extra["msgs_received"] == nil {
+			t.Fatalf("expecting the canonical name to win and the aliases in extra, got %+v", stats)
+		}
+	}
+
+	stats = Normalize("s", "ingester", true, "started")
+	if stats.Extra["value"] != "started" {
+		t.Errorf("expecting string payload as value, got %v", stats.Extra)
+	}
+	stats = Normalize("s", "ingester", true, &Stats{Name: "p", Errors: 4})
+	if stats.Name != "s" || stats.Errors != 4 {
+		t.Errorf("expecting standard stats kept, got %+v", stats)
+	}
+	stats = Normalize("n", "expeller", false, nil)
+	if stats.Name != "n" || stats.Extra != nil {
+		t.Errorf("expecting empty stats, got %+v", stats)
+	}
+}
@@ -1,8 +1,10 @@
 package sta
 
 import (
+	"encoding/json"
 	"runtime"
 	"runtime/debug"
+	"time"
 )
 
 // RuntimeStats provide go runtime stats
@@ -21,6 +23,153 @@ type FlowStats map[string][]string
 // ReservoirStats provides reservoir stats
 type ReservoirStats map[string][]interface{}
 
+// SupervisorStats provides the restart counts and last error of a component
+type SupervisorStats struct {
+	ID            string    `json:"id,omitempty"`
+	Name          string    `json:"name"`
+	Policy        string    `json:"policy"`
+	Restarts      int       `json:"restarts"`
+	Panics        int       `json:"panics"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastStack     string    `json:"lastStack,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+}
+
+// ComponentMetrics provides the metrics of one component of a reservoir,
+// length, capacity, injected messages, counters and latency are only set for
+// queues, delivery for ingesters with delivery configured. Stats are as
+// reported, normalized as the standard stats.
+type ComponentMetrics struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Name       string          `json:"name"`
+	Running    bool            `json:"running"`
+	Len        int             `json:"len,omitempty"`
+	Cap        int             `json:"cap,omitempty"`
+	Injected   uint64          `json:"injected,omitempty"`
+	Counters   *QueueCounters  `json:"counters,omitempty"`
+	Latency    *QueueLatency   `json:"latency,omitempty"`
+	Delivery   *DeliveryStats  `json:"delivery,omitempty"`
+	Updated    time.Time       `json:"updated"`
+	Stats      interface{}     `json:"stats"`
+	Normalized Stats           `json:"normalized"`
+	Supervisor SupervisorStats `json:"supervisor"`
+}
+
+// QueueStats provides a queue between components of a reservoir, index is
+// its position in flow order
+type QueueStats struct {
+	Index    int           `json:"index"`
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Len      int           `json:"len"`
+	Cap      int           `json:"cap"`
+	Taps     int           `json:"taps"`
+	Injected uint64        `json:"injected"`
+	Counters QueueCounters `json:"counters"`
+}
+
+// QueueCounters are counted by the host around every queue. Failures are
+// calls returning an error, such as a get on an empty non-blocking queue.
+// Bytes are only counted for byte slices. Blocked and wait are the total
+// time spent in put and get.
+type QueueCounters struct {
+	ID            string        `json:"id,omitempty"`
+	Puts          uint64        `json:"puts"`
+	PutFailures   uint64        `json:"putFailures"`
+	Gets          uint64        `json:"gets"`
+	GetFailures   uint64        `json:"getFailures"`
+	BytesPut      uint64        `json:"bytesPut"`
+	BytesGot      uint64        `json:"bytesGot"`
+	PutBlocked    time.Duration `json:"putBlocked"`
+	MaxPutBlocked time.Duration `json:"maxPutBlocked"`
+	GetWait       time.Duration `json:"getWait"`
+	MaxGetWait    time.Duration `json:"maxGetWait"`
+	LastActivity  time.Time     `json:"lastActivity"`
+}
+
+// DeliveryStats provides the at-least-once delivery of an ingester. Unacked
+// envelopes are in flight up to the in-flight limit, the others were acked
+// or failed after the last attempt. Dropped counts outcomes the ingester had
+// not read when its reservoir was closed.
+type DeliveryStats struct {
+	Unacked     int    `json:"unacked"`
+	InFlight    int    `json:"inFlight"`
+	Acked       uint64 `json:"acked"`
+	Nacked      uint64 `json:"nacked"`
+	Expired     uint64 `json:"expired"`
+	Redelivered uint64 `json:"redelivered"`
+	Failed      uint64 `json:"failed"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+// ReservoirMetrics provides the metrics of one reservoir
+type ReservoirMetrics struct {
+	Name       string             `json:"name"`
+	Stopped    bool               `json:"stopped"`
+	EndToEnd   Latency            `json:"endToEnd"`
+	Components []ComponentMetrics `json:"components"`
+}
+
+// Latency summarizes a latency histogram, quantiles are within 25%
+type Latency struct {
+	Count uint64        `json:"count"`
+	Sum   time.Duration `json:"sum"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// QueueLatency provides the latency measured at a queue, hop is the time
+// messages spent in the queue, age the time since they were ingested
+type QueueLatency struct {
+	ID  string  `json:"id,omitempty"`
+	Hop Latency `json:"hop"`
+	Age Latency `json:"age"`
+}
+
+// ReservoirLatency provides the latency of a reservoir from ingest to expel
+// and at every queue between components in flow order
+type ReservoirLatency struct {
+	Name     string         `json:"name"`
+	EndToEnd Latency        `json:"endToEnd"`
+	Queues   []QueueLatency `json:"queues"`
+}
+
+// Component describes one part of a reservoir: a plugin, a queue or a host
+// stage. Upstream and downstream are the ids of the parts it receives from
+// and sends to, location and config are those of the plugin or queue.
+// Length, capacity, counters and latency are only set for queues, delivery
+// for ingesters with delivery configured. Stats are normalized.
+type Component struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Name       string          `json:"name"`
+	Location   string          `json:"location,omitempty"`
+	Config     json.RawMessage `json:"config,omitempty"`
+	Upstream   []string        `json:"upstream"`
+	Downstream []string        `json:"downstream"`
+	Running    bool            `json:"running"`
+	Len        *int            `json:"len,omitempty"`
+	Cap        *int            `json:"cap,omitempty"`
+	Counters   *QueueCounters  `json:"counters,omitempty"`
+	Latency    *QueueLatency   `json:"latency,omitempty"`
+	Delivery   *DeliveryStats  `json:"delivery,omitempty"`
+	Updated    time.Time       `json:"updated"`
+	Stats      Stats           `json:"stats"`
+	Supervisor SupervisorStats `json:"supervisor"`
+}
+
+// Reservoir describes a reservoir with its components in flow order
+type Reservoir struct {
+	Name       string      `json:"name"`
+	Stopped    bool        `json:"stopped"`
+	Disposed   bool        `json:"disposed"`
+	EndToEnd   Latency     `json:"endToEnd"`
+	Components []Component `json:"components"`
+}
+
 // Version
 type Version struct {
 	GitVersion string `json:"gitVersion"`
@@ -0,0 +1,95 @@
+// Package viz renders the topology of a reservoir as Graphviz DOT, Mermaid
+// or a JSON graph
+package viz
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+// Node is one component of a reservoir. Name is the plugin name when the
+// reservoir is built and derived from the location otherwise. Running is
+// only set for a running reservoir, merges are only known once built.
+type Node struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Merge    bool   `json:"merge,omitempty"`
+	Running  *bool  `json:"running,omitempty"`
+}
+
+// Edge is the queue carrying messages from one component to another.
+// Queue is the queue name, QueueID its id within the reservoir. FanOut is
+// set when the sending node copies each message to several queues. Len and
+// Cap are only set for a running reservoir.
+type Edge struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Queue   string `json:"queue"`
+	QueueID string `json:"queueId"`
+	FanOut  bool   `json:"fanOut,omitempty"`
+	Len     *int   `json:"len,omitempty"`
+	Cap     *int   `json:"cap,omitempty"`
+}
+
+// Graph is the topology of a reservoir
+type Graph struct {
+	Name  string `json:"name"`
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// locationName shortens a location to something readable
+func locationName(loc string) string {
+	if strings.HasPrefix(loc, "builtin:") == true {
+		return strings.TrimPrefix(loc, "builtin:")
+	}
+	loc = strings.TrimPrefix(loc, "exec:")
+	return strings.TrimSuffix(filepath.Base(loc), ".so")
+}
+
+// FromConfig builds the graph of a reservoir config without building it
+func FromConfig(config cfg.ReservoirCfg) (Graph, error) {
+	graph, err := config.ToGraph()
+	if err != nil {
+		return Graph{}, err
+	}
+	order, err := graph.TopologicalOrder()
+	if err != nil {
+		return Graph{}, fmt.Errorf("%s: %v", config.Name, err)
+	}
+	g := Graph{
+		Name:  config.Name,
+		Nodes: make([]Node, 0),
+		Edges: make([]Edge, 0),
+	}
+	for _, id := range order {
+		node, _ := graph.Node(id)
+		g.Nodes = append(g.Nodes, Node{
+			ID:       node.ID,
+			Kind:     node.Kind,
+			Name:     locationName(node.Location),
+			Location: node.Location,
+			Merge:    node.Kind == cfg.KindDigester && len(graph.Upstream(id)) > 1,
+		})
+		downstream := graph.Downstream(id)
+		for _, down := range downstream {
+			edge := Edge{
+				From:    id,
+				To:      down,
+				Queue:   locationName(node.QueueItem.Location),
+				QueueID: id + ".queue",
+			}
+			if len(downstream) > 1 {
+				edge.FanOut = true
+				edge.QueueID = id + ".fanout." + down
+			}
+			g.Edges = append(g.Edges, edge)
+		}
+	}
+	return g, nil
+}
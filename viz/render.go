@@ -0,0 +1,190 @@
+package viz
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+// Formats
+const (
+	FormatDot       = "dot"
+	FormatMermaid   = "mermaid"
+	FormatJSONGraph = "json-graph"
+)
+
+// ContentType returns the media type of a format
+func ContentType(format string) string {
+	switch format {
+	case FormatDot:
+		return "text/vnd.graphviz"
+	case FormatJSONGraph:
+		return "application/json"
+	}
+	return "text/plain"
+}
+
+// Render renders graphs in a format, several graphs are rendered one after
+// another for dot and mermaid and as a list for json-graph
+func Render(graphs []Graph, format string) (string, error) {
+	switch format {
+	case FormatDot, FormatMermaid:
+		out := make([]string, 0)
+		for g := range graphs {
+			if format == FormatDot {
+				out = append(out, Dot(graphs[g]))
+			} else {
+				out = append(out, Mermaid(graphs[g]))
+			}
+		}
+		return strings.Join(out, "\n"), nil
+	case FormatJSONGraph:
+		var doc interface{}
+		if len(graphs) == 1 {
+			doc = map[string]interface{}{"graph": jsonGraph(graphs[0])}
+		} else {
+			list := make([]interface{}, 0)
+			for g := range graphs {
+				list = append(list, jsonGraph(graphs[g]))
+			}
+			doc = map[string]interface{}{"graphs": list}
+		}
+		b, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b) + "\n", nil
+	}
+	return "", fmt.Errorf("unknown format %s, expecting dot, mermaid or json-graph", format)
+}
+
+// queueLabel labels an edge with its queue and depth when known
+func queueLabel(edge Edge) string {
+	label := edge.Queue
+	if edge.Len != nil && edge.Cap != nil {
+		if *edge.Cap < 0 {
+			label = fmt.Sprintf("%s (%d)", label, *edge.Len)
+		} else {
+			label = fmt.Sprintf("%s (%d/%d)", label, *edge.Len, *edge.Cap)
+		}
+	}
+	return label
+}
+
+// nodeLines returns the lines labelling a node
+func nodeLines(node Node) []string {
+	lines := []string{node.ID, node.Kind}
+	if node.Name != "" && node.Name != node.ID {
+		lines = append(lines, node.Name)
+	}
+	if node.Merge == true {
+		lines = append(lines, "merge")
+	}
+	if node.Running != nil && *node.Running == false {
+		lines = append(lines, "not running")
+	}
+	return lines
+}
+
+// dotQuote quotes a dot id or label
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// dotShapes gives each kind a shape
+var dotShapes = map[string]string{
+	cfg.KindIngester: "invhouse",
+	cfg.KindDigester: "box",
+	cfg.KindExpeller: "house",
+}
+
+// Dot renders a graph as a Graphviz digraph
+func Dot(g Graph) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "digraph %s {\n", dotQuote(g.Name))
+	fmt.Fprintf(b, "  rankdir=LR;\n")
+	for _, node := range g.Nodes {
+		label := dotQuote(strings.Join(nodeLines(node), "\n"))
+		label = strings.Replace(label, "\n", `\n`, -1)
+		fmt.Fprintf(b, "  %s [label=%s, shape=%s];\n", dotQuote(node.ID), label, dotShapes[node.Kind])
+	}
+	for _, edge := range g.Edges {
+		style := ""
+		if edge.FanOut == true {
+			style = ", style=bold"
+		}
+		fmt.Fprintf(b, "  %s -> %s [label=%s%s];\n", dotQuote(edge.From), dotQuote(edge.To), dotQuote(queueLabel(edge)), style)
+	}
+	fmt.Fprintf(b, "}\n")
+	return b.String()
+}
+
+// mermaidEscape escapes text for a quoted mermaid label
+func mermaidEscape(s string) string {
+	return strings.Replace(s, `"`, "#quot;", -1)
+}
+
+// mermaidShapes gives each kind an opening and closing bracket
+var mermaidShapes = map[string][2]string{
+	cfg.KindIngester: {"[/", "/]"},
+	cfg.KindDigester: {"[", "]"},
+	cfg.KindExpeller: {"[\\", "\\]"},
+}
+
+// Mermaid renders a graph as a left to right mermaid flowchart, nodes are
+// numbered since ids may contain characters mermaid does not accept
+func Mermaid(g Graph) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%%%% %s\n", g.Name)
+	fmt.Fprintf(b, "graph LR\n")
+	ids := make(map[string]string)
+	for n, node := range g.Nodes {
+		ids[node.ID] = fmt.Sprintf("n%d", n)
+		lines := nodeLines(node)
+		for l := range lines {
+			lines[l] = mermaidEscape(lines[l])
+		}
+		shape := mermaidShapes[node.Kind]
+		fmt.Fprintf(b, "  %s%s\"%s\"%s\n", ids[node.ID], shape[0], strings.Join(lines, "<br/>"), shape[1])
+	}
+	for _, edge := range g.Edges {
+		arrow := "-->"
+		if edge.FanOut == true {
+			arrow = "==>"
+		}
+		fmt.Fprintf(b, "  %s %s|\"%s\"| %s\n", ids[edge.From], arrow, mermaidEscape(queueLabel(edge)), ids[edge.To])
+	}
+	return b.String()
+}
+
+// jsonGraph returns a graph in the JSON Graph Format
+func jsonGraph(g Graph) map[string]interface{} {
+	nodes := make(map[string]interface{})
+	for _, node := range g.Nodes {
+		nodes[node.ID] = map[string]interface{}{
+			"label":    node.Name,
+			"metadata": node,
+		}
+	}
+	edges := make([]interface{}, 0)
+	for _, edge := range g.Edges {
+		edges = append(edges, map[string]interface{}{
+			"source":   edge.From,
+			"target":   edge.To,
+			"relation": "queue",
+			"label":    queueLabel(edge),
+			"metadata": edge,
+		})
+	}
+	return map[string]interface{}{
+		"id":       g.Name,
+		"label":    g.Name,
+		"directed": true,
+		"nodes":    nodes,
+		"edges":    edges,
+	}
+}
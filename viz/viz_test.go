@@ -0,0 +1,103 @@
+package viz
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/reservoird/reservoird/cfg"
+)
+
+func testConfig() cfg.ReservoirCfg {
+	queue := cfg.QueueItemCfg{Location: "/plugins/fifo.so"}
+	return cfg.ReservoirCfg{
+		Name: "test",
+		Graph: &cfg.GraphCfg{
+			Nodes: []cfg.NodeCfg{
+				{ID: "in", Kind: cfg.KindIngester, Location: "/plugins/stdin.so", QueueItem: queue},
+				{ID: "dig", Kind: cfg.KindDigester, Location: "exec:/plugins/upper", QueueItem: queue},
+				{ID: "a", Kind: cfg.KindExpeller, Location: "builtin:com.example.out"},
+				{ID: "b", Kind: cfg.KindExpeller, Location: "builtin:com.example.out"},
+			},
+			Edges: []cfg.EdgeCfg{
+				{From: "in", To: "dig"},
+				{From: "dig", To: "a"},
+				{From: "dig", To: "b"},
+			},
+		},
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	g, err := FromConfig(testConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(g.Nodes) != 4 || g.Nodes[1].Name != "upper" || g.Nodes[2].Name != "com.example.out" {
+		t.Errorf("expecting 4 named nodes, got %v", g.Nodes)
+	}
+	if len(g.Edges) != 3 || g.Edges[0].Queue != "fifo" || g.Edges[0].FanOut == true {
+		t.Errorf("expecting plain edge through fifo, got %v", g.Edges[0])
+	}
+	if g.Edges[2].FanOut == false || g.Edges[2].QueueID != "dig.fanout.b" {
+		t.Errorf("expecting fan-out edge to b, got %v", g.Edges[2])
+	}
+
+	config := testConfig()
+	config.Graph.Edges = config.Graph.Edges[1:]
+	_, err = FromConfig(config)
+	if err == nil {
+		t.Errorf("expecting error for invalid graph")
+	}
+}
+
+func TestRender(t *testing.T) {
+	g, _ := FromConfig(testConfig())
+	l, c := 3, 10
+	g.Edges[0].Len = &l
+	g.Edges[0].Cap = &c
+
+	dot, err := Render([]Graph{g}, FormatDot)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{
+		`digraph "test" {`,
+		`"dig" [label="dig\ndigester\nupper", shape=box];`,
+		`"in" -> "dig" [label="fifo (3/10)"];`,
+		`"dig" -> "b" [label="fifo", style=bold];`,
+	} {
+		if strings.Contains(dot, expected) == false {
+			t.Errorf("expecting %s in\n%s", expected, dot)
+		}
+	}
+
+	mermaid, _ := Render([]Graph{g}, FormatMermaid)
+	for _, expected := range []string{
+		"graph LR\n",
+		`n0[/"in<br/>ingester<br/>stdin"/]`,
+		`n0 -->|"fifo (3/10)"| n1`,
+		`n1 ==>|"fifo"| n3`,
+	} {
+		if strings.Contains(mermaid, expected) == false {
+			t.Errorf("expecting %s in\n%s", expected, mermaid)
+		}
+	}
+
+	out, _ := Render([]Graph{g, g}, FormatJSONGraph)
+	doc := struct {
+		Graphs []struct {
+			Nodes map[string]interface{} `json:"nodes"`
+			Edges []interface{}          `json:"edges"`
+		} `json:"graphs"`
+	}{}
+	err = json.Unmarshal([]byte(out), &doc)
+	if err != nil || len(doc.Graphs) != 2 || len(doc.Graphs[0].Nodes) != 4 || len(doc.Graphs[0].Edges) != 3 {
+		t.Errorf("expecting 2 json graphs, got %s (%v)", out, err)
+	}
+
+	_, err = Render([]Graph{g}, "svg")
+	if err == nil {
+		t.Errorf("expecting error for unknown format")
+	}
+}